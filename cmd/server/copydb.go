@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"deel/internal/config"
+	"deel/internal/database"
+)
+
+// runCopyDB implements "deel copy-db", which copies everything in the
+// configured store to an empty store of another backend, such as from bbolt
+// to SQLite. The server must not be running while the bbolt store is read.
+func runCopyDB(args []string) error {
+	var toStorage, toPath string
+	cfg, err := config.LoadCommand("deel copy-db", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&toStorage, "to-storage", database.SQLiteBackend, "storage backend to copy to: bolt or sqlite")
+		fs.StringVar(&toPath, "to-db-path", "", "database file to copy to, created if it does not exist")
+	})
+	if err != nil {
+		return err
+	}
+	if toPath == "" {
+		return errors.New("-to-db-path is required")
+	}
+	if toPath == cfg.DBPath {
+		return errors.New("cannot copy a database onto itself")
+	}
+
+	src, err := database.Open(cfg.Storage, cfg.DBPath)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", cfg.DBPath, err)
+	}
+	defer src.Close()
+	dst, err := database.Open(toStorage, toPath)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", toPath, err)
+	}
+
+	report, err := database.CopyStore(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Copied %d feeds with %d items (%d read, %d favorites, %d extracted articles) from %s to %s\n",
+		report.Feeds, report.Items, report.Read, report.Favorites, report.Extractions, cfg.DBPath, toPath)
+	return nil
+}
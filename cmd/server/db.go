@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"deel/internal/config"
+	"deel/internal/database"
+)
+
+// dbActions maps the actions of "deel db" to the maintenance they run;
+// every action checks the database first
+var dbActions = map[string]database.MaintenanceOptions{
+	"check":   {},
+	"gc":      {CollectGarbage: true},
+	"compact": {CollectGarbage: true, Compact: true},
+}
+
+// runDB implements "deel db check|gc|compact", which checks the
+// consistency of the configured database, deletes orphaned state and
+// rewrites the file to reclaim free space. A bbolt database cannot be
+// opened while the server runs; use the admin page then.
+func runDB(args []string) error {
+	const usage = "usage: deel db check|gc|compact [flags]"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	options, ok := dbActions[args[0]]
+	if !ok {
+		return errors.New(usage)
+	}
+	cfg, err := config.LoadCommand("deel db "+args[0], args[1:], nil)
+	if err != nil {
+		return err
+	}
+
+	store, err := database.Open(cfg.Storage, cfg.DBPath)
+	if err != nil {
+		return fmt.Errorf("opening %s, use the admin page while the server runs: %w", cfg.DBPath, err)
+	}
+	report, err := database.RunMaintenance(store, options)
+	if closeErr := store.Close(); err == nil {
+		err = closeErr
+	}
+	for _, line := range report.Lines() {
+		fmt.Println(line)
+	}
+	if err != nil {
+		return err
+	}
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%s failed the consistency check", cfg.DBPath)
+	}
+	return nil
+}
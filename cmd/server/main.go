@@ -2,21 +2,64 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"html/template"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"deel/internal/config"
 	"deel/internal/database"
 	"deel/internal/feeds"
 	"deel/internal/handlers"
+	"deel/internal/models"
 )
 
+// commands are the subcommands, run as "deel <command> [flags]"
+var commands = map[string]func(args []string) error{
+	"migrate": runMigrate,
+	"copy-db": runCopyDB,
+	"restore": runRestore,
+	"db":      runDB,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err == nil {
+		err = cfg.CheckAssets()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	closeLog, err := cfg.SetupLogging()
+	if err != nil {
+		log.Fatalf("Failed to open log file: %v", err)
+	}
+	defer closeLog()
+	log.Printf("Configuration:\n%s", cfg)
+
 	// Initialize templates
-	templates := template.Must(template.ParseFiles("templates/index.html"))
+	templates := template.Must(template.New("index.html").Funcs(handlers.TemplateFuncs()).ParseFiles(filepath.Join(cfg.TemplatesDir, "index.html"), filepath.Join(cfg.TemplatesDir, "admin.html")))
 
 	// Initialize database
-	db, err := database.NewDB()
+	db, err := database.Open(cfg.Storage, cfg.DBPath)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
@@ -28,23 +71,98 @@ func main() {
 		log.Fatalf("Failed to initialize feed manager: %v", err)
 	}
 
+	// All outgoing requests share one client with the proxy and TLS settings
+	feedManager.Client, err = feeds.NewClient(feeds.ClientOptions{
+		ProxyURL:       cfg.Proxy,
+		CAFile:         cfg.CAFile,
+		CertFile:       cfg.ClientCert,
+		KeyFile:        cfg.ClientKey,
+		DenyPrivate:    cfg.DenyPrivateNetworks,
+		DeniedNetworks: cfg.DenyNetworks,
+		MaxRedirects:   cfg.MaxRedirects,
+	})
+	if err != nil {
+		log.Fatalf("Failed to initialize HTTP client: %v", err)
+	}
+	feedManager.Workers = cfg.Workers
+	feedManager.FeedTimeout = time.Duration(cfg.FeedTimeout)
+	feedManager.RefreshInterval = time.Duration(cfg.RefreshInterval)
+	feedManager.MaxBodySize = cfg.MaxFeedSize
+	feedManager.PageItems = cfg.PageItems
+	feedManager.Retention = models.RetentionPolicy{
+		MaxItems:   cfg.KeepItems,
+		MaxAgeDays: cfg.KeepDays,
+		KeepUnread: cfg.KeepUnread,
+	}
+
+	// Enable podcast downloads when a media directory is configured
+	if cfg.MediaDir != "" {
+		feedManager.Downloads, err = feeds.NewDownloader(cfg.MediaDir)
+		if err != nil {
+			log.Fatalf("Failed to initialize media directory: %v", err)
+		}
+		feedManager.Downloads.Client = feedManager.Client
+		feedManager.Downloads.MaxSize = cfg.MaxEpisodeSize
+		feedManager.Downloads.Timeout = time.Duration(cfg.EpisodeTimeout)
+	}
+
+	// Receive pushed updates when the server is reachable from the outside
+	if cfg.PublicURL != "" {
+		feedManager.WebSubCallbackURL = strings.TrimSuffix(cfg.PublicURL, "/") + feeds.WebSubPathPrefix
+	}
+
+	// Start the background refresh scheduler, episode downloads, article
+	// extraction and pruning
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go feedManager.RunScheduler(ctx)
+	go feedManager.RunDownloads(ctx)
+	go feedManager.RunExtractions(ctx)
+	go feedManager.RunRetention(ctx)
+
+	// Write scheduled backups when a backup directory is configured
+	if cfg.BackupDir != "" {
+		schedule := database.BackupSchedule{
+			Dir:      cfg.BackupDir,
+			Name:     filepath.Base(cfg.DBPath),
+			Interval: time.Duration(cfg.BackupInterval),
+			Keep:     cfg.BackupKeep,
+		}
+		go schedule.Run(ctx, db)
+	}
+
 	// Initialize handler
 	handler := handlers.NewHandler(feedManager, templates)
+	handler.AdminToken = cfg.AdminToken
 
 	// Serve static files
-	fs := http.FileServer(http.Dir("static"))
+	fs := http.FileServer(http.Dir(cfg.StaticDir))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
 
 	// Set up routes
 	http.HandleFunc("/", handler.HandleIndex)
 	http.HandleFunc("/add", handler.HandleAddFeed)
+	http.HandleFunc("/scrape", handler.HandleScrape)
 	http.HandleFunc("/refresh", handler.HandleRefresh)
 	http.HandleFunc("/remove", handler.HandleRemoveFeed)
+	http.HandleFunc("/refresh-interval", handler.HandleSetRefreshInterval)
+	http.HandleFunc("/retry", handler.HandleRetryFeed)
+	http.HandleFunc("/feed-settings", handler.HandleSetRequestSettings)
+	http.HandleFunc("/keep-episodes", handler.HandleSetKeepEpisodes)
+	http.HandleFunc("/retention", handler.HandleSetRetention)
+	http.HandleFunc("/mark-updated-unread", handler.HandleSetMarkUpdatedUnread)
+	http.HandleFunc("/full-content", handler.HandleSetFetchFullContent)
+	http.HandleFunc("/extract", handler.HandleExtractItem)
+	http.HandleFunc(feeds.MediaURLPrefix, handler.HandleMedia)
+	http.HandleFunc(feeds.WebSubPathPrefix, handler.HandleWebSub)
 	http.HandleFunc("/toggle-read", handler.HandleToggleReadStatus)
 	http.HandleFunc("/mark-all-read", handler.HandleMarkAllRead)
 	http.HandleFunc("/toggle-favorite", handler.HandleToggleFavorite) // Add this line
+	http.HandleFunc("/admin", handler.HandleAdmin)
+	http.HandleFunc("/admin/maintenance", handler.HandleMaintenance)
+	http.HandleFunc("/admin/backup", handler.HandleBackup)
 
 	// Start the server
-	log.Println("Starting server on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	log.Printf("Starting server on %s", cfg.Listen)
+	log.Fatal(http.ListenAndServe(cfg.Listen, nil))
 }
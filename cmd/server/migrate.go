@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"deel/internal/config"
+	"deel/internal/database"
+)
+
+// runMigrate implements "deel migrate", which migrates the database to the
+// current schema version, or with -dry-run reports what that would change
+func runMigrate(args []string) error {
+	var dryRun bool
+	cfg, err := config.LoadCommand("deel migrate", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&dryRun, "dry-run", false, "report what would change without changing anything")
+	})
+	if err != nil {
+		return err
+	}
+
+	dryRunMigrations, latest := database.DryRunMigrations, database.SchemaVersion()
+	if cfg.Storage == database.SQLiteBackend {
+		dryRunMigrations, latest = database.DryRunSQLiteMigrations, database.SQLiteSchemaVersion()
+	}
+
+	if dryRun {
+		current, reports, err := dryRunMigrations(cfg.DBPath)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s is at schema version %d, the current version is %d\n", cfg.DBPath, current, latest)
+		printReports(reports)
+		return nil
+	}
+
+	db, err := database.Open(cfg.Storage, cfg.DBPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	fmt.Printf("%s is at schema version %d\n", cfg.DBPath, latest)
+	return nil
+}
+
+// printReports lists migrations and their changes
+func printReports(reports []database.MigrationReport) {
+	if len(reports) == 0 {
+		fmt.Println("No migrations pending")
+		return
+	}
+	for _, report := range reports {
+		fmt.Printf("Migration %d: %s\n", report.Version, report.Description)
+		if len(report.Changes) == 0 {
+			fmt.Println("  no changes")
+		}
+		for _, change := range report.Changes {
+			fmt.Printf("  %s\n", change)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"deel/internal/config"
+	"deel/internal/database"
+)
+
+// runRestore implements "deel restore <snapshot>", which validates a
+// snapshot taken from /admin/backup or the backup directory and puts it in
+// place of the configured database. The server must be stopped.
+func runRestore(args []string) error {
+	var flags *flag.FlagSet
+	var check bool
+	cfg, err := config.LoadCommand("deel restore", args, func(fs *flag.FlagSet) {
+		flags = fs
+		fs.BoolVar(&check, "check", false, "only validate the snapshot")
+	})
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: deel restore [flags] <snapshot>")
+	}
+	snapshot := flags.Arg(0)
+
+	if check {
+		info, err := database.ValidateSnapshot(cfg.Storage, snapshot, filepath.Dir(cfg.DBPath))
+		if err != nil {
+			return fmt.Errorf("invalid snapshot: %w", err)
+		}
+		printSnapshot(snapshot, info)
+		return nil
+	}
+
+	info, backup, err := database.Restore(cfg.Storage, cfg.DBPath, snapshot)
+	if err != nil {
+		return err
+	}
+	printSnapshot(snapshot, info)
+	if backup == "" {
+		fmt.Printf("Restored %s\n", cfg.DBPath)
+		return nil
+	}
+	fmt.Printf("Restored %s; the previous database was kept as %s\n", cfg.DBPath, backup)
+	return nil
+}
+
+// printSnapshot describes a validated snapshot
+func printSnapshot(snapshot string, info database.SnapshotInfo) {
+	fmt.Printf("%s is a valid %s database at schema version %d", snapshot, info.Backend, info.SchemaVersion)
+	if info.Feeds > 0 || info.Items > 0 {
+		fmt.Printf(" with %d feeds and %d items", info.Feeds, info.Items)
+	}
+	fmt.Println()
+}
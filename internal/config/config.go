@@ -0,0 +1,443 @@
+// Package config loads the server settings from a config file, environment
+// variables and command line flags, each overriding the one before
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+
+	"deel/internal/database"
+	"deel/internal/feeds"
+)
+
+// EnvPrefix starts the environment variable of every setting. The variable
+// is named after the setting's flag, so -db-path is read from DEEL_DB_PATH.
+const EnvPrefix = "DEEL_"
+
+// Config holds every server setting. Keys in a config file are the flag
+// names with underscores, such as db_path for -db-path.
+type Config struct {
+	// Server
+	Listen       string `toml:"listen" yaml:"listen"`               // address the HTTP server listens on
+	PublicURL    string `toml:"public_url" yaml:"public_url"`       // URL WebSub hubs reach this server at, push is disabled if empty
+	TemplatesDir string `toml:"templates_dir" yaml:"templates_dir"` // directory holding index.html
+	StaticDir    string `toml:"static_dir" yaml:"static_dir"`       // directory served under /static/
+	PageItems    int    `toml:"page_items" yaml:"page_items"`       // newest items shown on a page
+
+	// Storage
+	Storage  string `toml:"storage" yaml:"storage"`     // storage backend, bolt or sqlite
+	DBPath   string `toml:"db_path" yaml:"db_path"`     // database file, the encryption key is kept next to it
+	MediaDir string `toml:"media_dir" yaml:"media_dir"` // podcast episode downloads, disabled if empty
+
+	MaxEpisodeSize int64    `toml:"max_episode_size" yaml:"max_episode_size"` // largest episode downloaded, in bytes
+	EpisodeTimeout Duration `toml:"episode_timeout" yaml:"episode_timeout"`   // deadline for downloading a single episode
+
+	// Backups
+	AdminToken     string   `toml:"admin_token" yaml:"admin_token"`         // password of the admin endpoints, which are disabled if empty
+	BackupDir      string   `toml:"backup_dir" yaml:"backup_dir"`           // scheduled backups, disabled if empty
+	BackupInterval Duration `toml:"backup_interval" yaml:"backup_interval"` // time between scheduled backups
+	BackupKeep     int      `toml:"backup_keep" yaml:"backup_keep"`         // scheduled backups kept
+
+	// Refreshing
+	RefreshInterval Duration `toml:"refresh_interval" yaml:"refresh_interval"` // default polling interval
+	Workers         int      `toml:"workers" yaml:"workers"`                   // feeds fetched in parallel
+	FeedTimeout     Duration `toml:"feed_timeout" yaml:"feed_timeout"`         // deadline for fetching a single feed
+	MaxFeedSize     int64    `toml:"max_feed_size" yaml:"max_feed_size"`       // largest feed document accepted, in bytes
+	MaxRedirects    int      `toml:"max_redirects" yaml:"max_redirects"`       // redirects followed per request
+
+	// Outgoing requests
+	Proxy               string   `toml:"proxy" yaml:"proxy"`                                 // http, https or socks5 proxy, the proxy environment variables are used if empty
+	CAFile              string   `toml:"ca_file" yaml:"ca_file"`                             // extra trusted certificate authorities
+	ClientCert          string   `toml:"client_cert" yaml:"client_cert"`                     // client certificate for servers that require one
+	ClientKey           string   `toml:"client_key" yaml:"client_key"`                       // private key of ClientCert
+	DenyPrivateNetworks bool     `toml:"deny_private_networks" yaml:"deny_private_networks"` // refuse private, loopback and link-local addresses
+	DenyNetworks        []string `toml:"deny_networks" yaml:"deny_networks"`                 // further CIDR networks feeds may not be fetched from
+
+	// Retention
+	KeepItems  int  `toml:"keep_items" yaml:"keep_items"`   // newest items kept per feed, zero keeps all
+	KeepDays   int  `toml:"keep_days" yaml:"keep_days"`     // days items are kept, zero keeps them forever
+	KeepUnread bool `toml:"keep_unread" yaml:"keep_unread"` // never prune unread items
+
+	// Logging
+	LogFile       string `toml:"log_file" yaml:"log_file"`             // log destination, standard error if empty
+	LogTimestamps bool   `toml:"log_timestamps" yaml:"log_timestamps"` // prefix log lines with the time
+}
+
+// Default returns the settings used when nothing else is configured
+func Default() Config {
+	return Config{
+		Listen:          ":8080",
+		TemplatesDir:    "templates",
+		StaticDir:       "static",
+		PageItems:       feeds.DefaultPageItems,
+		Storage:         database.BoltBackend,
+		DBPath:          database.DBPath,
+		MaxEpisodeSize:  feeds.DefaultMaxEpisodeSize,
+		EpisodeTimeout:  Duration(feeds.DefaultDownloadTimeout),
+		BackupInterval:  Duration(24 * time.Hour),
+		BackupKeep:      7,
+		RefreshInterval: Duration(feeds.DefaultRefreshInterval),
+		Workers:         feeds.DefaultWorkers,
+		FeedTimeout:     Duration(feeds.DefaultFeedTimeout),
+		MaxFeedSize:     feeds.DefaultMaxBodySize,
+		MaxRedirects:    feeds.DefaultMaxRedirects,
+		LogTimestamps:   true,
+	}
+}
+
+// Load builds the configuration from, in increasing order of precedence,
+// the defaults, the config file given with -config or DEEL_CONFIG, the
+// environment and the command line arguments. PORT is honored as a
+// shorthand for the listen address, as set by container platforms.
+func Load(args []string) (Config, error) {
+	return LoadCommand("deel", args, nil)
+}
+
+// LoadCommand is Load for a subcommand, which may register flags of its
+// own on the flag set before the arguments are parsed
+func LoadCommand(name string, args []string, register func(fs *flag.FlagSet)) (Config, error) {
+	cfg := Default()
+
+	// Parse the flags on their own first, to find the config file and to
+	// learn which settings the command line overrides
+	cmdline := Default()
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(EnvPrefix+"CONFIG"), "TOML or YAML config file")
+	bind(fs, &cmdline)
+	if register != nil {
+		register(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *configPath != "" {
+		if err := loadFile(*configPath, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	settings := flag.NewFlagSet("deel", flag.ContinueOnError)
+	settings.SetOutput(io.Discard)
+	bind(settings, &cfg)
+
+	if port := os.Getenv("PORT"); port != "" {
+		cfg.Listen = ":" + port
+	}
+	var envErr error
+	settings.VisitAll(func(f *flag.Flag) {
+		name := EnvPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok && envErr == nil {
+			if err := settings.Set(f.Name, value); err != nil {
+				envErr = fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	})
+	if envErr != nil {
+		return cfg, envErr
+	}
+
+	// Replay the flags that were given over the file and environment
+	fs.Visit(func(f *flag.Flag) {
+		if settings.Lookup(f.Name) != nil {
+			settings.Set(f.Name, f.Value.String())
+		}
+	})
+
+	return cfg, cfg.Validate()
+}
+
+// bind registers a flag for every setting, storing into cfg. The current
+// values of cfg are the flag defaults.
+func bind(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "address the HTTP server listens on")
+	fs.StringVar(&cfg.PublicURL, "public-url", cfg.PublicURL, "URL this server is reachable at by WebSub hubs, e.g. https://reader.example.com; push updates are disabled if empty")
+	fs.StringVar(&cfg.TemplatesDir, "templates-dir", cfg.TemplatesDir, "directory holding the HTML templates")
+	fs.StringVar(&cfg.StaticDir, "static-dir", cfg.StaticDir, "directory of the static files")
+	fs.IntVar(&cfg.PageItems, "page-items", cfg.PageItems, "newest items shown on a page, older ones are not loaded")
+
+	fs.StringVar(&cfg.Storage, "storage", cfg.Storage, "storage backend: bolt or sqlite")
+	fs.StringVar(&cfg.DBPath, "db-path", cfg.DBPath, "database file; the encryption key is kept in the same directory")
+	fs.StringVar(&cfg.MediaDir, "media-dir", cfg.MediaDir, "directory podcast episodes are downloaded to, downloads are disabled if empty")
+	fs.Int64Var(&cfg.MaxEpisodeSize, "max-episode-size", cfg.MaxEpisodeSize, "largest podcast episode downloaded, in bytes")
+	fs.Var(&cfg.EpisodeTimeout, "episode-timeout", "deadline for downloading a single podcast episode, resumed on the next sync if exceeded")
+
+	fs.StringVar(&cfg.AdminToken, "admin-token", cfg.AdminToken, "password of the admin endpoints such as /admin/backup, which are disabled if empty")
+	fs.StringVar(&cfg.BackupDir, "backup-dir", cfg.BackupDir, "directory database backups are written to, scheduled backups are disabled if empty")
+	fs.Var(&cfg.BackupInterval, "backup-interval", "time between scheduled backups")
+	fs.IntVar(&cfg.BackupKeep, "backup-keep", cfg.BackupKeep, "scheduled backups kept, older ones are deleted")
+
+	fs.Var(&cfg.RefreshInterval, "refresh-interval", "default interval feeds are polled at")
+	fs.IntVar(&cfg.Workers, "workers", cfg.Workers, "feeds fetched in parallel")
+	fs.Var(&cfg.FeedTimeout, "feed-timeout", "deadline for fetching a single feed")
+	fs.Int64Var(&cfg.MaxFeedSize, "max-feed-size", cfg.MaxFeedSize, "largest feed document accepted, in bytes")
+	fs.IntVar(&cfg.MaxRedirects, "max-redirects", cfg.MaxRedirects, "redirects followed per request, at least 1")
+
+	fs.StringVar(&cfg.Proxy, "proxy", cfg.Proxy, "http, https or socks5 proxy for all outgoing requests, defaults to the HTTP_PROXY and HTTPS_PROXY environment variables")
+	fs.StringVar(&cfg.CAFile, "ca-file", cfg.CAFile, "PEM bundle of extra certificate authorities to trust")
+	fs.StringVar(&cfg.ClientCert, "client-cert", cfg.ClientCert, "PEM client certificate for servers that require one")
+	fs.StringVar(&cfg.ClientKey, "client-key", cfg.ClientKey, "PEM private key of the client certificate")
+	fs.BoolVar(&cfg.DenyPrivateNetworks, "deny-private-networks", cfg.DenyPrivateNetworks, "refuse fetching feeds from private, loopback and link-local addresses")
+	fs.Var((*listValue)(&cfg.DenyNetworks), "deny-networks", "comma separated CIDR networks feeds may not be fetched from")
+
+	fs.IntVar(&cfg.KeepItems, "keep-items", cfg.KeepItems, "newest items kept per feed, zero keeps all")
+	fs.IntVar(&cfg.KeepDays, "keep-days", cfg.KeepDays, "days items are kept after they were published, zero keeps them forever")
+	fs.BoolVar(&cfg.KeepUnread, "keep-unread", cfg.KeepUnread, "never prune unread items")
+
+	fs.StringVar(&cfg.LogFile, "log-file", cfg.LogFile, "file to append the log to, standard error if empty")
+	fs.BoolVar(&cfg.LogTimestamps, "log-timestamps", cfg.LogTimestamps, "prefix log lines with the date and time")
+}
+
+// loadFile decodes a TOML or YAML config file, chosen by its extension.
+// Unknown keys are rejected so typos do not go unnoticed.
+func loadFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		decoder := toml.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(cfg)
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(cfg); errors.Is(err, io.EOF) {
+			err = nil // an empty file
+		}
+	default:
+		return fmt.Errorf("config file %s must end in .toml, .yaml or .yml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks the settings for values the server cannot run with
+func (c Config) Validate() error {
+	var problems []string
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		problems = append(problems, fmt.Sprintf("listen address %q: %v", c.Listen, err))
+	}
+	if c.Storage != database.BoltBackend && c.Storage != database.SQLiteBackend {
+		problems = append(problems, fmt.Sprintf("storage %q is not bolt or sqlite", c.Storage))
+	}
+	if c.DBPath == "" {
+		problems = append(problems, "db_path is empty")
+	}
+	if c.PageItems < 1 {
+		problems = append(problems, "page_items must be at least 1")
+	}
+	if c.BackupDir != "" {
+		if time.Duration(c.BackupInterval) < time.Minute {
+			problems = append(problems, "backup_interval must be at least 1m")
+		}
+		if c.BackupKeep < 1 {
+			problems = append(problems, "backup_keep must be at least 1")
+		}
+	}
+	if c.PublicURL != "" {
+		if u, err := url.Parse(c.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("public_url %q is not an http or https URL", c.PublicURL))
+		}
+	}
+	if time.Duration(c.RefreshInterval) < feeds.MinRefreshInterval {
+		problems = append(problems, fmt.Sprintf("refresh_interval must be at least %s", feeds.MinRefreshInterval))
+	}
+	if c.Workers < 1 {
+		problems = append(problems, "workers must be at least 1")
+	}
+	if c.FeedTimeout <= 0 {
+		problems = append(problems, "feed_timeout must be positive")
+	}
+	if c.MaxFeedSize <= 0 {
+		problems = append(problems, "max_feed_size must be positive")
+	}
+	if c.MaxEpisodeSize <= 0 {
+		problems = append(problems, "max_episode_size must be positive")
+	}
+	if c.EpisodeTimeout <= 0 {
+		problems = append(problems, "episode_timeout must be positive")
+	}
+	if c.MaxRedirects < 1 {
+		// The client treats zero as unset and would follow the default
+		problems = append(problems, "max_redirects must be at least 1")
+	}
+	if c.Proxy != "" {
+		if _, err := feeds.ParseProxyURL(c.Proxy); err != nil {
+			problems = append(problems, fmt.Sprintf("proxy: %v", err))
+		}
+	}
+	if (c.ClientCert == "") != (c.ClientKey == "") {
+		problems = append(problems, "client_cert and client_key must be set together")
+	}
+	for _, cidr := range c.DenyNetworks {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			problems = append(problems, fmt.Sprintf("deny_networks: %v", err))
+		}
+	}
+	if c.KeepItems < 0 || c.KeepDays < 0 {
+		problems = append(problems, "keep_items and keep_days cannot be negative")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// CheckAssets checks that the template and static directories exist, which
+// only the web server needs
+func (c Config) CheckAssets() error {
+	for name, dir := range map[string]string{"templates_dir": c.TemplatesDir, "static_dir": c.StaticDir} {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("invalid configuration: %s %q is not a directory", name, dir)
+		}
+	}
+	return nil
+}
+
+// SetupLogging points the standard logger at the configured destination.
+// The returned function closes the log file, if any.
+func (c Config) SetupLogging() (func() error, error) {
+	flags := 0
+	if c.LogTimestamps {
+		flags = log.LstdFlags
+	}
+	log.SetFlags(flags)
+
+	if c.LogFile == "" {
+		return func() error { return nil }, nil
+	}
+	f, err := os.OpenFile(c.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	log.SetOutput(f)
+	return f.Close, nil
+}
+
+// String lists the settings one per line, with the admin token and the
+// password of the proxy URL masked
+func (c Config) String() string {
+	proxy := c.Proxy
+	if u, err := url.Parse(proxy); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+			proxy = u.String()
+		}
+	}
+
+	var b strings.Builder
+	for _, setting := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"listen", c.Listen},
+		{"public_url", c.PublicURL},
+		{"templates_dir", c.TemplatesDir},
+		{"static_dir", c.StaticDir},
+		{"page_items", c.PageItems},
+		{"storage", c.Storage},
+		{"db_path", c.DBPath},
+		{"media_dir", c.MediaDir},
+		{"max_episode_size", c.MaxEpisodeSize},
+		{"episode_timeout", c.EpisodeTimeout},
+		{"admin_token", mask(c.AdminToken)},
+		{"backup_dir", c.BackupDir},
+		{"backup_interval", c.BackupInterval},
+		{"backup_keep", c.BackupKeep},
+		{"refresh_interval", c.RefreshInterval},
+		{"workers", c.Workers},
+		{"feed_timeout", c.FeedTimeout},
+		{"max_feed_size", c.MaxFeedSize},
+		{"max_redirects", c.MaxRedirects},
+		{"proxy", proxy},
+		{"ca_file", c.CAFile},
+		{"client_cert", c.ClientCert},
+		{"client_key", c.ClientKey},
+		{"deny_private_networks", c.DenyPrivateNetworks},
+		{"deny_networks", strings.Join(c.DenyNetworks, ",")},
+		{"keep_items", c.KeepItems},
+		{"keep_days", c.KeepDays},
+		{"keep_unread", c.KeepUnread},
+		{"log_file", c.LogFile},
+		{"log_timestamps", c.LogTimestamps},
+	} {
+		fmt.Fprintf(&b, "  %-23s %v\n", setting.name, setting.value)
+	}
+	return b.String()
+}
+
+// mask hides a secret setting, showing only whether it is set
+func mask(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "xxxxx"
+}
+
+// Duration is a time.Duration written as "30m" or "1h30m" in config
+// files, the environment and flags
+type Duration time.Duration
+
+// String formats the duration like time.Duration
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Set parses a duration, implementing flag.Value
+func (d *Duration) Set(value string) error {
+	parsed, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// UnmarshalText parses a duration from a config file
+func (d *Duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
+
+// MarshalText formats a duration for a config file
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// listValue is a comma separated list flag
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// backupTimeFormat is the time in the names of scheduled backups. It sorts
+// in time order.
+const backupTimeFormat = "20060102-150405"
+
+// Snapshot writes a consistent copy of the database to w while it stays in
+// use, and returns the number of bytes written. Writers are not blocked.
+func (db *DB) Snapshot(w io.Writer) (int64, error) {
+	var n int64
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// Backend returns BoltBackend
+func (db *DB) Backend() string {
+	return BoltBackend
+}
+
+// Snapshot writes a consistent copy of the database to w while it stays in
+// use, and returns the number of bytes written. The copy is made with
+// VACUUM INTO next to the database file, then streamed and removed.
+func (db *SQLiteDB) Snapshot(w io.Writer) (int64, error) {
+	f, err := os.CreateTemp(filepath.Dir(db.path), filepath.Base(db.path)+".snapshot-*")
+	if err != nil {
+		return 0, err
+	}
+	tmp := f.Name()
+	f.Close()
+	defer os.Remove(tmp)
+	// VACUUM INTO refuses to overwrite a file
+	if err := os.Remove(tmp); err != nil {
+		return 0, err
+	}
+
+	if _, err := db.Exec(`VACUUM INTO ?`, tmp); err != nil {
+		return 0, err
+	}
+	f, err = os.Open(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// Backend returns SQLiteBackend
+func (db *SQLiteDB) Backend() string {
+	return SQLiteBackend
+}
+
+// BackupSchedule writes snapshots of a store to a directory at a fixed
+// interval and deletes all but the newest ones
+type BackupSchedule struct {
+	Dir      string        // directory the backups are written to, created if needed
+	Name     string        // file name of the database, backups are named after it
+	Interval time.Duration // time between backups
+	Keep     int           // number of backups kept, at least one
+}
+
+// Run writes a backup every Interval until ctx is cancelled
+func (s BackupSchedule) Run(ctx context.Context, store Store) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			path, err := s.WriteBackup(store, now)
+			if err != nil {
+				log.Printf("Error backing up database: %v", err)
+				continue
+			}
+			log.Printf("Backed up database to %s", path)
+		}
+	}
+}
+
+// WriteBackup writes a snapshot of store named after now, copies the key
+// file next to it, then deletes the backups beyond Keep. It returns the
+// path of the new backup.
+func (s BackupSchedule) WriteBackup(store Store, now time.Time) (string, error) {
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return "", err
+	}
+	prefix, ext := s.nameParts()
+	path := filepath.Join(s.Dir, prefix+now.Format(backupTimeFormat)+ext)
+
+	// Write to a temporary file first, so a failed backup never looks like
+	// a complete one and never counts towards Keep
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = store.Snapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	// The snapshot is useless without the key that encrypts its request
+	// settings, so keep a copy of it with the backups
+	if err := s.copyKey(filepath.Join(filepath.Dir(store.Path()), KeyFileName)); err != nil {
+		return path, fmt.Errorf("copying %s: %w", KeyFileName, err)
+	}
+	if err := s.rotate(); err != nil {
+		return path, fmt.Errorf("deleting old backups: %w", err)
+	}
+	return path, nil
+}
+
+// copyKey copies the key file at keyPath into Dir, unless an identical
+// copy is there already
+func (s BackupSchedule) copyKey(keyPath string) error {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(s.Dir, KeyFileName)
+	if existing, err := os.ReadFile(dst); err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+	tmp := dst + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// rotate deletes all but the newest Keep backups
+func (s BackupSchedule) rotate() error {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+	prefix, ext := s.nameParts()
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		if _, err := time.Parse(backupTimeFormat, stamp); err != nil {
+			continue // not one of ours
+		}
+		backups = append(backups, name)
+	}
+
+	keep := s.Keep
+	if keep < 1 {
+		keep = 1
+	}
+	sort.Strings(backups)
+	for len(backups) > keep {
+		if err := os.Remove(filepath.Join(s.Dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// nameParts splits Name into the prefix and extension of backup names:
+// rss_feeds.db is backed up as rss_feeds-<time>.db
+func (s BackupSchedule) nameParts() (prefix, ext string) {
+	ext = filepath.Ext(s.Name)
+	return strings.TrimSuffix(s.Name, ext) + "-", ext
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"deel/internal/models"
+)
+
+// populateStore stores a feed with request settings and items with read,
+// favorite and extraction state
+func populateStore(t *testing.T, store Store) {
+	t.Helper()
+	const feedURL = "http://example.com/feed"
+	feed := models.Feed{
+		URL:     feedURL,
+		Title:   "Feed",
+		Request: models.RequestSettings{Username: "reader", Password: "secret"},
+	}
+	if err := store.SaveFeed(feed); err != nil {
+		t.Fatal(err)
+	}
+	published := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	var items []models.FeedItem
+	for i, title := range []string{"one", "two", "three"} {
+		items = append(items, storeItem(feedURL, title, true, published.Add(time.Duration(i)*time.Hour)))
+	}
+	if _, err := store.SaveFeedItems(feedURL, items); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetFeedItemReadStatus(items[0].ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetFeedItemFavoriteStatus(items[1].ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveExtraction(items[2].ID, models.Extraction{Content: "<p>Full</p>", Extracted: published}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storeContents returns the feeds and items of a store
+func storeContents(t *testing.T, store Store) ([]models.Feed, []models.FeedItem) {
+	t.Helper()
+	feeds, err := store.LoadFeeds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := store.LoadAllFeedItems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return feeds, items
+}
+
+// TestBackupRestore backs up a populated store while it is open, restores
+// the backup into a new directory and compares the contents
+func TestBackupRestore(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		populateStore(t, store)
+		wantFeeds, wantItems := storeContents(t, store)
+
+		schedule := BackupSchedule{Dir: t.TempDir(), Name: filepath.Base(store.Path()), Keep: 1}
+		backup, err := schedule.WriteBackup(store, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The key is restored from the copy kept with the backups
+		dir := t.TempDir()
+		key, err := os.ReadFile(filepath.Join(schedule.Dir, KeyFileName))
+		if err != nil {
+			t.Fatalf("backup directory lacks the key: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, KeyFileName), key, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(dir, filepath.Base(store.Path()))
+		info, previous, err := Restore(store.Backend(), path, backup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Feeds != len(wantFeeds) || info.Items != len(wantItems) {
+			t.Errorf("restored %d feeds and %d items, want %d and %d", info.Feeds, info.Items, len(wantFeeds), len(wantItems))
+		}
+		if previous != "" {
+			t.Errorf("restoring into a new path kept %s, want no previous database", previous)
+		}
+
+		restored, err := Open(store.Backend(), path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer restored.Close()
+		feeds, items := storeContents(t, restored)
+		if !reflect.DeepEqual(feeds, wantFeeds) {
+			t.Errorf("restored feeds %+v, want %+v", feeds, wantFeeds)
+		}
+		if !reflect.DeepEqual(items, wantItems) {
+			t.Errorf("restored items %+v, want %+v", items, wantItems)
+		}
+	})
+}
+
+// TestBackupRotation checks that scheduled backups beyond Keep are deleted,
+// oldest first, and files that are not backups are left alone
+func TestBackupRotation(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		populateStore(t, store)
+		schedule := BackupSchedule{Dir: t.TempDir(), Name: filepath.Base(store.Path()), Keep: 3}
+		prefix, ext := schedule.nameParts()
+		foreign := prefix + "manual" + ext
+		if err := os.WriteFile(filepath.Join(schedule.Dir, foreign), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+		var written []string
+		for i := 0; i < schedule.Keep+2; i++ {
+			backup, err := schedule.WriteBackup(store, start.Add(time.Duration(i)*time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			written = append(written, filepath.Base(backup))
+		}
+
+		want := append([]string{foreign, KeyFileName}, written[len(written)-schedule.Keep:]...)
+		sort.Strings(want)
+		if got := dirNames(t, schedule.Dir); !reflect.DeepEqual(got, want) {
+			t.Errorf("backup directory holds %v, want %v", got, want)
+		}
+	})
+}
@@ -4,6 +4,8 @@ package database
 import (
 	"encoding/json"
 	"log"
+	"path/filepath"
+	"sync"
 	"time"
 
 	bolt "go.etcd.io/bbolt"
@@ -12,49 +14,48 @@ import (
 )
 
 const (
-	// DBPath is the path to the database file
+	// DBPath is the default path to the database file
 	DBPath = "rss_feeds.db"
 	
 	// BucketName is the name of the bucket for feeds
 	BucketName = "feeds"
 	
-	// FeedItemStatusBucketName is the name of the bucket for feed item statuses
+	// FeedItemStatusBucketName is the name of the bucket for feed item statuses, keyed by item ID
 	FeedItemStatusBucketName = "feedItemStatus"
 
-	// FeedItemFavoriteBucketName is the name of the bucket for feed item favorite statuses
+	// FeedItemFavoriteBucketName is the name of the bucket for feed item favorite statuses, keyed by item ID
 	FeedItemFavoriteBucketName = "feedItemFavorite"
 )
 
 // DB wraps the bolt database
 type DB struct {
 	*bolt.DB
+	key []byte // encrypts the request settings, see KeyFileName
+
+	// swapMu guards the bolt database against being replaced by Compact
+	// while a transaction runs; see View and Update
+	swapMu sync.RWMutex
 }
 
-// NewDB initializes and returns a new database connection
-func NewDB() (*DB, error) {
-	db, err := bolt.Open(DBPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+// NewDB opens the database at path, creating it and its key if needed, and
+// migrates it to the current schema version
+func NewDB(path string) (*DB, error) {
+	key, err := loadKey(filepath.Join(filepath.Dir(path), KeyFileName))
 	if err != nil {
 		return nil, err
 	}
 
-	// Create buckets if they don't exist
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(BucketName))
-		if err != nil {
-			return err
-		}
-		_, err = tx.CreateBucketIfNotExists([]byte(FeedItemStatusBucketName))
-		if err != nil {
-			return err
-		}
-		_, err = tx.CreateBucketIfNotExists([]byte(FeedItemFavoriteBucketName))
-		return err
-	})
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
 		return nil, err
 	}
 
-	return &DB{DB: db}, nil
+	if _, err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &DB{DB: db, key: key}, nil
 }
 
 // LoadFeeds loads all feeds from the database
@@ -69,6 +70,11 @@ func (db *DB) LoadFeeds() ([]models.Feed, error) {
 			if err := json.Unmarshal(v, &feed); err != nil {
 				return err
 			}
+			settings, err := db.getRequestSettings(tx, feed.URL)
+			if err != nil {
+				return err
+			}
+			feed.Request = settings
 			feeds = append(feeds, feed)
 			return nil
 		})
@@ -91,76 +97,113 @@ func (db *DB) SaveFeed(feed models.Feed) error {
 			return err
 		}
 
-		return b.Put([]byte(feed.URL), encoded)
+		if err := b.Put([]byte(feed.URL), encoded); err != nil {
+			return err
+		}
+		return db.putRequestSettings(tx, feed.URL, feed.Request)
+	})
+}
+
+// RenameFeed stores a feed under its new URL and removes the record kept
+// under oldURL, moving its stored items along, in a single transaction
+func (db *DB) RenameFeed(oldURL string, feed models.Feed) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BucketName))
+
+		encoded, err := json.Marshal(feed)
+		if err != nil {
+			return err
+		}
+
+		if err := b.Delete([]byte(oldURL)); err != nil {
+			return err
+		}
+		if err := b.Put([]byte(feed.URL), encoded); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(FeedRequestBucketName)).Delete([]byte(oldURL)); err != nil {
+			return err
+		}
+		if err := db.putRequestSettings(tx, feed.URL, feed.Request); err != nil {
+			return err
+		}
+		return renameFeedItems(tx, oldURL, feed.URL)
 	})
 }
 
-// RemoveFeed removes a feed from the database
+// RemoveFeed removes a feed and its stored items, with their read and
+// favorite state and cached extractions, from the database
 func (db *DB) RemoveFeed(feedURL string) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(BucketName))
-		return b.Delete([]byte(feedURL))
+		if err := b.Delete([]byte(feedURL)); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(FeedRequestBucketName)).Delete([]byte(feedURL)); err != nil {
+			return err
+		}
+		return removeFeedItems(tx, feedURL)
 	})
 }
 
-// GetFeedItemReadStatus retrieves the read status of a feed item from the database.
+// GetFeedItemReadStatus retrieves the read status of a feed item by its ID from the database.
 // It defaults to false (unread) if the item is not found.
-func (db *DB) GetFeedItemReadStatus(link string) bool {
+func (db *DB) GetFeedItemReadStatus(itemID string) bool {
 	var isRead bool
 	err := db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(FeedItemStatusBucketName))
-		val := b.Get([]byte(link))
+		val := b.Get([]byte(itemID))
 		if val != nil && string(val) == "true" {
 			isRead = true
 		}
 		return nil
 	})
 	if err != nil {
-		log.Printf("Error getting read status for %s: %v", link, err)
+		log.Printf("Error getting read status for %s: %v", itemID, err)
 		return false // Default to unread on error
 	}
 	return isRead
 }
 
-// SetFeedItemReadStatus sets the read status of a feed item in the database.
-func (db *DB) SetFeedItemReadStatus(link string, read bool) error {
+// SetFeedItemReadStatus sets the read status of a feed item by its ID in the database.
+func (db *DB) SetFeedItemReadStatus(itemID string, read bool) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(FeedItemStatusBucketName))
 		val := "false"
 		if read {
 			val = "true"
 		}
-		return b.Put([]byte(link), []byte(val))
+		return b.Put([]byte(itemID), []byte(val))
 	})
 }
 
-// GetFeedItemFavoriteStatus retrieves the favorite status of a feed item from the database.
+// GetFeedItemFavoriteStatus retrieves the favorite status of a feed item by its ID from the database.
 // It defaults to false (not favorited) if the item is not found.
-func (db *DB) GetFeedItemFavoriteStatus(link string) bool {
+func (db *DB) GetFeedItemFavoriteStatus(itemID string) bool {
 	var isFavorite bool
 	err := db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(FeedItemFavoriteBucketName))
-		val := b.Get([]byte(link))
+		val := b.Get([]byte(itemID))
 		if val != nil {
 			isFavorite = (string(val) == "true")
 		}
 		return nil
 	})
 	if err != nil {
-		log.Printf("Error getting favorite status for %s: %v", link, err)
+		log.Printf("Error getting favorite status for %s: %v", itemID, err)
 		return false // Default to false on error
 	}
 	return isFavorite
 }
 
-// SetFeedItemFavoriteStatus sets the favorite status of a feed item in the database.
-func (db *DB) SetFeedItemFavoriteStatus(link string, favorite bool) error {
+// SetFeedItemFavoriteStatus sets the favorite status of a feed item by its ID in the database.
+func (db *DB) SetFeedItemFavoriteStatus(itemID string, favorite bool) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(FeedItemFavoriteBucketName))
 		val := "false"
 		if favorite {
 			val = "true"
 		}
-		return b.Put([]byte(link), []byte(val))
+		return b.Put([]byte(itemID), []byte(val))
 	})
 }
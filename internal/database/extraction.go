@@ -0,0 +1,39 @@
+package database
+
+import (
+	"encoding/json"
+
+	bolt "go.etcd.io/bbolt"
+
+	"deel/internal/models"
+)
+
+// ExtractionBucketName is the name of the bucket caching the full text
+// extracted from item articles, keyed by item ID
+const ExtractionBucketName = "itemExtraction"
+
+// SaveExtraction caches the result of extracting the article of an item,
+// replacing any earlier result
+func (db *DB) SaveExtraction(itemID string, extraction models.Extraction) error {
+	encoded, err := json.Marshal(extraction)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(ExtractionBucketName)).Put([]byte(itemID), encoded)
+	})
+}
+
+// applyExtraction fills in the cached extraction of an item, if any
+func applyExtraction(b *bolt.Bucket, item *models.FeedItem) {
+	encoded := b.Get([]byte(item.ID))
+	if encoded == nil {
+		return
+	}
+	var extraction models.Extraction
+	if err := json.Unmarshal(encoded, &extraction); err != nil {
+		return
+	}
+	item.FullContent = extraction.Content
+	item.ExtractionError = extraction.Error
+}
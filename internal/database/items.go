@@ -0,0 +1,658 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"deel/internal/models"
+	"deel/internal/utils"
+)
+
+const (
+	// FeedItemsBucketName is the name of the bucket for feed items.
+	// It holds one nested bucket per feed URL, each containing an items
+	// bucket keyed by item ID, a byTime index keyed by publish time and a
+	// byLink index of the items without a GUID.
+	FeedItemsBucketName = "feedItems"
+)
+
+var (
+	itemsBucketName  = []byte("items")
+	byTimeBucketName = []byte("byTime")
+	byLinkBucketName = []byte("byLink")
+)
+
+// timeKey builds the byTime index key for an item: the big-endian publish
+// time followed by the item ID, so a cursor walks a feed in time order.
+// Undated items sort before everything else.
+func timeKey(published time.Time, itemID string) []byte {
+	key := make([]byte, 8+len(itemID))
+	binary.BigEndian.PutUint64(key, publishedNanos(published))
+	copy(key[8:], itemID)
+	return key
+}
+
+// publishedNanos returns the publish time items are ordered by, in Unix
+// nanoseconds. Undated items and items dated before 1970 get zero.
+func publishedNanos(published time.Time) uint64 {
+	if published.IsZero() || published.UnixNano() <= 0 {
+		return 0
+	}
+	return uint64(published.UnixNano())
+}
+
+// SaveResult summarizes what SaveFeedItems changed
+type SaveResult struct {
+	Added   int      // items that were not stored before
+	Revised []string // IDs of read items whose content the publisher changed
+}
+
+// SaveFeedItems merges items into the store of a feed. New items are added,
+// known items are updated in place and items missing from the list are kept.
+// Items must have their ID set. When a read item changes, the version that
+// was read is kept as its previous revision.
+func (db *DB) SaveFeedItems(feedURL string, items []models.FeedItem) (SaveResult, error) {
+	var result SaveResult
+	now := time.Now()
+	err := db.Update(func(tx *bolt.Tx) error {
+		status := tx.Bucket([]byte(FeedItemStatusBucketName))
+		favorite := tx.Bucket([]byte(FeedItemFavoriteBucketName))
+
+		feedBucket, err := tx.Bucket([]byte(FeedItemsBucketName)).CreateBucketIfNotExists([]byte(feedURL))
+		if err != nil {
+			return err
+		}
+		byKey, err := feedBucket.CreateBucketIfNotExists(itemsBucketName)
+		if err != nil {
+			return err
+		}
+		byTime, err := feedBucket.CreateBucketIfNotExists(byTimeBucketName)
+		if err != nil {
+			return err
+		}
+		byLink, err := feedBucket.CreateBucketIfNotExists(byLinkBucketName)
+		if err != nil {
+			return err
+		}
+
+		saved := make(map[string]bool) // IDs stored by this call
+		for _, item := range items {
+			key := item.ID
+			if key == "" {
+				continue
+			}
+
+			item.ContentHash = utils.ContentHash(item.Title, item.Description, item.Content)
+			if existing := byKey.Get([]byte(key)); existing != nil {
+				var stored models.FeedItem
+				if err := json.Unmarshal(existing, &stored); err == nil {
+					if err := byTime.Delete(timeKey(stored.PublishedTime, key)); err != nil {
+						return err
+					}
+					item.Previous = stored.Previous
+					// Items stored before hashes were kept cannot be compared
+					if stored.ContentHash != "" && stored.ContentHash != item.ContentHash &&
+						string(status.Get([]byte(key))) == "true" {
+						item.Previous = &models.ItemRevision{
+							Title:       stored.Title,
+							Description: stored.Description,
+							Content:     stored.Content,
+							Replaced:    now,
+						}
+						result.Revised = append(result.Revised, key)
+					}
+				}
+			} else {
+				result.Added++
+				if old, ok := linkedItem(byKey, byLink, item.Link); ok && !saved[old.ID] {
+					// Replace the earlier version, carrying its state over
+					result.Added--
+					if err := moveItemState(status, favorite, old.ID, key); err != nil {
+						return err
+					}
+					if err := byKey.Delete([]byte(old.ID)); err != nil {
+						return err
+					}
+					if err := byTime.Delete(timeKey(old.PublishedTime, old.ID)); err != nil {
+						return err
+					}
+					if err := unindexLink(byLink, old); err != nil {
+						return err
+					}
+				} else if err := adoptLinkState(status, favorite, item); err != nil {
+					return err
+				}
+			}
+
+			item.FeedURLOrigin = feedURL
+			encoded, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			if err := byKey.Put([]byte(key), encoded); err != nil {
+				return err
+			}
+			if err := byTime.Put(timeKey(item.PublishedTime, key), []byte(key)); err != nil {
+				return err
+			}
+			if err := indexLink(byLink, item); err != nil {
+				return err
+			}
+			saved[key] = true
+		}
+		return nil
+	})
+	return result, err
+}
+
+// indexLink records an item without a GUID in the byLink index. Such items
+// have a fallback ID that changes with their title, and items migrated from
+// link-keyed storage have no GUID at all; the index maps their link to their
+// ID, so a successor with a new ID replaces them instead of showing up twice.
+func indexLink(byLink *bolt.Bucket, item models.FeedItem) error {
+	if item.GUID != "" || item.Link == "" || string(byLink.Get([]byte(item.Link))) == item.ID {
+		return nil
+	}
+	return byLink.Put([]byte(item.Link), []byte(item.ID))
+}
+
+// unindexLink removes a deleted item from the byLink index
+func unindexLink(byLink *bolt.Bucket, item models.FeedItem) error {
+	if byLink == nil || item.Link == "" || string(byLink.Get([]byte(item.Link))) != item.ID {
+		return nil
+	}
+	return byLink.Delete([]byte(item.Link))
+}
+
+// linkedItem returns the stored item without a GUID that carries link
+func linkedItem(byKey, byLink *bolt.Bucket, link string) (models.FeedItem, bool) {
+	if link == "" {
+		return models.FeedItem{}, false
+	}
+	itemID := byLink.Get([]byte(link))
+	if itemID == nil {
+		return models.FeedItem{}, false
+	}
+	encoded := byKey.Get(itemID)
+	if encoded == nil {
+		return models.FeedItem{}, false
+	}
+	var item models.FeedItem
+	if err := json.Unmarshal(encoded, &item); err != nil {
+		return models.FeedItem{}, false
+	}
+	return item, true
+}
+
+// LoadFeedItems loads the stored items of a feed, newest first, with their
+// read and favorite status
+func (db *DB) LoadFeedItems(feedURL string) ([]models.FeedItem, error) {
+	var items []models.FeedItem
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		items, err = loadFeedItems(tx, []byte(feedURL))
+		return err
+	})
+	return items, err
+}
+
+// LoadAllFeedItems loads the stored items of every feed, newest first, with
+// their read and favorite status
+func (db *DB) LoadAllFeedItems() ([]models.FeedItem, error) {
+	var items []models.FeedItem
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(FeedItemsBucketName)).ForEach(func(feedURL, v []byte) error {
+			if v != nil {
+				return nil // not a nested feed bucket
+			}
+			feedItems, err := loadFeedItems(tx, feedURL)
+			if err != nil {
+				return err
+			}
+			items = append(items, feedItems...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].PublishedTime.After(items[j].PublishedTime)
+	})
+	return items, nil
+}
+
+// loadFeedItems walks the byTime index of a feed from newest to oldest
+func loadFeedItems(tx *bolt.Tx, feedURL []byte) ([]models.FeedItem, error) {
+	feedBucket := tx.Bucket([]byte(FeedItemsBucketName)).Bucket(feedURL)
+	if feedBucket == nil {
+		return nil, nil
+	}
+	byKey := feedBucket.Bucket(itemsBucketName)
+	byTime := feedBucket.Bucket(byTimeBucketName)
+	if byKey == nil || byTime == nil {
+		return nil, nil
+	}
+
+	var items []models.FeedItem
+	c := byTime.Cursor()
+	for k, key := c.Last(); k != nil; k, key = c.Prev() {
+		encoded := byKey.Get(key)
+		if encoded == nil {
+			continue
+		}
+		item, err := decodeItem(tx, encoded)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// decodeItem decodes a stored item and adds its read and favorite status
+// and cached extraction
+func decodeItem(tx *bolt.Tx, encoded []byte) (models.FeedItem, error) {
+	var item models.FeedItem
+	if err := json.Unmarshal(encoded, &item); err != nil {
+		return item, err
+	}
+	item.Read = string(tx.Bucket([]byte(FeedItemStatusBucketName)).Get([]byte(item.ID))) == "true"
+	item.Favorite = string(tx.Bucket([]byte(FeedItemFavoriteBucketName)).Get([]byte(item.ID))) == "true"
+	applyExtraction(tx.Bucket([]byte(ExtractionBucketName)), &item)
+	return item, nil
+}
+
+// timeCursor walks the byTime index of a feed from newest to oldest
+type timeCursor struct {
+	byKey  *bolt.Bucket
+	cursor *bolt.Cursor
+	key    []byte // current byTime key, nil once the walk is done
+	itemID []byte
+}
+
+// QueryFeedItems returns the stored items a query selects, newest first.
+// The byTime indexes of the feeds are walked from their newest item and
+// merged as they go; the status and favorite filters only look up item IDs,
+// so no more items are decoded than are returned.
+func (db *DB) QueryFeedItems(query ItemQuery) ([]models.FeedItem, error) {
+	var items []models.FeedItem
+	err := db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(FeedItemsBucketName))
+		status := tx.Bucket([]byte(FeedItemStatusBucketName))
+		favorite := tx.Bucket([]byte(FeedItemFavoriteBucketName))
+
+		var cursors []*timeCursor
+		open := func(feedURL []byte) {
+			feedBucket := root.Bucket(feedURL)
+			if feedBucket == nil {
+				return
+			}
+			byKey := feedBucket.Bucket(itemsBucketName)
+			byTime := feedBucket.Bucket(byTimeBucketName)
+			if byKey == nil || byTime == nil {
+				return
+			}
+			c := &timeCursor{byKey: byKey, cursor: byTime.Cursor()}
+			if c.key, c.itemID = c.cursor.Last(); c.key != nil {
+				cursors = append(cursors, c)
+			}
+		}
+		if query.FeedURL != "" {
+			open([]byte(query.FeedURL))
+		} else {
+			root.ForEach(func(feedURL, v []byte) error {
+				if v == nil {
+					open(feedURL)
+				}
+				return nil
+			})
+		}
+
+		for query.Limit <= 0 || len(items) < query.Limit {
+			var newest *timeCursor
+			for _, c := range cursors {
+				if c.key != nil && (newest == nil || bytes.Compare(c.key, newest.key) > 0) {
+					newest = c
+				}
+			}
+			if newest == nil {
+				return nil
+			}
+			itemID := newest.itemID
+			newest.key, newest.itemID = newest.cursor.Prev()
+
+			if query.Unread && string(status.Get(itemID)) == "true" {
+				continue
+			}
+			if query.Favorite && string(favorite.Get(itemID)) != "true" {
+				continue
+			}
+			encoded := newest.byKey.Get(itemID)
+			if encoded == nil {
+				continue
+			}
+			item, err := decodeItem(tx, encoded)
+			if err != nil {
+				return err
+			}
+			items = append(items, item)
+		}
+		return nil
+	})
+	return items, err
+}
+
+// CountFeedItems returns the number of stored items per feed URL
+func (db *DB) CountFeedItems() (map[string]int, error) {
+	counts := make(map[string]int)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(FeedItemsBucketName)).ForEach(func(feedURL, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			if byKey := tx.Bucket([]byte(FeedItemsBucketName)).Bucket(feedURL).Bucket(itemsBucketName); byKey != nil {
+				counts[string(feedURL)] = byKey.Stats().KeyN
+			}
+			return nil
+		})
+	})
+	return counts, err
+}
+
+// renameFeedItems moves the stored items of a feed to a new feed URL. Item
+// IDs are derived from the feed URL, so each item gets the ID it will have
+// when fetched from newURL, and its read and favorite state and cached
+// extraction move along.
+func renameFeedItems(tx *bolt.Tx, oldURL, newURL string) error {
+	root := tx.Bucket([]byte(FeedItemsBucketName))
+	oldBucket := root.Bucket([]byte(oldURL))
+	if oldBucket == nil {
+		return nil
+	}
+	oldItems := oldBucket.Bucket(itemsBucketName)
+	if oldItems == nil {
+		return root.DeleteBucket([]byte(oldURL))
+	}
+
+	newBucket, err := root.CreateBucketIfNotExists([]byte(newURL))
+	if err != nil {
+		return err
+	}
+	newItems, err := newBucket.CreateBucketIfNotExists(itemsBucketName)
+	if err != nil {
+		return err
+	}
+	newByTime, err := newBucket.CreateBucketIfNotExists(byTimeBucketName)
+	if err != nil {
+		return err
+	}
+	newByLink, err := newBucket.CreateBucketIfNotExists(byLinkBucketName)
+	if err != nil {
+		return err
+	}
+
+	state := []*bolt.Bucket{
+		tx.Bucket([]byte(FeedItemStatusBucketName)),
+		tx.Bucket([]byte(FeedItemFavoriteBucketName)),
+		tx.Bucket([]byte(ExtractionBucketName)),
+	}
+	err = oldItems.ForEach(func(oldKey, encoded []byte) error {
+		var item models.FeedItem
+		if err := json.Unmarshal(encoded, &item); err != nil {
+			return err
+		}
+		item.FeedURLOrigin = newURL
+		item.ID = utils.ItemID(newURL, item.GUID, item.Link, item.Title)
+		key := []byte(item.ID)
+		for _, b := range state {
+			if err := moveKey(b, string(oldKey), item.ID); err != nil {
+				return err
+			}
+		}
+		reencoded, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		if existing := newItems.Get(key); existing != nil {
+			var stored models.FeedItem
+			if err := json.Unmarshal(existing, &stored); err == nil {
+				if err := newByTime.Delete(timeKey(stored.PublishedTime, string(key))); err != nil {
+					return err
+				}
+			}
+		}
+		if err := newItems.Put(key, reencoded); err != nil {
+			return err
+		}
+		if err := newByTime.Put(timeKey(item.PublishedTime, string(key)), key); err != nil {
+			return err
+		}
+		return indexLink(newByLink, item)
+	})
+	if err != nil {
+		return err
+	}
+
+	return root.DeleteBucket([]byte(oldURL))
+}
+
+// removeFeedItems deletes the stored items of a feed with their read and
+// favorite state and cached extractions
+func removeFeedItems(tx *bolt.Tx, feedURL string) error {
+	root := tx.Bucket([]byte(FeedItemsBucketName))
+	feedBucket := root.Bucket([]byte(feedURL))
+	if feedBucket == nil {
+		return nil
+	}
+	if byKey := feedBucket.Bucket(itemsBucketName); byKey != nil {
+		state := []*bolt.Bucket{
+			tx.Bucket([]byte(FeedItemStatusBucketName)),
+			tx.Bucket([]byte(FeedItemFavoriteBucketName)),
+			tx.Bucket([]byte(ExtractionBucketName)),
+		}
+		err := byKey.ForEach(func(key, _ []byte) error {
+			for _, b := range state {
+				if err := b.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return root.DeleteBucket([]byte(feedURL))
+}
+
+// CountUnreadFeedItems returns the number of stored unread items per feed URL
+func (db *DB) CountUnreadFeedItems() (map[string]int, error) {
+	counts := make(map[string]int)
+	err := db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(FeedItemsBucketName))
+		status := tx.Bucket([]byte(FeedItemStatusBucketName))
+		return root.ForEach(func(feedURL, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			byKey := root.Bucket(feedURL).Bucket(itemsBucketName)
+			if byKey == nil {
+				return nil
+			}
+			// Items are keyed by ID, so they need not be decoded
+			return byKey.ForEach(func(itemID, _ []byte) error {
+				if string(status.Get(itemID)) != "true" {
+					counts[string(feedURL)]++
+				}
+				return nil
+			})
+		})
+	})
+	return counts, err
+}
+
+// adoptLinkState copies read and favorite state that was stored under an
+// item's link, before items had IDs, to the item's ID. The link-keyed entry
+// is left in place since another feed may carry the same link.
+func adoptLinkState(status, favorite *bolt.Bucket, item models.FeedItem) error {
+	if item.Link == "" {
+		return nil
+	}
+	for _, b := range []*bolt.Bucket{status, favorite} {
+		if b.Get([]byte(item.ID)) != nil {
+			continue
+		}
+		if val := b.Get([]byte(item.Link)); val != nil {
+			if err := b.Put([]byte(item.ID), append([]byte(nil), val...)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// moveItemState moves read and favorite state from one item ID to another
+func moveItemState(status, favorite *bolt.Bucket, fromID, toID string) error {
+	for _, b := range []*bolt.Bucket{status, favorite} {
+		if err := moveKey(b, fromID, toID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveKey moves the value of a key in b to another key, if there is one
+func moveKey(b *bolt.Bucket, from, to string) error {
+	if from == to {
+		return nil
+	}
+	val := b.Get([]byte(from))
+	if val == nil {
+		return nil
+	}
+	if err := b.Put([]byte(to), append([]byte(nil), val...)); err != nil {
+		return err
+	}
+	return b.Delete([]byte(from))
+}
+
+// migrateLinkKeyedItems gives stored items that predate item IDs a fallback
+// ID, re-keys them and adopts the read and favorite state kept under their
+// link. Items that already have an ID are left alone, so it is safe to run
+// on every start.
+func migrateLinkKeyedItems(tx *bolt.Tx) error {
+	root := tx.Bucket([]byte(FeedItemsBucketName))
+	status := tx.Bucket([]byte(FeedItemStatusBucketName))
+	favorite := tx.Bucket([]byte(FeedItemFavoriteBucketName))
+
+	var feedURLs [][]byte
+	err := root.ForEach(func(feedURL, v []byte) error {
+		if v == nil {
+			feedURLs = append(feedURLs, append([]byte(nil), feedURL...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, feedURL := range feedURLs {
+		feedBucket := root.Bucket(feedURL)
+		byKey := feedBucket.Bucket(itemsBucketName)
+		byTime := feedBucket.Bucket(byTimeBucketName)
+		if byKey == nil || byTime == nil {
+			continue
+		}
+
+		var legacy []models.FeedItem
+		var legacyKeys []string
+		err := byKey.ForEach(func(key, encoded []byte) error {
+			var item models.FeedItem
+			if err := json.Unmarshal(encoded, &item); err != nil {
+				return err
+			}
+			if item.ID == "" {
+				legacy = append(legacy, item)
+				legacyKeys = append(legacyKeys, string(key))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i, item := range legacy {
+			oldKey := legacyKeys[i]
+			item.ID = utils.ItemID(string(feedURL), "", item.Link, item.Title)
+
+			if err := byTime.Delete(timeKey(item.PublishedTime, oldKey)); err != nil {
+				return err
+			}
+			if err := byKey.Delete([]byte(oldKey)); err != nil {
+				return err
+			}
+
+			encoded, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			if err := byKey.Put([]byte(item.ID), encoded); err != nil {
+				return err
+			}
+			if err := byTime.Put(timeKey(item.PublishedTime, item.ID), []byte(item.ID)); err != nil {
+				return err
+			}
+			if err := adoptLinkState(status, favorite, item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexItemLinks builds the byLink index of every feed
+func indexItemLinks(tx *bolt.Tx) error {
+	root := tx.Bucket([]byte(FeedItemsBucketName))
+
+	// Collect first, bbolt cursors must not walk a bucket being modified
+	var feedURLs [][]byte
+	err := root.ForEach(func(feedURL, v []byte) error {
+		if v == nil {
+			feedURLs = append(feedURLs, append([]byte(nil), feedURL...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, feedURL := range feedURLs {
+		feedBucket := root.Bucket(feedURL)
+		byKey := feedBucket.Bucket(itemsBucketName)
+		if byKey == nil {
+			continue
+		}
+		byLink, err := feedBucket.CreateBucketIfNotExists(byLinkBucketName)
+		if err != nil {
+			return err
+		}
+		err = byKey.ForEach(func(_, encoded []byte) error {
+			var item models.FeedItem
+			if err := json.Unmarshal(encoded, &item); err != nil {
+				return err
+			}
+			return indexLink(byLink, item)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package database
+
+import "os"
+
+// lockFile opens the file at path without locking it; other platforms
+// rely on the server being stopped before a restore
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+}
@@ -0,0 +1,59 @@
+//go:build unix
+
+package database
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRestoreLocked checks that a restore refuses to replace a database
+// that is open, and replaces it once it is closed
+func TestRestoreLocked(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		populateStore(t, store)
+		schedule := BackupSchedule{Dir: t.TempDir(), Name: filepath.Base(store.Path()), Keep: 1}
+		backup, err := schedule.WriteBackup(store, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path := store.Path()
+		before, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := dirNames(t, filepath.Dir(path))
+
+		_, _, err = Restore(store.Backend(), path, backup)
+		if err == nil || !strings.Contains(err.Error(), "is in use") {
+			t.Fatalf("restore over an open database = %v, want it refused as in use", err)
+		}
+		after, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(before, after) {
+			t.Error("refused restore changed the database file")
+		}
+		if got := dirNames(t, filepath.Dir(path)); !reflect.DeepEqual(got, files) {
+			t.Errorf("refused restore left files %v, want %v", got, files)
+		}
+
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+		_, previous, err := Restore(store.Backend(), path, backup)
+		if err != nil {
+			t.Fatalf("restore over a closed database: %v", err)
+		}
+		if _, err := os.Stat(previous); err != nil {
+			t.Errorf("replaced database was not kept: %v", err)
+		}
+	})
+}
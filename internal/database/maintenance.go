@@ -0,0 +1,375 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"deel/internal/utils"
+)
+
+// maxProblems bounds the consistency problems a check reports
+const maxProblems = 20
+
+// compactTxMaxSize is how much Compact copies per transaction
+const compactTxMaxSize = 64 << 20
+
+// MaintenanceOptions selects the maintenance steps to run. The consistency
+// check always runs first, and the other steps are skipped if it fails.
+type MaintenanceOptions struct {
+	CollectGarbage bool // delete state left behind by deleted items and feeds
+	Compact        bool // rewrite the database file to reclaim free space
+}
+
+// MaintenanceReport summarizes a maintenance run
+type MaintenanceReport struct {
+	Backend    string
+	Path       string
+	Started    time.Time
+	Duration   time.Duration
+	Problems   []string       // consistency problems, empty if the check passed
+	Removed    map[string]int // orphaned entries deleted per bucket or table, nil if GC did not run
+	Compacted  bool
+	SizeBefore int64 // file size in bytes before the run
+	SizeAfter  int64 // file size in bytes after the run
+}
+
+// Lines describes the run one line per step, for the command line and the
+// admin page
+func (r MaintenanceReport) Lines() []string {
+	lines := []string{fmt.Sprintf("%s database %s, %s, took %s", r.Backend, r.Path, r.Started.Format(time.RFC1123), r.Duration.Round(time.Millisecond))}
+	if len(r.Problems) == 0 {
+		lines = append(lines, "Consistency check passed")
+	} else {
+		lines = append(lines, fmt.Sprintf("Consistency check found %d problems, garbage collection and compaction were skipped:", len(r.Problems)))
+		for _, problem := range r.Problems {
+			lines = append(lines, "  "+problem)
+		}
+	}
+	if r.Removed != nil {
+		names := make([]string, 0, len(r.Removed))
+		total := 0
+		for name, n := range r.Removed {
+			names = append(names, name)
+			total += n
+		}
+		sort.Strings(names)
+		removed := make([]string, 0, len(names))
+		for _, name := range names {
+			removed = append(removed, fmt.Sprintf("%s %d", name, r.Removed[name]))
+		}
+		lines = append(lines, fmt.Sprintf("Garbage collection removed %d orphaned entries (%s)", total, strings.Join(removed, ", ")))
+	}
+	if r.Compacted {
+		lines = append(lines, fmt.Sprintf("Compaction rewrote the file, %s before and %s after", formatSize(r.SizeBefore), formatSize(r.SizeAfter)))
+	} else {
+		lines = append(lines, fmt.Sprintf("File size %s", formatSize(r.SizeAfter)))
+	}
+	return lines
+}
+
+// RunMaintenance checks the consistency of a store and, if it is sound,
+// runs the selected steps. It can run while the store is in use; writers
+// wait while a bbolt database is compacted.
+func RunMaintenance(store Store, options MaintenanceOptions) (report MaintenanceReport, err error) {
+	report = MaintenanceReport{Backend: store.Backend(), Path: store.Path(), Started: time.Now()}
+	defer func() { report.Duration = time.Since(report.Started) }()
+
+	if report.SizeBefore, err = fileSize(store.Path()); err != nil {
+		return report, err
+	}
+	report.SizeAfter = report.SizeBefore
+
+	if report.Problems, err = store.Check(); err != nil {
+		return report, fmt.Errorf("checking consistency: %w", err)
+	}
+	if len(report.Problems) > 0 {
+		return report, nil
+	}
+
+	if options.CollectGarbage {
+		if report.Removed, err = store.CollectGarbage(); err != nil {
+			return report, fmt.Errorf("collecting garbage: %w", err)
+		}
+	}
+	if options.Compact {
+		if err := store.Compact(); err != nil {
+			return report, fmt.Errorf("compacting: %w", err)
+		}
+		report.Compacted = true
+	}
+	report.SizeAfter, err = fileSize(store.Path())
+	return report, err
+}
+
+// View runs fn in a read-only transaction, see bolt.DB.View
+func (db *DB) View(fn func(tx *bolt.Tx) error) error {
+	db.swapMu.RLock()
+	defer db.swapMu.RUnlock()
+	return db.DB.View(fn)
+}
+
+// Update runs fn in a read-write transaction, see bolt.DB.Update
+func (db *DB) Update(fn func(tx *bolt.Tx) error) error {
+	db.swapMu.RLock()
+	defer db.swapMu.RUnlock()
+	return db.DB.Update(fn)
+}
+
+// Path returns the path of the database file
+func (db *DB) Path() string {
+	db.swapMu.RLock()
+	defer db.swapMu.RUnlock()
+	return db.DB.Path()
+}
+
+// Close closes the database
+func (db *DB) Close() error {
+	db.swapMu.Lock()
+	defer db.swapMu.Unlock()
+	return db.DB.Close()
+}
+
+// Check runs bbolt's consistency check and returns the problems it finds,
+// at most maxProblems of them
+func (db *DB) Check() ([]string, error) {
+	var problems []string
+	err := db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			if len(problems) < maxProblems {
+				problems = append(problems, err.Error())
+			}
+		}
+		return nil
+	})
+	return problems, err
+}
+
+// CollectGarbage deletes what deleted feeds and items left behind: the
+// items of feeds that are no longer subscribed, request settings of such
+// feeds, and the read, favorite and extraction entries of items that are
+// no longer stored. Read and favorite entries keyed by link, from before
+// items had IDs, are kept. It returns the number of entries deleted per
+// bucket.
+func (db *DB) CollectGarbage() (map[string]int, error) {
+	removed := make(map[string]int)
+	err := db.Update(func(tx *bolt.Tx) error {
+		feeds := tx.Bucket([]byte(BucketName))
+		root := tx.Bucket([]byte(FeedItemsBucketName))
+
+		// Items of unsubscribed feeds
+		var unsubscribed [][]byte
+		err := root.ForEach(func(feedURL, v []byte) error {
+			if v == nil && feeds.Get(feedURL) == nil {
+				unsubscribed = append(unsubscribed, append([]byte(nil), feedURL...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		removed[FeedItemsBucketName] = 0
+		for _, feedURL := range unsubscribed {
+			if byKey := root.Bucket(feedURL).Bucket(itemsBucketName); byKey != nil {
+				removed[FeedItemsBucketName] += byKey.Stats().KeyN
+			}
+			if err := root.DeleteBucket(feedURL); err != nil {
+				return err
+			}
+		}
+
+		// Request settings of unsubscribed feeds
+		n, err := deleteKeys(tx.Bucket([]byte(FeedRequestBucketName)), func(feedURL []byte) bool {
+			return feeds.Get(feedURL) == nil
+		})
+		if err != nil {
+			return err
+		}
+		removed[FeedRequestBucketName] = n
+
+		// State of items that are no longer stored
+		stored := make(map[string]bool)
+		err = root.ForEach(func(feedURL, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			byKey := root.Bucket(feedURL).Bucket(itemsBucketName)
+			if byKey == nil {
+				return nil
+			}
+			return byKey.ForEach(func(itemID, _ []byte) error {
+				stored[string(itemID)] = true
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		// State kept under a link predates item IDs and is adopted by items
+		// carrying that link when they are next stored, see adoptLinkState
+		for _, name := range []string{FeedItemStatusBucketName, FeedItemFavoriteBucketName, ExtractionBucketName} {
+			n, err := deleteKeys(tx.Bucket([]byte(name)), func(itemID []byte) bool {
+				return utils.IsItemID(string(itemID)) && !stored[string(itemID)]
+			})
+			if err != nil {
+				return err
+			}
+			removed[name] = n
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// Compact rewrites the database into a new file without free pages and
+// puts it in place of the old one. Transactions wait until it is done.
+func (db *DB) Compact() error {
+	db.swapMu.Lock()
+	defer db.swapMu.Unlock()
+
+	path := db.DB.Path()
+	tmp := path + ".compact"
+	os.Remove(tmp)
+	compacted, err := bolt.Open(tmp, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	if err := bolt.Compact(compacted, db.DB, compactTxMaxSize); err != nil {
+		compacted.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := compacted.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Swap the files, then reopen; if reopening fails the database stays
+	// closed and the server has to be restarted
+	if err := db.DB.Close(); err != nil {
+		return err
+	}
+	renameErr := os.Rename(tmp, path)
+	if renameErr != nil {
+		os.Remove(tmp)
+	}
+	reopened, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return fmt.Errorf("reopening %s: %w", path, err)
+	}
+	db.DB = reopened
+	return renameErr
+}
+
+// Path returns the path of the database file
+func (db *SQLiteDB) Path() string {
+	return db.path
+}
+
+// Check runs SQLite's integrity check and returns the problems it finds,
+// at most maxProblems of them
+func (db *SQLiteDB) Check() ([]string, error) {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA integrity_check(%d)`, maxProblems))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return nil, err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	return problems, rows.Err()
+}
+
+// CollectGarbage deletes the items of feeds that are no longer subscribed
+// and the state and extractions of items that are no longer stored. It
+// returns the number of rows deleted per table.
+func (db *SQLiteDB) CollectGarbage() (map[string]int, error) {
+	removed := make(map[string]int)
+	err := withTx(db.DB, func(tx *sql.Tx) error {
+		statements := []struct{ table, query string }{
+			{"items", `DELETE FROM items WHERE feed_url NOT IN (SELECT url FROM feeds)`},
+			{"item_state", `DELETE FROM item_state WHERE id NOT IN (SELECT id FROM items)`},
+			{"extractions", `DELETE FROM extractions WHERE id NOT IN (SELECT id FROM items)`},
+		}
+		for _, s := range statements {
+			result, err := tx.Exec(s.query)
+			if err != nil {
+				return err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			removed[s.table] = int(n)
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// Compact rebuilds the database with VACUUM and truncates the write-ahead
+// log. Writers wait until it is done.
+func (db *SQLiteDB) Compact() error {
+	if _, err := db.Exec(`VACUUM`); err != nil {
+		return err
+	}
+	_, err := db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`)
+	return err
+}
+
+// deleteKeys deletes the keys of a bucket that orphaned reports as
+// orphaned, and returns how many it deleted
+func deleteKeys(b *bolt.Bucket, orphaned func(key []byte) bool) (int, error) {
+	var keys [][]byte
+	err := b.ForEach(func(k, _ []byte) error {
+		if orphaned(k) {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// fileSize returns the size of the file at path
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// formatSize formats a byte count for people
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,230 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"deel/internal/models"
+)
+
+// TestCollectGarbage seeds state that deleted feeds and items left behind
+// and checks that garbage collection removes that and nothing else
+func TestCollectGarbage(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		const feedURL, unsubscribedURL = "http://example.com/feed", "http://gone.example/feed"
+		const legacyLink = "http://example.com/legacy"
+		published := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+		// A subscribed feed whose items have state
+		read := storeItem(feedURL, "read", true, published)
+		favorite := storeItem(feedURL, "favorite", true, published.Add(time.Hour))
+		extracted := storeItem(feedURL, "extracted", true, published.Add(2*time.Hour))
+		if err := store.SaveFeed(models.Feed{URL: feedURL}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.SaveFeedItems(feedURL, []models.FeedItem{read, favorite, extracted}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Items of a feed that is no longer subscribed
+		unsubscribed := storeItem(unsubscribedURL, "unsubscribed", true, published)
+		if _, err := store.SaveFeedItems(unsubscribedURL, []models.FeedItem{unsubscribed}); err != nil {
+			t.Fatal(err)
+		}
+
+		// State of items that are no longer stored
+		orphanRead := storeItem(feedURL, "pruned read", true, published).ID
+		orphanFavorite := storeItem(feedURL, "pruned favorite", true, published).ID
+		orphanExtracted := storeItem(feedURL, "pruned extracted", true, published).ID
+
+		for _, id := range []string{read.ID, unsubscribed.ID, orphanRead} {
+			if err := store.SetFeedItemReadStatus(id, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, id := range []string{favorite.ID, orphanFavorite} {
+			if err := store.SetFeedItemFavoriteStatus(id, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, id := range []string{extracted.ID, orphanExtracted} {
+			if err := store.SaveExtraction(id, models.Extraction{Content: "<p>Full</p>", Extracted: published}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		want := map[string]int{"items": 1, "item_state": 3, "extractions": 1}
+		if db, ok := store.(*DB); ok {
+			// bbolt also keeps request settings apart from the feed, and read
+			// state keyed by link from before items had IDs, which is kept
+			seedBoltLeftovers(t, db, unsubscribedURL, legacyLink)
+			want = map[string]int{
+				FeedItemsBucketName:        1,
+				FeedRequestBucketName:      1,
+				FeedItemStatusBucketName:   2,
+				FeedItemFavoriteBucketName: 1,
+				ExtractionBucketName:       1,
+			}
+		}
+
+		removed, err := store.CollectGarbage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(removed, want) {
+			t.Errorf("CollectGarbage removed %v, want %v", removed, want)
+		}
+
+		items, err := store.LoadAllFeedItems()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := itemTitles(items), []string{"extracted", "favorite", "read"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("items after collecting garbage %v, want %v", got, want)
+		}
+		if !items[2].Read || !items[1].Favorite || items[0].FullContent != "<p>Full</p>" {
+			t.Errorf("stored items lost their state: %+v", items)
+		}
+		for _, id := range []string{unsubscribed.ID, orphanRead} {
+			if store.GetFeedItemReadStatus(id) {
+				t.Errorf("read state of %s was kept", id)
+			}
+		}
+		if store.GetFeedItemFavoriteStatus(orphanFavorite) {
+			t.Errorf("favorite state of %s was kept", orphanFavorite)
+		}
+		if store.Backend() == BoltBackend && !store.GetFeedItemReadStatus(legacyLink) {
+			t.Error("read state keyed by link was removed")
+		}
+
+		// Nothing is left to collect
+		removed, err = store.CollectGarbage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, n := range removed {
+			if n != 0 {
+				t.Errorf("second run removed %d entries from %s", n, name)
+			}
+		}
+	})
+}
+
+// seedBoltLeftovers stores request settings of a feed that is not
+// subscribed and read state keyed by a link
+func seedBoltLeftovers(t *testing.T, db *DB, feedURL, link string) {
+	t.Helper()
+	err := db.Update(func(tx *bolt.Tx) error {
+		encoded, _ := json.Marshal(models.RequestSettings{UserAgent: "leftover"})
+		if err := tx.Bucket([]byte(FeedRequestBucketName)).Put([]byte(feedURL), encoded); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(FeedItemStatusBucketName)).Put([]byte(link), []byte("true"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCompact compacts a store with free space while it is being read, and
+// checks that it keeps its contents and can still be written to
+func TestCompact(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		const feedURL = "http://example.com/feed"
+		populateStore(t, store)
+
+		// Free some space by pruning large items
+		published := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		var large []models.FeedItem
+		for i := 0; i < 100; i++ {
+			item := storeItem(feedURL, strings.Repeat("x", i+1), true, published.Add(-time.Duration(i)*time.Hour))
+			item.Content = strings.Repeat("content ", 1000)
+			large = append(large, item)
+		}
+		if _, err := store.SaveFeedItems(feedURL, large); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.PruneFeedItems(feedURL, models.RetentionPolicy{MaxItems: 3}, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		wantFeeds, wantItems := storeContents(t, store)
+		before := databaseSize(t, store.Path())
+
+		// Readers keep going while the file is swapped
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					if _, err := store.LoadFeedItems(feedURL); err != nil {
+						t.Errorf("reading while compacting: %v", err)
+						return
+					}
+				}
+			}()
+		}
+		err := store.Compact()
+		close(done)
+		wg.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		feeds, items := storeContents(t, store)
+		if !reflect.DeepEqual(feeds, wantFeeds) || !reflect.DeepEqual(items, wantItems) {
+			t.Errorf("contents changed by compacting: %v, want %v", itemTitles(items), itemTitles(wantItems))
+		}
+		if after := databaseSize(t, store.Path()); after >= before {
+			t.Errorf("database size %d after compacting, want less than %d", after, before)
+		}
+
+		// The store is still writable
+		item := storeItem(feedURL, "after compacting", true, time.Now())
+		if _, err := store.SaveFeedItems(feedURL, []models.FeedItem{item}); err != nil {
+			t.Fatalf("saving after compacting: %v", err)
+		}
+		if err := store.SetFeedItemReadStatus(item.ID, true); err != nil {
+			t.Fatalf("marking read after compacting: %v", err)
+		}
+		items, err = store.QueryFeedItems(ItemQuery{FeedURL: feedURL, Limit: 1})
+		if err != nil || len(items) != 1 || items[0].ID != item.ID || !items[0].Read {
+			t.Errorf("newest item after compacting %+v (%v), want the read item saved after", items, err)
+		}
+		if problems, err := store.Check(); err != nil || len(problems) != 0 {
+			t.Errorf("check after compacting found %v (%v)", problems, err)
+		}
+	})
+}
+
+// databaseSize returns the size of a database file together with its SQLite
+// write-ahead log, which holds the latest writes until a checkpoint
+func databaseSize(t *testing.T, path string) int64 {
+	t.Helper()
+	var size int64
+	for _, name := range []string{path, path + "-wal"} {
+		info, err := os.Stat(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += info.Size()
+	}
+	return size
+}
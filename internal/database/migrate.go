@@ -0,0 +1,336 @@
+package database
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// MetaBucketName is the name of the bucket holding database metadata such
+// as the schema version
+const MetaBucketName = "meta"
+
+var schemaVersionKey = []byte("schemaVersion")
+
+// errDryRun rolls back the transaction of a dry run
+var errDryRun = errors.New("dry run")
+
+// migration upgrades the database by one schema version. The pending
+// migrations run in order in a single transaction together with their
+// version bumps, so if one fails the database is left exactly as it was
+// backed up.
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *bolt.Tx) error
+}
+
+// migrations lists every schema change. Append new migrations at the end
+// with the next version; never change or reorder released ones.
+var migrations = []migration{
+	{1, "create the feed, status, favorite, item, request settings and extraction buckets", createBuckets},
+	{2, "give items stored before item IDs existed an ID and adopt their link-keyed state", migrateLinkKeyedItems},
+	{3, "index the items without a GUID by link", indexItemLinks},
+}
+
+// SchemaVersion is the schema version this build reads and writes
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// MigrationReport describes a migration that ran, or would run in a dry run
+type MigrationReport struct {
+	Version     int
+	Description string
+	Changes     []string // buckets or tables created, deleted or modified
+}
+
+// migrate brings the database up to SchemaVersion. Existing databases are
+// backed up next to the database file first; the pending migrations then
+// run in a single transaction.
+func migrate(db *bolt.DB) ([]MigrationReport, error) {
+	current, err := readSchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	pending := pendingMigrations(current)
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	if current > 0 || !isEmpty(db) {
+		backup, err := backupFile(db, current)
+		if err != nil {
+			return nil, fmt.Errorf("backing up before migrating: %w", err)
+		}
+		log.Printf("Backed up database schema version %d to %s", current, backup)
+	}
+
+	reports, err := runMigrations(db, pending)
+	if err != nil {
+		return nil, err
+	}
+	for _, report := range reports {
+		log.Printf("Migrated database to schema version %d: %s", report.Version, report.Description)
+	}
+	return reports, nil
+}
+
+// DryRunMigrations reports the schema version of the database at path and
+// what migrating it would change, without changing it. The database is
+// opened read-only and the pending migrations run on a temporary copy, in a
+// single transaction that is rolled back.
+func DryRunMigrations(path string) (current int, reports []MigrationReport, err error) {
+	// bbolt creates missing files even when opening them read-only
+	if _, err := os.Stat(path); err != nil {
+		return 0, nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return 0, nil, err
+	}
+	defer db.Close()
+
+	current, err = readSchemaVersion(db)
+	if err != nil {
+		return current, nil, err
+	}
+	pending := pendingMigrations(current)
+	if len(pending) == 0 {
+		return current, nil, nil
+	}
+
+	dir, err := os.MkdirTemp("", "deel-dry-run-")
+	if err != nil {
+		return current, nil, err
+	}
+	defer os.RemoveAll(dir)
+	scratchPath := filepath.Join(dir, filepath.Base(path))
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(scratchPath, 0600)
+	})
+	if err != nil {
+		return current, nil, err
+	}
+	scratch, err := bolt.Open(scratchPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return current, nil, err
+	}
+	defer scratch.Close()
+
+	// Run all pending migrations in one transaction so later migrations see
+	// the work of earlier ones, then roll it back
+	err = scratch.Update(func(tx *bolt.Tx) error {
+		for _, m := range pending {
+			before := bucketStates(tx)
+			if err := m.apply(tx); err != nil {
+				return fmt.Errorf("migration to schema version %d: %w", m.version, err)
+			}
+			reports = append(reports, MigrationReport{
+				Version:     m.version,
+				Description: m.description,
+				Changes:     describeChanges("bucket", "keys", before, bucketStates(tx)),
+			})
+		}
+		return errDryRun
+	})
+	if errors.Is(err, errDryRun) {
+		err = nil
+	}
+	return current, reports, err
+}
+
+// runMigrations applies the pending migrations and records each version in
+// one transaction, which is rolled back if any of them fails
+func runMigrations(db *bolt.DB, pending []migration) ([]MigrationReport, error) {
+	var reports []MigrationReport
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, m := range pending {
+			before := bucketStates(tx)
+			if err := m.apply(tx); err != nil {
+				return fmt.Errorf("migrating to schema version %d: %w", m.version, err)
+			}
+			if err := writeSchemaVersion(tx, m.version); err != nil {
+				return err
+			}
+			reports = append(reports, MigrationReport{
+				Version:     m.version,
+				Description: m.description,
+				Changes:     describeChanges("bucket", "keys", before, bucketStates(tx)),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+// readSchemaVersion returns the recorded schema version, zero for databases
+// created before versions were recorded. It refuses databases written by a
+// newer build.
+func readSchemaVersion(db *bolt.DB) (int, error) {
+	version := 0
+	err := db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(MetaBucketName))
+		if meta == nil {
+			return nil
+		}
+		if encoded := meta.Get(schemaVersionKey); len(encoded) == 8 {
+			version = int(binary.BigEndian.Uint64(encoded))
+		}
+		return nil
+	})
+	if err == nil && version > SchemaVersion() {
+		err = fmt.Errorf("database schema version %d is newer than the supported version %d", version, SchemaVersion())
+	}
+	return version, err
+}
+
+// writeSchemaVersion records the schema version in the meta bucket
+func writeSchemaVersion(tx *bolt.Tx, version int) error {
+	meta, err := tx.CreateBucketIfNotExists([]byte(MetaBucketName))
+	if err != nil {
+		return err
+	}
+	encoded := make([]byte, 8)
+	binary.BigEndian.PutUint64(encoded, uint64(version))
+	return meta.Put(schemaVersionKey, encoded)
+}
+
+// pendingMigrations returns the migrations newer than version
+func pendingMigrations(version int) []migration {
+	var pending []migration
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// isEmpty reports whether the database has no buckets at all, as a newly
+// created file does
+func isEmpty(db *bolt.DB) bool {
+	empty := true
+	db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(_ []byte, _ *bolt.Bucket) error {
+			empty = false
+			return nil
+		})
+	})
+	return empty
+}
+
+// backupFile copies the database to a file next to it named after the
+// schema version and time, and returns the file's path
+func backupFile(db *bolt.DB, version int) (string, error) {
+	backup := fmt.Sprintf("%s.v%d-%s.bak", db.Path(), version, time.Now().Format("20060102-150405"))
+	if _, err := os.Stat(backup); err == nil {
+		return "", fmt.Errorf("backup %s already exists", backup)
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(backup, 0600)
+	})
+	return backup, err
+}
+
+// createBuckets creates the top-level buckets
+func createBuckets(tx *bolt.Tx) error {
+	for _, name := range []string{
+		BucketName,
+		FeedItemStatusBucketName,
+		FeedItemFavoriteBucketName,
+		FeedItemsBucketName,
+		FeedRequestBucketName,
+		ExtractionBucketName,
+	} {
+		if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bucketState summarizes the content of a bucket to tell whether it changed
+type bucketState struct {
+	keys   int    // keys, nested buckets included
+	digest []byte // hash of every key and value
+}
+
+// bucketStates summarizes every top-level bucket by name
+func bucketStates(tx *bolt.Tx) map[string]bucketState {
+	states := make(map[string]bucketState)
+	tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		h := sha256.New()
+		keys := hashBucket(h, b)
+		states[string(name)] = bucketState{keys: keys, digest: h.Sum(nil)}
+		return nil
+	})
+	return states
+}
+
+// hashBucket feeds the keys and values of a bucket and its nested buckets
+// to h and returns the number of keys. Stats cannot be used, as it misses
+// the uncommitted changes of a write transaction.
+func hashBucket(h hash.Hash, b *bolt.Bucket) int {
+	keys := 0
+	b.ForEach(func(k, v []byte) error {
+		keys++
+		h.Write(k)
+		h.Write([]byte{0})
+		if v == nil {
+			h.Write([]byte{'{'})
+			keys += hashBucket(h, b.Bucket(k))
+			h.Write([]byte{'}'})
+		} else {
+			h.Write(v)
+			h.Write([]byte{0})
+		}
+		return nil
+	})
+	return keys
+}
+
+// describeChanges lists the buckets or tables, as named by kind, that were
+// created, deleted or modified, counting their entries in units
+func describeChanges(kind, units string, before, after map[string]bucketState) []string {
+	names := make(map[string]bool)
+	for name := range before {
+		names[name] = true
+	}
+	for name := range after {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var changes []string
+	for _, name := range sorted {
+		old, existed := before[name]
+		now, exists := after[name]
+		switch {
+		case !existed:
+			changes = append(changes, fmt.Sprintf("create %s %s (%d %s)", kind, name, now.keys, units))
+		case !exists:
+			changes = append(changes, fmt.Sprintf("delete %s %s (%d %s)", kind, name, old.keys, units))
+		case !bytes.Equal(old.digest, now.digest):
+			changes = append(changes, fmt.Sprintf("modify %s %s (%d -> %d %s)", kind, name, old.keys, now.keys, units))
+		}
+	}
+	return changes
+}
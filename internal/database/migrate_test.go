@@ -0,0 +1,272 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"deel/internal/models"
+	"deel/internal/utils"
+)
+
+const (
+	fixtureFeedURL = "http://example.com/feed"
+	fixtureLink    = "http://example.com/1"
+)
+
+// writeBoltFixture creates a bbolt database at the given schema version.
+// Version 0 holds a feed and link-keyed read state the way builds before
+// schema versions stored them; version 1 adds an item stored before items
+// had IDs.
+func writeBoltFixture(t *testing.T, path string, version int) {
+	t.Helper()
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{BucketName, FeedItemStatusBucketName, FeedItemFavoriteBucketName} {
+			if _, err := tx.CreateBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		feed, _ := json.Marshal(models.Feed{URL: fixtureFeedURL, Title: "Fixture"})
+		if err := tx.Bucket([]byte(BucketName)).Put([]byte(fixtureFeedURL), feed); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(FeedItemStatusBucketName)).Put([]byte(fixtureLink), []byte("true")); err != nil {
+			return err
+		}
+		if version == 0 {
+			return nil
+		}
+
+		if err := createBuckets(tx); err != nil {
+			return err
+		}
+		feedBucket, err := tx.Bucket([]byte(FeedItemsBucketName)).CreateBucket([]byte(fixtureFeedURL))
+		if err != nil {
+			return err
+		}
+		byKey, _ := feedBucket.CreateBucket(itemsBucketName)
+		byTime, _ := feedBucket.CreateBucket(byTimeBucketName)
+		published := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		item, _ := json.Marshal(models.FeedItem{Title: "One", Link: fixtureLink, PublishedTime: published})
+		if err := byKey.Put([]byte(fixtureLink), item); err != nil {
+			return err
+		}
+		if err := byTime.Put(timeKey(published, fixtureLink), []byte(fixtureLink)); err != nil {
+			return err
+		}
+		return writeSchemaVersion(tx, version)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dirNames lists the names of the files in dir
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// checkDryRun runs a dry run and checks that it reports the pending
+// migrations without touching the database or its directory
+func checkDryRun(t *testing.T, dryRun func(string) (int, []MigrationReport, error), path string, version, pending int) {
+	t.Helper()
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := dirNames(t, filepath.Dir(path))
+
+	current, reports, err := dryRun(path)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if current != version || len(reports) != pending {
+		t.Errorf("dry run reported version %d with %d migrations, want %d with %d", current, len(reports), version, pending)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("dry run changed the database file")
+	}
+	if got := dirNames(t, filepath.Dir(path)); !reflect.DeepEqual(got, files) {
+		t.Errorf("dry run left files %v, want %v", got, files)
+	}
+}
+
+// checkBackup checks that migrating left exactly one backup of the
+// database at version, and returns its path
+func checkBackup(t *testing.T, path string, version int) string {
+	t.Helper()
+	backups, err := filepath.Glob(fmt.Sprintf("%s.v%d-*.bak", path, version))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("found backups %v, want one of version %d", backups, version)
+	}
+	return backups[0]
+}
+
+func TestMigrateBolt(t *testing.T) {
+	for _, version := range []int{0, 1} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), DBPath)
+			writeBoltFixture(t, path, version)
+			checkDryRun(t, DryRunMigrations, path, version, SchemaVersion()-version)
+
+			db, err := NewDB(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := readSchemaVersion(db.DB); err != nil || got != SchemaVersion() {
+				t.Errorf("schema version %d (%v) after migrating, want %d", got, err, SchemaVersion())
+			}
+
+			backup, err := bolt.Open(checkBackup(t, path, version), 0600, &bolt.Options{ReadOnly: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer backup.Close()
+			if got, err := readSchemaVersion(backup); err != nil || got != version {
+				t.Errorf("backup at schema version %d (%v), want %d", got, err, version)
+			}
+
+			feeds, err := db.LoadFeeds()
+			if err != nil || len(feeds) != 1 || feeds[0].URL != fixtureFeedURL {
+				t.Errorf("feeds after migrating: %v (%v), want the fixture feed", feeds, err)
+			}
+			if version == 1 {
+				// The item got an ID and adopted its link-keyed read state
+				items, err := db.LoadFeedItems(fixtureFeedURL)
+				if err != nil || len(items) != 1 {
+					t.Fatalf("items after migrating: %v (%v), want one", items, err)
+				}
+				if want := utils.ItemID(fixtureFeedURL, "", fixtureLink, "One"); items[0].ID != want {
+					t.Errorf("item ID %q, want %q", items[0].ID, want)
+				}
+				if !db.GetFeedItemReadStatus(items[0].ID) {
+					t.Error("item lost its read state")
+				}
+
+				// The link index built by the migration lets a successor
+				// with a GUID replace the item, keeping its read state
+				successor := models.FeedItem{GUID: "1", Title: "One, edited", Link: fixtureLink}
+				successor.ID = utils.ItemID(fixtureFeedURL, successor.GUID, successor.Link, successor.Title)
+				if result, err := db.SaveFeedItems(fixtureFeedURL, []models.FeedItem{successor}); err != nil || result.Added != 0 {
+					t.Errorf("saving the successor added %d items (%v), want it to replace the item", result.Added, err)
+				}
+				items, err = db.LoadFeedItems(fixtureFeedURL)
+				if err != nil || len(items) != 1 || items[0].ID != successor.ID || !items[0].Read {
+					t.Errorf("items after saving the successor: %+v (%v), want only the read successor", items, err)
+				}
+			}
+
+			// Already migrated
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			checkDryRun(t, DryRunMigrations, path, SchemaVersion(), 0)
+		})
+	}
+}
+
+func TestMigrateNewDatabase(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, DBPath)
+
+	// A dry run of a mistyped path must not create it
+	for _, dryRun := range []func(string) (int, []MigrationReport, error){DryRunMigrations, DryRunSQLiteMigrations} {
+		if _, _, err := dryRun(path); !os.IsNotExist(err) {
+			t.Errorf("dry run of a missing database: %v, want it not to exist", err)
+		}
+	}
+	if files := dirNames(t, dir); len(files) != 0 {
+		t.Fatalf("dry run created %v", files)
+	}
+
+	// A new database needs no backup
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if backups, _ := filepath.Glob(path + ".v*.bak"); len(backups) != 0 {
+		t.Errorf("new database was backed up to %v", backups)
+	}
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rss_feeds.sqlite")
+
+	// A database at version 0 that is not empty
+	fixture, err := openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fixture.Exec(`CREATE TABLE notes (note TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := fixture.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkDryRun(t, DryRunSQLiteMigrations, path, 0, SQLiteSchemaVersion())
+
+	// Also while another connection has it open, with a -wal file
+	fixture, err = openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fixture.Exec(`INSERT INTO notes VALUES ('open')`); err != nil {
+		t.Fatal(err)
+	}
+	checkDryRun(t, DryRunSQLiteMigrations, path, 0, SQLiteSchemaVersion())
+	if err := fixture.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewSQLiteDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got, err := readSQLiteVersion(db.DB); err != nil || got != SQLiteSchemaVersion() {
+		t.Errorf("schema version %d (%v) after migrating, want %d", got, err, SQLiteSchemaVersion())
+	}
+
+	backup, err := openSQLiteReadOnly(checkBackup(t, path, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	var notes int
+	if err := backup.QueryRow(`SELECT count(*) FROM notes`).Scan(&notes); err != nil || notes != 1 {
+		t.Errorf("backup holds %d notes (%v), want 1", notes, err)
+	}
+	if got, err := readSQLiteVersion(backup); err != nil || got != 0 {
+		t.Errorf("backup at schema version %d (%v), want 0", got, err)
+	}
+}
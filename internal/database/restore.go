@@ -0,0 +1,206 @@
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// sqliteHeader starts every SQLite database file
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// SnapshotInfo describes a snapshot that passed validation
+type SnapshotInfo struct {
+	Backend       string
+	SchemaVersion int // older versions are migrated when the store is opened
+	Feeds         int
+	Items         int
+}
+
+// ValidateSnapshot checks that the file at path is an intact, non-empty
+// database of the backend that this build can open. The file's structure is
+// checked and its schema version must not be newer than this build's. At
+// the current version every feed and item must also load, with the request
+// settings decrypting under the key in keyDir, which must exist. Neither
+// the snapshot nor the key is written to.
+func ValidateSnapshot(backend, path, keyDir string) (SnapshotInfo, error) {
+	info := SnapshotInfo{Backend: backend}
+	header := make([]byte, len(sqliteHeader))
+	f, err := os.Open(path)
+	if err != nil {
+		return info, err
+	}
+	_, err = io.ReadFull(f, header)
+	f.Close()
+	if err != nil {
+		return info, fmt.Errorf("%s is too short to be a database", path)
+	}
+	if isSQLite := bytes.Equal(header, sqliteHeader); isSQLite != (backend == SQLiteBackend) {
+		return info, fmt.Errorf("%s is not a %s database", path, backend)
+	}
+
+	keyPath := filepath.Join(keyDir, KeyFileName)
+	key, err := readKey(keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return info, fmt.Errorf("%s is missing; copy it from the backup directory or the host the snapshot was taken on", keyPath)
+	}
+	if err != nil {
+		return info, err
+	}
+
+	var store Store
+	var empty bool
+	latest := SchemaVersion()
+	switch backend {
+	case BoltBackend:
+		db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+		if err != nil {
+			return info, err
+		}
+		defer db.Close()
+		if err := checkBolt(db); err != nil {
+			return info, err
+		}
+		if info.SchemaVersion, err = readSchemaVersion(db); err != nil {
+			return info, err
+		}
+		store, empty = &DB{DB: db, key: key}, isEmpty(db)
+	case SQLiteBackend:
+		db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+		if err != nil {
+			return info, err
+		}
+		defer db.Close()
+		var result string
+		if err := db.QueryRow(`PRAGMA integrity_check(1)`).Scan(&result); err != nil {
+			return info, err
+		}
+		if result != "ok" {
+			return info, fmt.Errorf("integrity check failed: %s", result)
+		}
+		if info.SchemaVersion, err = readSQLiteVersion(db); err != nil {
+			return info, err
+		}
+		if empty, err = sqliteIsEmpty(db); err != nil {
+			return info, err
+		}
+		store, latest = &SQLiteDB{DB: db, path: path, key: key}, SQLiteSchemaVersion()
+	default:
+		return info, fmt.Errorf("unknown storage backend %q", backend)
+	}
+	if empty {
+		return info, fmt.Errorf("%s holds no data", path)
+	}
+
+	// Snapshots of an older schema are migrated when opened; this build
+	// can only read its own
+	if info.SchemaVersion < latest {
+		return info, nil
+	}
+	feeds, err := store.LoadFeeds()
+	if err != nil {
+		return info, fmt.Errorf("loading feeds: %w", err)
+	}
+	items, err := store.LoadAllFeedItems()
+	if err != nil {
+		return info, fmt.Errorf("loading items: %w", err)
+	}
+	info.Feeds, info.Items = len(feeds), len(items)
+	return info, nil
+}
+
+// Restore replaces the database at path with a snapshot after validating
+// it. The current database is kept next to it as
+// <path>.pre-restore-<time>.bak, whose path is returned along with what
+// was restored; it is empty if there was no database yet. The store must not be open, which its file lock enforces.
+func Restore(backend, path, snapshot string) (SnapshotInfo, string, error) {
+	info, err := ValidateSnapshot(backend, snapshot, filepath.Dir(path))
+	if err != nil {
+		return info, "", fmt.Errorf("invalid snapshot: %w", err)
+	}
+
+	// Hold the database's lock until the snapshot is in place, so a server
+	// starting meanwhile cannot open the file being replaced
+	switch backend {
+	case BoltBackend:
+		if _, err := os.Stat(path); err == nil {
+			db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+			if err != nil {
+				return info, "", fmt.Errorf("%s is in use, stop the server first: %w", path, err)
+			}
+			defer db.Close()
+		}
+	case SQLiteBackend:
+		lock, err := lockFile(sqliteLockPath(path))
+		if err != nil {
+			return info, "", fmt.Errorf("%s is in use, stop the server first: %w", path, err)
+		}
+		defer lock.Close()
+	}
+
+	// Copy the snapshot next to the database, so the final rename is atomic
+	tmp := path + ".restore"
+	if err := copyFile(tmp, snapshot); err != nil {
+		os.Remove(tmp)
+		return info, "", err
+	}
+
+	backup := fmt.Sprintf("%s.pre-restore-%s.bak", path, time.Now().Format(backupTimeFormat))
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		backup = ""
+	}
+	// SQLite keeps uncheckpointed writes in the -wal file, which belongs to
+	// the old database and must move along with it
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if backup == "" {
+			break
+		}
+		if err := os.Rename(path+suffix, backup+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			os.Remove(tmp)
+			return info, "", err
+		}
+	}
+	return info, backup, os.Rename(tmp, path)
+}
+
+// checkBolt runs bbolt's consistency check
+func checkBolt(db *bolt.DB) error {
+	return db.View(func(tx *bolt.Tx) error {
+		var problems []error
+		for err := range tx.Check() {
+			problems = append(problems, err)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("consistency check found %d problems, the first: %w", len(problems), problems[0])
+		}
+		return nil
+	})
+}
+
+// copyFile copies src to a new file dst and syncs it to disk
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
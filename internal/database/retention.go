@@ -0,0 +1,89 @@
+package database
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"deel/internal/models"
+)
+
+// PruneFeedItems deletes the stored items of a feed that fall outside the
+// retention policy, along with their read and favorite state and cached
+// extraction. Items are
+// ranked newest first; favorites and, if the policy says so, unread items
+// are kept but still count towards MaxItems. Undated items are only pruned
+// by count. It returns the number of items deleted.
+func (db *DB) PruneFeedItems(feedURL string, policy models.RetentionPolicy, now time.Time) (int, error) {
+	if !policy.Prunes() {
+		return 0, nil
+	}
+	cutoff := policy.Cutoff(now)
+
+	pruned := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		feedBucket := tx.Bucket([]byte(FeedItemsBucketName)).Bucket([]byte(feedURL))
+		if feedBucket == nil {
+			return nil
+		}
+		byKey := feedBucket.Bucket(itemsBucketName)
+		byTime := feedBucket.Bucket(byTimeBucketName)
+		if byKey == nil || byTime == nil {
+			return nil
+		}
+		byLink := feedBucket.Bucket(byLinkBucketName)
+		status := tx.Bucket([]byte(FeedItemStatusBucketName))
+		favorite := tx.Bucket([]byte(FeedItemFavoriteBucketName))
+		extraction := tx.Bucket([]byte(ExtractionBucketName))
+
+		// Collect first, bbolt cursors must not walk a bucket being modified
+		var expired []models.FeedItem
+		rank := 0
+		c := byTime.Cursor()
+		for k, key := c.Last(); k != nil; k, key = c.Prev() {
+			encoded := byKey.Get(key)
+			if encoded == nil {
+				continue
+			}
+			var item models.FeedItem
+			if err := json.Unmarshal(encoded, &item); err != nil {
+				return err
+			}
+			rank++
+
+			tooMany := policy.MaxItems > 0 && rank > policy.MaxItems
+			tooOld := !cutoff.IsZero() && !item.PublishedTime.IsZero() && item.PublishedTime.Before(cutoff)
+			if !tooMany && !tooOld {
+				continue
+			}
+			if string(favorite.Get([]byte(item.ID))) == "true" {
+				continue
+			}
+			if policy.KeepUnread && string(status.Get([]byte(item.ID))) != "true" {
+				continue
+			}
+			expired = append(expired, item)
+		}
+
+		for _, item := range expired {
+			if err := byTime.Delete(timeKey(item.PublishedTime, item.ID)); err != nil {
+				return err
+			}
+			if err := byKey.Delete([]byte(item.ID)); err != nil {
+				return err
+			}
+			if err := unindexLink(byLink, item); err != nil {
+				return err
+			}
+			for _, b := range []*bolt.Bucket{status, favorite, extraction} {
+				if err := b.Delete([]byte(item.ID)); err != nil {
+					return err
+				}
+			}
+		}
+		pruned = len(expired)
+		return nil
+	})
+	return pruned, err
+}
@@ -0,0 +1,133 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+
+	"deel/internal/models"
+)
+
+const (
+	// FeedRequestBucketName is the name of the bucket for the encrypted
+	// per-feed request settings, keyed by feed URL
+	FeedRequestBucketName = "feedRequest"
+
+	// KeyFileName is the name of the key the request settings are encrypted
+	// with. It is created next to the database on first use.
+	KeyFileName = "rss_feeds.key"
+)
+
+// loadKey reads the hex encoded AES-256 key at path, generating it if the
+// file does not exist yet
+func loadKey(path string) ([]byte, error) {
+	key, err := readKey(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.WriteString(hex.EncodeToString(key) + "\n"); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return key, f.Close()
+	}
+	return key, err
+}
+
+// readKey reads the hex encoded AES-256 key at path without generating
+// one; the error wraps os.ErrNotExist if there is none
+func readKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("invalid key in %s", path)
+	}
+	return key, nil
+}
+
+// putRequestSettings encrypts and stores the request settings of a feed
+func (db *DB) putRequestSettings(tx *bolt.Tx, feedURL string, settings models.RequestSettings) error {
+	b := tx.Bucket([]byte(FeedRequestBucketName))
+	if settings.Empty() {
+		return b.Delete([]byte(feedURL))
+	}
+	sealed, err := sealRequestSettings(db.key, feedURL, settings)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(feedURL), sealed)
+}
+
+// getRequestSettings decrypts the request settings of a feed
+func (db *DB) getRequestSettings(tx *bolt.Tx, feedURL string) (models.RequestSettings, error) {
+	return openRequestSettings(db.key, feedURL, tx.Bucket([]byte(FeedRequestBucketName)).Get([]byte(feedURL)))
+}
+
+// sealRequestSettings encrypts the request settings of a feed with key.
+// The feed URL is authenticated along with them, so settings cannot be
+// moved to another feed.
+func sealRequestSettings(key []byte, feedURL string, settings models.RequestSettings) ([]byte, error) {
+	plaintext, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, []byte(feedURL)), nil
+}
+
+// openRequestSettings decrypts request settings sealed by
+// sealRequestSettings. Nil sealed settings are empty.
+func openRequestSettings(key []byte, feedURL string, sealed []byte) (models.RequestSettings, error) {
+	var settings models.RequestSettings
+	if sealed == nil {
+		return settings, nil
+	}
+
+	gcm, err := newCipher(key)
+	if err != nil {
+		return settings, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return settings, fmt.Errorf("request settings of %s are corrupt", feedURL)
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(feedURL))
+	if err != nil {
+		return settings, fmt.Errorf("decrypting request settings of %s: %w", feedURL, err)
+	}
+	err = json.Unmarshal(plaintext, &settings)
+	return settings, err
+}
+
+// newCipher returns the AEAD the request settings are sealed with
+func newCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
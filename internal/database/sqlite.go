@@ -0,0 +1,852 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the pure Go "sqlite" driver
+
+	"deel/internal/models"
+	"deel/internal/utils"
+)
+
+// SQLiteDB is a Store kept in an SQLite database. Unlike the bbolt
+// database it can be read by other processes, so reports can be run with
+// the sqlite3 shell while the server is running; only one deel process
+// opens it at a time, see lockFile. Feeds and items
+// are stored as JSON along with the columns they are queried by;
+// published holds Unix nanoseconds, zero for undated items.
+type SQLiteDB struct {
+	*sql.DB
+	path string
+	key  []byte   // encrypts the request settings, see KeyFileName
+	lock *os.File // held open while the database is, see sqliteLockPath
+}
+
+// sqliteLockPath returns the lock file deel holds while it has the SQLite
+// database at path open, so restoring cannot replace it under a running
+// server
+func sqliteLockPath(path string) string {
+	return path + ".lock"
+}
+
+// sqliteMigration upgrades the SQLite schema by one version, recorded in
+// PRAGMA user_version
+type sqliteMigration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// sqliteMigrations lists every SQLite schema change. Append new migrations
+// at the end with the next version; never change or reorder released ones.
+var sqliteMigrations = []sqliteMigration{
+	{1, "create the feed, item, item state and extraction tables", []string{
+		`CREATE TABLE feeds (
+			url     TEXT PRIMARY KEY,
+			data    TEXT NOT NULL,
+			request BLOB
+		)`,
+		`CREATE TABLE items (
+			feed_url  TEXT NOT NULL,
+			id        TEXT NOT NULL,
+			guid      TEXT NOT NULL,
+			link      TEXT NOT NULL,
+			title     TEXT NOT NULL,
+			published INTEGER NOT NULL,
+			data      TEXT NOT NULL,
+			PRIMARY KEY (feed_url, id)
+		)`,
+		`CREATE INDEX items_by_time ON items (feed_url, published, id)`,
+		`CREATE TABLE item_state (
+			id       TEXT PRIMARY KEY,
+			read     INTEGER NOT NULL DEFAULT 0,
+			favorite INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE extractions (
+			id        TEXT PRIMARY KEY,
+			content   TEXT NOT NULL,
+			error     TEXT NOT NULL,
+			extracted INTEGER NOT NULL
+		)`,
+	}},
+	{2, "index the items without a GUID by link", []string{
+		`CREATE INDEX items_by_link ON items (feed_url, link) WHERE guid = ''`,
+	}},
+	{3, "index the items of every feed by time", []string{
+		`CREATE INDEX items_by_published ON items (published, id)`,
+	}},
+}
+
+// SQLiteSchemaVersion is the SQLite schema version this build reads and
+// writes
+func SQLiteSchemaVersion() int {
+	return sqliteMigrations[len(sqliteMigrations)-1].version
+}
+
+// NewSQLiteDB opens the SQLite database at path, creating it and its key if
+// needed, and migrates it to the current schema version
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	key, err := loadKey(filepath.Join(filepath.Dir(path), KeyFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := lockFile(sqliteLockPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s is in use by another process: %w", path, err)
+	}
+	db, err := openSQLite(path)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	if err := migrateSQLite(db, path); err != nil {
+		db.Close()
+		lock.Close()
+		return nil, err
+	}
+
+	return &SQLiteDB{DB: db, path: path, key: key, lock: lock}, nil
+}
+
+// Close closes the database and releases its lock
+func (db *SQLiteDB) Close() error {
+	err := db.DB.Close()
+	if db.lock != nil {
+		db.lock.Close()
+	}
+	return err
+}
+
+// openSQLite opens an SQLite database in WAL mode, so readers do not block
+// the writer. Write transactions take the write lock up front and wait for
+// other writers instead of failing.
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrateSQLite brings the schema up to SQLiteSchemaVersion. Existing
+// databases are backed up next to the database file first; the pending
+// migrations then run in a single transaction.
+func migrateSQLite(db *sql.DB, path string) error {
+	current, err := readSQLiteVersion(db)
+	if err != nil {
+		return err
+	}
+	pending := pendingSQLiteMigrations(current)
+	if len(pending) == 0 {
+		return nil
+	}
+
+	empty, err := sqliteIsEmpty(db)
+	if err != nil {
+		return err
+	}
+	if current > 0 || !empty {
+		backup := fmt.Sprintf("%s.v%d-%s.bak", path, current, time.Now().Format("20060102-150405"))
+		if _, err := os.Stat(backup); err == nil {
+			return fmt.Errorf("backup %s already exists", backup)
+		}
+		if _, err := db.Exec(`VACUUM INTO ?`, backup); err != nil {
+			return fmt.Errorf("backing up before migrating: %w", err)
+		}
+		log.Printf("Backed up database schema version %d to %s", current, backup)
+	}
+
+	// SQLite changes the schema transactionally, so the pending migrations
+	// run in one transaction and a failure leaves the database as it was
+	err = withTx(db, func(tx *sql.Tx) error {
+		for _, m := range pending {
+			if err := applySQLiteMigration(tx, m); err != nil {
+				return fmt.Errorf("migrating to schema version %d: %w", m.version, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		log.Printf("Migrated database to schema version %d: %s", m.version, m.description)
+	}
+	return nil
+}
+
+// DryRunSQLiteMigrations is DryRunMigrations for an SQLite database
+func DryRunSQLiteMigrations(path string) (current int, reports []MigrationReport, err error) {
+	db, err := openSQLiteReadOnly(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer db.Close()
+
+	current, err = readSQLiteVersion(db)
+	if err != nil {
+		return current, nil, err
+	}
+	pending := pendingSQLiteMigrations(current)
+	if len(pending) == 0 {
+		return current, nil, nil
+	}
+
+	dir, err := os.MkdirTemp("", "deel-dry-run-")
+	if err != nil {
+		return current, nil, err
+	}
+	defer os.RemoveAll(dir)
+	scratchPath := filepath.Join(dir, filepath.Base(path))
+	if _, err := db.Exec(`VACUUM INTO ?`, scratchPath); err != nil {
+		return current, nil, err
+	}
+	scratch, err := openSQLite(scratchPath)
+	if err != nil {
+		return current, nil, err
+	}
+	defer scratch.Close()
+
+	// SQLite changes the schema transactionally, so the pending migrations
+	// run in one transaction that is rolled back
+	err = withTx(scratch, func(tx *sql.Tx) error {
+		for _, m := range pending {
+			before, err := tableStates(tx)
+			if err != nil {
+				return err
+			}
+			if err := applySQLiteMigration(tx, m); err != nil {
+				return fmt.Errorf("migration to schema version %d: %w", m.version, err)
+			}
+			after, err := tableStates(tx)
+			if err != nil {
+				return err
+			}
+			reports = append(reports, MigrationReport{
+				Version:     m.version,
+				Description: m.description,
+				Changes:     describeChanges("table", "rows", before, after),
+			})
+		}
+		return errDryRun
+	})
+	if errors.Is(err, errDryRun) {
+		err = nil
+	}
+	return current, reports, err
+}
+
+// openSQLiteReadOnly opens an existing SQLite database without writing to
+// it or its directory. Readers of a database in WAL mode create -wal and
+// -shm files unless it is opened as immutable, which is safe while there is
+// no -wal file, since then no other connection has the database open.
+func openSQLiteReadOnly(path string) (*sql.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	mode := "mode=ro"
+	if _, err := os.Stat(path + "-wal"); errors.Is(err, os.ErrNotExist) {
+		mode = "immutable=1"
+	}
+	uri := (&url.URL{Scheme: "file", Opaque: (&url.URL{Path: path}).EscapedPath(), RawQuery: mode}).String()
+	db, err := sql.Open("sqlite", uri+"&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// applySQLiteMigration runs the statements of a migration and records its
+// version
+func applySQLiteMigration(tx *sql.Tx, m sqliteMigration) error {
+	for _, statement := range m.statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	// PRAGMA does not take parameters
+	_, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", m.version))
+	return err
+}
+
+// readSQLiteVersion returns the recorded schema version, refusing databases
+// written by a newer build
+func readSQLiteVersion(db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return 0, err
+	}
+	if version > SQLiteSchemaVersion() {
+		return version, fmt.Errorf("database schema version %d is newer than the supported version %d", version, SQLiteSchemaVersion())
+	}
+	return version, nil
+}
+
+// pendingSQLiteMigrations returns the migrations newer than version
+func pendingSQLiteMigrations(version int) []sqliteMigration {
+	var pending []sqliteMigration
+	for _, m := range sqliteMigrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// sqliteIsEmpty reports whether the database has no tables at all
+func sqliteIsEmpty(db *sql.DB) (bool, error) {
+	var tables int
+	err := db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table'`).Scan(&tables)
+	return tables == 0, err
+}
+
+// tableStates summarizes every table by name, like bucketStates
+func tableStates(tx *sql.Tx) (map[string]bucketState, error) {
+	rows, err := tx.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	states := make(map[string]bucketState)
+	for _, name := range names {
+		rows, err := tx.Query(fmt.Sprintf(`SELECT * FROM "%s"`, name))
+		if err != nil {
+			return nil, err
+		}
+		columns, err := rows.Columns()
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		h := sha256.New()
+		count := 0
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		for rows.Next() {
+			if err := rows.Scan(pointers...); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			count++
+			fmt.Fprintf(h, "%q\n", values)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		states[name] = bucketState{keys: count, digest: h.Sum(nil)}
+	}
+	return states, nil
+}
+
+// withTx runs fn in a transaction, committing it if fn succeeds
+func withTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// LoadFeeds loads all feeds from the database
+func (db *SQLiteDB) LoadFeeds() ([]models.Feed, error) {
+	rows, err := db.Query(`SELECT url, data, request FROM feeds ORDER BY url`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var feeds []models.Feed
+	for rows.Next() {
+		var feedURL, data string
+		var sealed []byte
+		if err := rows.Scan(&feedURL, &data, &sealed); err != nil {
+			return nil, err
+		}
+		var feed models.Feed
+		if err := json.Unmarshal([]byte(data), &feed); err != nil {
+			return nil, err
+		}
+		if feed.Request, err = openRequestSettings(db.key, feedURL, sealed); err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, feed)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error loading feeds from database: %v", err)
+		return nil, err
+	}
+	return feeds, nil
+}
+
+// SaveFeed saves a feed to the database
+func (db *SQLiteDB) SaveFeed(feed models.Feed) error {
+	return withTx(db.DB, func(tx *sql.Tx) error {
+		return db.putFeed(tx, feed)
+	})
+}
+
+// putFeed stores a feed with its sealed request settings
+func (db *SQLiteDB) putFeed(tx *sql.Tx, feed models.Feed) error {
+	encoded, err := json.Marshal(feed)
+	if err != nil {
+		return err
+	}
+	var sealed []byte
+	if !feed.Request.Empty() {
+		if sealed, err = sealRequestSettings(db.key, feed.URL, feed.Request); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO feeds (url, data, request) VALUES (?, ?, ?)
+		ON CONFLICT (url) DO UPDATE SET data = excluded.data, request = excluded.request`,
+		feed.URL, string(encoded), sealed)
+	return err
+}
+
+// RenameFeed stores a feed under its new URL and removes the record kept
+// under oldURL, moving its stored items along, in a single transaction.
+// Items get the IDs they will have when fetched from the new URL, see
+// renameFeedItems.
+func (db *SQLiteDB) RenameFeed(oldURL string, feed models.Feed) error {
+	return withTx(db.DB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM feeds WHERE url = ?`, oldURL); err != nil {
+			return err
+		}
+		if err := db.putFeed(tx, feed); err != nil {
+			return err
+		}
+
+		items, err := querySQLiteItems(tx, `WHERE feed_url = ? `+byFeedOrder, oldURL)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM items WHERE feed_url = ?`, oldURL); err != nil {
+			return err
+		}
+		for _, item := range items {
+			oldID := item.ID
+			item.FeedURLOrigin = feed.URL
+			item.ID = utils.ItemID(feed.URL, item.GUID, item.Link, item.Title)
+			if err := putSQLiteItem(tx, feed.URL, item); err != nil {
+				return err
+			}
+			if oldID == item.ID {
+				continue
+			}
+			for _, table := range []string{"item_state", "extractions"} {
+				if _, err := tx.Exec(`UPDATE OR REPLACE `+table+` SET id = ? WHERE id = ?`, item.ID, oldID); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveFeed removes a feed and its stored items, with their state and
+// cached extractions, from the database
+func (db *SQLiteDB) RemoveFeed(feedURL string) error {
+	return withTx(db.DB, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM feeds WHERE url = ?`, feedURL); err != nil {
+			return err
+		}
+		for _, table := range []string{"item_state", "extractions"} {
+			if _, err := tx.Exec(`DELETE FROM `+table+` WHERE id IN (SELECT id FROM items WHERE feed_url = ?)`, feedURL); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`DELETE FROM items WHERE feed_url = ?`, feedURL)
+		return err
+	})
+}
+
+// SaveFeedItems merges items into the store of a feed, like
+// DB.SaveFeedItems
+func (db *SQLiteDB) SaveFeedItems(feedURL string, items []models.FeedItem) (SaveResult, error) {
+	var result SaveResult
+	now := time.Now()
+	err := withTx(db.DB, func(tx *sql.Tx) error {
+		saved := make(map[string]bool) // IDs stored by this call
+		for _, item := range items {
+			key := item.ID
+			if key == "" {
+				continue
+			}
+
+			item.ContentHash = utils.ContentHash(item.Title, item.Description, item.Content)
+			var existing string
+			err := tx.QueryRow(`SELECT data FROM items WHERE feed_url = ? AND id = ?`, feedURL, key).Scan(&existing)
+			switch {
+			case err == nil:
+				var stored models.FeedItem
+				if err := json.Unmarshal([]byte(existing), &stored); err == nil {
+					item.Previous = stored.Previous
+					if stored.ContentHash != "" && stored.ContentHash != item.ContentHash && sqliteItemRead(tx, key) {
+						item.Previous = &models.ItemRevision{
+							Title:       stored.Title,
+							Description: stored.Description,
+							Content:     stored.Content,
+							Replaced:    now,
+						}
+						result.Revised = append(result.Revised, key)
+					}
+				}
+			case errors.Is(err, sql.ErrNoRows):
+				result.Added++
+				oldID, err := sqliteLinkedItem(tx, feedURL, item.Link)
+				if err != nil {
+					return err
+				}
+				if oldID != "" && !saved[oldID] {
+					// Replace the earlier version, carrying its state over
+					result.Added--
+					if _, err := tx.Exec(`INSERT OR REPLACE INTO item_state (id, read, favorite)
+						SELECT ?, read, favorite FROM item_state WHERE id = ?`, key, oldID); err != nil {
+						return err
+					}
+					if _, err := tx.Exec(`DELETE FROM item_state WHERE id = ?`, oldID); err != nil {
+						return err
+					}
+					if _, err := tx.Exec(`DELETE FROM items WHERE feed_url = ? AND id = ?`, feedURL, oldID); err != nil {
+						return err
+					}
+				}
+			default:
+				return err
+			}
+
+			item.FeedURLOrigin = feedURL
+			if err := putSQLiteItem(tx, feedURL, item); err != nil {
+				return err
+			}
+			saved[key] = true
+		}
+		return nil
+	})
+	return result, err
+}
+
+// LoadFeedItems loads the stored items of a feed, newest first, with their
+// read and favorite status
+func (db *SQLiteDB) LoadFeedItems(feedURL string) ([]models.FeedItem, error) {
+	return querySQLiteItems(db.DB, `WHERE feed_url = ? `+byFeedOrder, feedURL)
+}
+
+// LoadAllFeedItems loads the stored items of every feed, newest first, with
+// their read and favorite status
+func (db *SQLiteDB) LoadAllFeedItems() ([]models.FeedItem, error) {
+	items, err := querySQLiteItems(db.DB, byFeedOrder)
+	if err != nil {
+		return nil, err
+	}
+	// Order ties between feeds as the bbolt store does
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].PublishedTime.After(items[j].PublishedTime)
+	})
+	return items, nil
+}
+
+// QueryFeedItems returns the stored items a query selects, newest first.
+// Across feeds the items_by_published index is walked from the newest item,
+// so the limit stops the scan as well as the decoding.
+func (db *SQLiteDB) QueryFeedItems(query ItemQuery) ([]models.FeedItem, error) {
+	var conditions []string
+	var args []interface{}
+	if query.FeedURL != "" {
+		conditions = append(conditions, `i.feed_url = ?`)
+		args = append(args, query.FeedURL)
+	}
+	if query.Unread {
+		conditions = append(conditions, `coalesce(s.read, 0) = 0`)
+	}
+	if query.Favorite {
+		conditions = append(conditions, `coalesce(s.favorite, 0) = 1`)
+	}
+
+	var clauses string
+	if len(conditions) > 0 {
+		clauses = `WHERE ` + strings.Join(conditions, ` AND `) + ` `
+	}
+	clauses += `ORDER BY i.published DESC, i.id DESC`
+	if query.Limit > 0 {
+		clauses += ` LIMIT ?`
+		args = append(args, query.Limit)
+	}
+	return querySQLiteItems(db.DB, clauses, args...)
+}
+
+// CountFeedItems returns the number of stored items per feed URL
+func (db *SQLiteDB) CountFeedItems() (map[string]int, error) {
+	return queryCounts(db.DB, `SELECT feed_url, count(*) FROM items GROUP BY feed_url`)
+}
+
+// CountUnreadFeedItems returns the number of stored unread items per feed URL
+func (db *SQLiteDB) CountUnreadFeedItems() (map[string]int, error) {
+	return queryCounts(db.DB, `SELECT i.feed_url, count(*) FROM items i
+		LEFT JOIN item_state s ON s.id = i.id
+		WHERE coalesce(s.read, 0) = 0
+		GROUP BY i.feed_url`)
+}
+
+// PruneFeedItems deletes the stored items of a feed that fall outside the
+// retention policy, like DB.PruneFeedItems
+func (db *SQLiteDB) PruneFeedItems(feedURL string, policy models.RetentionPolicy, now time.Time) (int, error) {
+	if !policy.Prunes() {
+		return 0, nil
+	}
+	cutoff := policy.Cutoff(now)
+
+	pruned := 0
+	err := withTx(db.DB, func(tx *sql.Tx) error {
+		items, err := querySQLiteItems(tx, `WHERE feed_url = ? `+byFeedOrder, feedURL)
+		if err != nil {
+			return err
+		}
+		for rank, item := range items {
+			tooMany := policy.MaxItems > 0 && rank+1 > policy.MaxItems
+			tooOld := !cutoff.IsZero() && !item.PublishedTime.IsZero() && item.PublishedTime.Before(cutoff)
+			if (!tooMany && !tooOld) || item.Favorite || (policy.KeepUnread && !item.Read) {
+				continue
+			}
+			if _, err := tx.Exec(`DELETE FROM items WHERE feed_url = ? AND id = ?`, feedURL, item.ID); err != nil {
+				return err
+			}
+			for _, table := range []string{"item_state", "extractions"} {
+				if _, err := tx.Exec(`DELETE FROM `+table+` WHERE id = ?`, item.ID); err != nil {
+					return err
+				}
+			}
+			pruned++
+		}
+		return nil
+	})
+	return pruned, err
+}
+
+// SaveExtraction caches the result of extracting the article of an item,
+// replacing any earlier result
+func (db *SQLiteDB) SaveExtraction(itemID string, extraction models.Extraction) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO extractions (id, content, error, extracted) VALUES (?, ?, ?, ?)`,
+		itemID, extraction.Content, extraction.Error, extraction.Extracted.UnixNano())
+	return err
+}
+
+// GetFeedItemReadStatus retrieves the read status of a feed item by its ID.
+// It defaults to false (unread) if the item is not found.
+func (db *SQLiteDB) GetFeedItemReadStatus(itemID string) bool {
+	return db.getItemState("read", itemID)
+}
+
+// SetFeedItemReadStatus sets the read status of a feed item by its ID
+func (db *SQLiteDB) SetFeedItemReadStatus(itemID string, read bool) error {
+	return db.setItemState("read", itemID, read)
+}
+
+// GetFeedItemFavoriteStatus retrieves the favorite status of a feed item by
+// its ID. It defaults to false (not favorited) if the item is not found.
+func (db *SQLiteDB) GetFeedItemFavoriteStatus(itemID string) bool {
+	return db.getItemState("favorite", itemID)
+}
+
+// SetFeedItemFavoriteStatus sets the favorite status of a feed item by its ID
+func (db *SQLiteDB) SetFeedItemFavoriteStatus(itemID string, favorite bool) error {
+	return db.setItemState("favorite", itemID, favorite)
+}
+
+// SetFeedItemReadStatuses sets the read status of many items in a single
+// transaction
+func (db *SQLiteDB) SetFeedItemReadStatuses(itemIDs []string, read bool) error {
+	return db.setItemStates("read", itemIDs, read)
+}
+
+// SetFeedItemFavoriteStatuses sets the favorite status of many items in a
+// single transaction
+func (db *SQLiteDB) SetFeedItemFavoriteStatuses(itemIDs []string, favorite bool) error {
+	return db.setItemStates("favorite", itemIDs, favorite)
+}
+
+// getItemState reads the read or favorite column of an item's state
+func (db *SQLiteDB) getItemState(column, itemID string) bool {
+	var set bool
+	err := db.QueryRow(`SELECT `+column+` FROM item_state WHERE id = ?`, itemID).Scan(&set)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Error getting %s status for %s: %v", column, itemID, err)
+	}
+	return set
+}
+
+// setItemState writes the read or favorite column of an item's state
+func (db *SQLiteDB) setItemState(column, itemID string, set bool) error {
+	_, err := db.Exec(`INSERT INTO item_state (id, `+column+`) VALUES (?, ?)
+		ON CONFLICT (id) DO UPDATE SET `+column+` = excluded.`+column, itemID, set)
+	return err
+}
+
+// MarkAllFeedItemsRead marks every stored item as read in a single
+// statement. It returns the number of items that were unread.
+func (db *SQLiteDB) MarkAllFeedItemsRead() (int, error) {
+	// WHERE true keeps SQLite from reading ON CONFLICT as a join constraint
+	result, err := db.Exec(`INSERT INTO item_state (id, read)
+		SELECT id, 1 FROM items WHERE true
+		ON CONFLICT (id) DO UPDATE SET read = 1 WHERE read = 0`)
+	if err != nil {
+		return 0, err
+	}
+	marked, err := result.RowsAffected()
+	return int(marked), err
+}
+
+// setItemStates writes the read or favorite column of many items
+func (db *SQLiteDB) setItemStates(column string, itemIDs []string, set bool) error {
+	if len(itemIDs) == 0 {
+		return nil
+	}
+	return withTx(db.DB, func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare(`INSERT INTO item_state (id, ` + column + `) VALUES (?, ?)
+			ON CONFLICT (id) DO UPDATE SET ` + column + ` = excluded.` + column)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, itemID := range itemIDs {
+			if _, err := stmt.Exec(itemID, set); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// sqliteLinkedItem returns the ID of the stored item of a feed that has no
+// GUID and carries link, or "" if there is none, see DB.SaveFeedItems
+func sqliteLinkedItem(tx *sql.Tx, feedURL, link string) (string, error) {
+	if link == "" {
+		return "", nil
+	}
+	var itemID string
+	err := tx.QueryRow(`SELECT id FROM items WHERE feed_url = ? AND guid = '' AND link = ?
+		ORDER BY published DESC LIMIT 1`, feedURL, link).Scan(&itemID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return itemID, err
+}
+
+// sqliteItemRead reports whether an item is read within tx
+func sqliteItemRead(tx *sql.Tx, itemID string) bool {
+	var read bool
+	tx.QueryRow(`SELECT read FROM item_state WHERE id = ?`, itemID).Scan(&read)
+	return read
+}
+
+// putSQLiteItem inserts or replaces an item of a feed
+func putSQLiteItem(tx *sql.Tx, feedURL string, item models.FeedItem) error {
+	encoded, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO items (feed_url, id, guid, link, title, published, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		feedURL, item.ID, item.GUID, item.Link, item.Title, int64(publishedNanos(item.PublishedTime)), string(encoded))
+	return err
+}
+
+// querier is implemented by *sql.DB and *sql.Tx
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// byFeedOrder orders items by feed, newest first
+const byFeedOrder = `ORDER BY i.feed_url, i.published DESC, i.id DESC`
+
+// querySQLiteItems loads the items selected and ordered by clauses, which
+// follow the joins, with their state and cached extraction
+func querySQLiteItems(q querier, clauses string, args ...interface{}) ([]models.FeedItem, error) {
+	rows, err := q.Query(`SELECT i.data, coalesce(s.read, 0), coalesce(s.favorite, 0),
+			coalesce(e.content, ''), coalesce(e.error, '')
+		FROM items i
+		LEFT JOIN item_state s ON s.id = i.id
+		LEFT JOIN extractions e ON e.id = i.id
+		`+clauses, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []models.FeedItem
+	for rows.Next() {
+		var data string
+		var item models.FeedItem
+		if err := rows.Scan(&data, &item.Read, &item.Favorite, &item.FullContent, &item.ExtractionError); err != nil {
+			return nil, err
+		}
+		// The state and extraction are not part of the JSON, so unmarshalling
+		// keeps them
+		if err := json.Unmarshal([]byte(data), &item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// queryCounts runs a query returning feed URLs and counts
+func queryCounts(q querier, query string) (map[string]int, error) {
+	rows, err := q.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var feedURL string
+		var count int
+		if err := rows.Scan(&feedURL, &count); err != nil {
+			return nil, err
+		}
+		counts[feedURL] = count
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,65 @@
+package database
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+// SetFeedItemReadStatuses sets the read status of many items in a single
+// transaction
+func (db *DB) SetFeedItemReadStatuses(itemIDs []string, read bool) error {
+	return db.setItemStates(FeedItemStatusBucketName, itemIDs, read)
+}
+
+// SetFeedItemFavoriteStatuses sets the favorite status of many items in a
+// single transaction
+func (db *DB) SetFeedItemFavoriteStatuses(itemIDs []string, favorite bool) error {
+	return db.setItemStates(FeedItemFavoriteBucketName, itemIDs, favorite)
+}
+
+// MarkAllFeedItemsRead marks every stored item as read in a single
+// transaction, going over the item keys without decoding the items. It
+// returns the number of items that were unread.
+func (db *DB) MarkAllFeedItemsRead() (int, error) {
+	marked := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(FeedItemsBucketName))
+		status := tx.Bucket([]byte(FeedItemStatusBucketName))
+		return root.ForEach(func(feedURL, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			byKey := root.Bucket(feedURL).Bucket(itemsBucketName)
+			if byKey == nil {
+				return nil
+			}
+			return byKey.ForEach(func(itemID, _ []byte) error {
+				if string(status.Get(itemID)) == "true" {
+					return nil
+				}
+				marked++
+				return status.Put(append([]byte(nil), itemID...), []byte("true"))
+			})
+		})
+	})
+	return marked, err
+}
+
+// setItemStates writes a "true"/"false" value for itemIDs to a bucket
+func (db *DB) setItemStates(bucket string, itemIDs []string, set bool) error {
+	if len(itemIDs) == 0 {
+		return nil
+	}
+	val := []byte("false")
+	if set {
+		val = []byte("true")
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		for _, itemID := range itemIDs {
+			if err := b.Put([]byte(itemID), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,172 @@
+package database
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"deel/internal/models"
+)
+
+// Storage backends, as named in the storage setting
+const (
+	BoltBackend   = "bolt"
+	SQLiteBackend = "sqlite"
+)
+
+// Store keeps the feeds, their items, the read and favorite state of items
+// and the per-feed settings. DB, the bbolt database, and SQLiteDB implement
+// it.
+type Store interface {
+	// LoadFeeds returns every feed with its request settings, ordered by URL
+	LoadFeeds() ([]models.Feed, error)
+	// SaveFeed stores a feed and its request settings
+	SaveFeed(feed models.Feed) error
+	// RenameFeed moves a feed and its items from oldURL to feed.URL
+	RenameFeed(oldURL string, feed models.Feed) error
+	// RemoveFeed removes a feed and its items with their state
+	RemoveFeed(feedURL string) error
+
+	// SaveFeedItems merges items into the items of a feed, see DB.SaveFeedItems
+	SaveFeedItems(feedURL string, items []models.FeedItem) (SaveResult, error)
+	// LoadFeedItems returns the items of a feed, newest first
+	LoadFeedItems(feedURL string) ([]models.FeedItem, error)
+	// LoadAllFeedItems returns the items of every feed, newest first
+	LoadAllFeedItems() ([]models.FeedItem, error)
+	// QueryFeedItems returns the items a query selects, newest first,
+	// decoding no more items than it returns
+	QueryFeedItems(query ItemQuery) ([]models.FeedItem, error)
+	// CountFeedItems returns the number of items per feed URL
+	CountFeedItems() (map[string]int, error)
+	// CountUnreadFeedItems returns the number of unread items per feed URL
+	CountUnreadFeedItems() (map[string]int, error)
+	// PruneFeedItems deletes the items outside a retention policy
+	PruneFeedItems(feedURL string, policy models.RetentionPolicy, now time.Time) (int, error)
+	// SaveExtraction caches the extracted article of an item
+	SaveExtraction(itemID string, extraction models.Extraction) error
+
+	GetFeedItemReadStatus(itemID string) bool
+	SetFeedItemReadStatus(itemID string, read bool) error
+	GetFeedItemFavoriteStatus(itemID string) bool
+	SetFeedItemFavoriteStatus(itemID string, favorite bool) error
+
+	// The batch variants write the state of many items in a single
+	// transaction
+	SetFeedItemReadStatuses(itemIDs []string, read bool) error
+	SetFeedItemFavoriteStatuses(itemIDs []string, favorite bool) error
+	// MarkAllFeedItemsRead marks every stored item as read and returns how
+	// many were unread
+	MarkAllFeedItemsRead() (int, error)
+
+	// Snapshot writes a consistent copy of the database file to w without
+	// stopping the store
+	Snapshot(w io.Writer) (int64, error)
+	// Backend names the storage backend, BoltBackend or SQLiteBackend
+	Backend() string
+	// Path returns the path of the database file
+	Path() string
+
+	// Check verifies the consistency of the database file and returns the
+	// problems it finds
+	Check() ([]string, error)
+	// CollectGarbage deletes state left behind by deleted feeds and items
+	// and returns the number of entries deleted per bucket or table
+	CollectGarbage() (map[string]int, error)
+	// Compact rewrites the database file to give free space back to the
+	// file system
+	Compact() error
+
+	Close() error
+}
+
+// ItemQuery selects stored items, as shown on a page
+type ItemQuery struct {
+	FeedURL  string // only items of this feed, of every feed if empty
+	Unread   bool   // only unread items
+	Favorite bool   // only favorites
+	Limit    int    // at most this many of the newest items, all if zero
+}
+
+// Open opens the store of the named backend at path, creating it if needed,
+// and migrates it to the current schema version
+func Open(backend, path string) (Store, error) {
+	switch backend {
+	case BoltBackend:
+		return NewDB(path)
+	case SQLiteBackend:
+		return NewSQLiteDB(path)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// CopyReport counts what CopyStore copied
+type CopyReport struct {
+	Feeds       int
+	Items       int
+	Read        int
+	Favorites   int
+	Extractions int
+}
+
+// CopyStore copies every feed with its items, their read and favorite state
+// and cached extractions from src to dst, which must hold no feeds. Items
+// of feeds that are no longer subscribed are not copied. Extractions are
+// recorded as made at the time of the copy.
+func CopyStore(dst, src Store) (CopyReport, error) {
+	var report CopyReport
+	existing, err := dst.LoadFeeds()
+	if err != nil {
+		return report, err
+	}
+	if len(existing) > 0 {
+		return report, fmt.Errorf("the destination already holds %d feeds", len(existing))
+	}
+
+	feeds, err := src.LoadFeeds()
+	if err != nil {
+		return report, err
+	}
+	now := time.Now()
+	for _, feed := range feeds {
+		if err := dst.SaveFeed(feed); err != nil {
+			return report, fmt.Errorf("copying feed %s: %w", feed.URL, err)
+		}
+		report.Feeds++
+
+		items, err := src.LoadFeedItems(feed.URL)
+		if err != nil {
+			return report, fmt.Errorf("loading items of %s: %w", feed.URL, err)
+		}
+		if _, err := dst.SaveFeedItems(feed.URL, items); err != nil {
+			return report, fmt.Errorf("copying items of %s: %w", feed.URL, err)
+		}
+		report.Items += len(items)
+
+		var read, favorites []string
+		for _, item := range items {
+			if item.Read {
+				read = append(read, item.ID)
+			}
+			if item.Favorite {
+				favorites = append(favorites, item.ID)
+			}
+			if item.FullContent != "" || item.ExtractionError != "" {
+				extraction := models.Extraction{Content: item.FullContent, Error: item.ExtractionError, Extracted: now}
+				if err := dst.SaveExtraction(item.ID, extraction); err != nil {
+					return report, err
+				}
+				report.Extractions++
+			}
+		}
+		if err := dst.SetFeedItemReadStatuses(read, true); err != nil {
+			return report, err
+		}
+		if err := dst.SetFeedItemFavoriteStatuses(favorites, true); err != nil {
+			return report, err
+		}
+		report.Read += len(read)
+		report.Favorites += len(favorites)
+	}
+	return report, nil
+}
@@ -0,0 +1,499 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"deel/internal/models"
+	"deel/internal/utils"
+)
+
+// forEachBackend runs test against a new empty store of every backend
+func forEachBackend(t *testing.T, test func(t *testing.T, store Store)) {
+	for _, backend := range []string{BoltBackend, SQLiteBackend} {
+		t.Run(backend, func(t *testing.T) {
+			store, err := Open(backend, filepath.Join(t.TempDir(), "deel."+backend))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			test(t, store)
+		})
+	}
+}
+
+// storeItem returns an item of a feed with its ID set; the title doubles as
+// its GUID unless guid is false
+func storeItem(feedURL, title string, guid bool, published time.Time) models.FeedItem {
+	item := models.FeedItem{
+		Title:         title,
+		Link:          "http://example.com/" + title,
+		Description:   "About " + title,
+		PublishedTime: published,
+	}
+	if guid {
+		item.GUID = title
+	}
+	item.ID = utils.ItemID(feedURL, item.GUID, item.Link, item.Title)
+	return item
+}
+
+// itemTitles lists the titles of items in order
+func itemTitles(items []models.FeedItem) []string {
+	titles := []string{}
+	for _, item := range items {
+		titles = append(titles, item.Title)
+	}
+	return titles
+}
+
+// itemIDs lists the IDs of items in order
+func itemIDs(items []models.FeedItem) []string {
+	ids := []string{}
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	return ids
+}
+
+func TestQueryFeedItems(t *testing.T) {
+	const feedA, feedB = "http://a.example/feed", "http://b.example/feed"
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	forEachBackend(t, func(t *testing.T, store Store) {
+		// The feeds interleave in time, a1 and b2 share a publish time and
+		// b0 is undated
+		saves := map[string][]models.FeedItem{
+			feedA: {
+				{ID: "a1", Title: "a1", PublishedTime: day.Add(1 * time.Hour)},
+				{ID: "a3", Title: "a3", PublishedTime: day.Add(3 * time.Hour)},
+				{ID: "a4", Title: "a4", PublishedTime: day.Add(4 * time.Hour)},
+			},
+			feedB: {
+				{ID: "b0", Title: "b0"},
+				{ID: "b2", Title: "b2", PublishedTime: day.Add(1 * time.Hour)},
+				{ID: "b5", Title: "b5", PublishedTime: day.Add(5 * time.Hour)},
+			},
+		}
+		for feedURL, items := range saves {
+			if _, err := store.SaveFeedItems(feedURL, items); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.SetFeedItemReadStatuses([]string{"a4", "b2"}, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetFeedItemFavoriteStatuses([]string{"a1", "a4", "b0"}, true); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			query ItemQuery
+			want  []string
+		}{
+			{ItemQuery{}, []string{"b5", "a4", "a3", "b2", "a1", "b0"}},
+			{ItemQuery{FeedURL: feedA}, []string{"a4", "a3", "a1"}},
+			{ItemQuery{FeedURL: "http://missing.example/feed"}, []string{}},
+			{ItemQuery{Unread: true}, []string{"b5", "a3", "a1", "b0"}},
+			{ItemQuery{Favorite: true}, []string{"a4", "a1", "b0"}},
+			{ItemQuery{Unread: true, Favorite: true}, []string{"a1", "b0"}},
+			{ItemQuery{Limit: 2}, []string{"b5", "a4"}},
+			{ItemQuery{Unread: true, Limit: 3}, []string{"b5", "a3", "a1"}},
+			{ItemQuery{FeedURL: feedB, Favorite: true, Limit: 1}, []string{"b0"}},
+		}
+		for _, tt := range tests {
+			items, err := store.QueryFeedItems(tt.query)
+			if err != nil {
+				t.Fatalf("QueryFeedItems(%+v): %v", tt.query, err)
+			}
+			if got := itemIDs(items); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("QueryFeedItems(%+v) = %v, want %v", tt.query, got, tt.want)
+			}
+		}
+
+		// The items carry their state
+		items, err := store.QueryFeedItems(ItemQuery{FeedURL: feedA, Limit: 1})
+		if err != nil || len(items) != 1 || !items[0].Read || !items[0].Favorite || items[0].Title != "a4" {
+			t.Errorf("QueryFeedItems = %+v (%v), want a4 read and favorite", items, err)
+		}
+	})
+}
+
+// TestStoreBehavior runs the same checks against every backend, so the
+// backends stay interchangeable
+func TestStoreBehavior(t *testing.T) {
+	tests := []struct {
+		name  string
+		check func(t *testing.T, store Store)
+	}{
+		{"feeds", checkStoreFeeds},
+		{"items", checkStoreItems},
+		{"link successor", checkStoreLinkSuccessor},
+		{"status", checkStoreStatus},
+		{"rename", checkStoreRename},
+		{"remove", checkStoreRemove},
+		{"retention", checkStoreRetention},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, tt.check)
+		})
+	}
+}
+
+// checkStoreFeeds checks that feeds and their request settings are saved,
+// updated and listed by URL
+func checkStoreFeeds(t *testing.T, store Store) {
+	settings := models.RequestSettings{
+		Username: "reader",
+		Password: "secret",
+		Headers:  map[string]string{"X-Token": "abc"},
+	}
+	for _, feed := range []models.Feed{
+		{URL: "http://b.example/feed", Title: "B", Request: settings},
+		{URL: "http://a.example/feed", Title: "A"},
+		{URL: "http://b.example/feed", Title: "B, renamed", Request: settings},
+	} {
+		if err := store.SaveFeed(feed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	feeds, err := store.LoadFeeds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feeds) != 2 || feeds[0].Title != "A" || feeds[1].Title != "B, renamed" {
+		t.Fatalf("LoadFeeds = %+v, want A and the renamed B", feeds)
+	}
+	if !feeds[0].Request.Empty() || !reflect.DeepEqual(feeds[1].Request, settings) {
+		t.Errorf("request settings %+v and %+v, want none and %+v", feeds[0].Request, feeds[1].Request, settings)
+	}
+}
+
+// checkStoreItems checks that items are merged, ordered, counted and keep
+// the version that was read when the publisher edits them
+func checkStoreItems(t *testing.T, store Store) {
+	const feedA, feedB = "http://a.example/feed", "http://b.example/feed"
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	one := storeItem(feedA, "one", true, day.Add(1*time.Hour))
+	two := storeItem(feedA, "two", true, day.Add(2*time.Hour))
+	undated := storeItem(feedA, "undated", true, time.Time{})
+	other := storeItem(feedB, "other", true, day.Add(90*time.Minute))
+
+	result, err := store.SaveFeedItems(feedA, []models.FeedItem{one, undated, two})
+	if err != nil || result.Added != 3 {
+		t.Fatalf("SaveFeedItems added %d (%v), want 3", result.Added, err)
+	}
+	if _, err := store.SaveFeedItems(feedB, []models.FeedItem{other}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Editing a read item keeps the version that was read
+	if err := store.SetFeedItemReadStatus(one.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	editedOne, editedTwo := one, two
+	editedOne.Description = "Edited"
+	editedTwo.Description = "Edited"
+	result, err = store.SaveFeedItems(feedA, []models.FeedItem{editedOne, editedTwo})
+	if err != nil || result.Added != 0 || !reflect.DeepEqual(result.Revised, []string{one.ID}) {
+		t.Fatalf("saving edits added %d and revised %v (%v), want only %s revised", result.Added, result.Revised, err, one.ID)
+	}
+
+	extraction := models.Extraction{Content: "<p>Full</p>", Extracted: day}
+	if err := store.SaveExtraction(two.ID, extraction); err != nil {
+		t.Fatal(err)
+	}
+
+	// Items missing from a save are kept
+	items, err := store.LoadFeedItems(feedA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := itemTitles(items), []string{"two", "one", "undated"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("LoadFeedItems = %v, want %v", got, want)
+	}
+	if got := items[1]; !got.Read || got.Description != "Edited" || got.Previous == nil || got.Previous.Description != one.Description {
+		t.Errorf("edited read item %+v, want it read with the version that was read as its previous revision", got)
+	}
+	if got := items[0]; got.Read || got.Previous != nil || got.FullContent != extraction.Content {
+		t.Errorf("edited unread item %+v, want it unread without a previous revision and with its extraction", got)
+	}
+	if items[0].FeedURLOrigin != feedA {
+		t.Errorf("item of feed %q, want %q", items[0].FeedURLOrigin, feedA)
+	}
+
+	all, err := store.LoadAllFeedItems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := itemTitles(all), []string{"two", "other", "one", "undated"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadAllFeedItems = %v, want %v", got, want)
+	}
+
+	if counts, err := store.CountFeedItems(); err != nil || !reflect.DeepEqual(counts, map[string]int{feedA: 3, feedB: 1}) {
+		t.Errorf("CountFeedItems = %v (%v), want 3 and 1", counts, err)
+	}
+	if counts, err := store.CountUnreadFeedItems(); err != nil || !reflect.DeepEqual(counts, map[string]int{feedA: 2, feedB: 1}) {
+		t.Errorf("CountUnreadFeedItems = %v (%v), want 2 and 1", counts, err)
+	}
+}
+
+// checkStoreLinkSuccessor checks that an item without a GUID whose title
+// changes replaces the stored item of the same link, keeping its state
+func checkStoreLinkSuccessor(t *testing.T, store Store) {
+	const feedURL = "http://example.com/feed"
+	published := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	item := storeItem(feedURL, "draft", false, published)
+	if _, err := store.SaveFeedItems(feedURL, []models.FeedItem{item}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetFeedItemReadStatus(item.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetFeedItemFavoriteStatus(item.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	successor := item
+	successor.Title = "final"
+	successor.ID = utils.ItemID(feedURL, "", successor.Link, successor.Title)
+	result, err := store.SaveFeedItems(feedURL, []models.FeedItem{successor})
+	if err != nil || result.Added != 0 {
+		t.Fatalf("saving the successor added %d items (%v), want it to replace the item", result.Added, err)
+	}
+	items, err := store.LoadFeedItems(feedURL)
+	if err != nil || len(items) != 1 || items[0].ID != successor.ID || !items[0].Read || !items[0].Favorite {
+		t.Errorf("items after saving the successor: %+v (%v), want only the read favorite successor", items, err)
+	}
+	if store.GetFeedItemReadStatus(item.ID) || store.GetFeedItemFavoriteStatus(item.ID) {
+		t.Error("the replaced item kept its state")
+	}
+}
+
+// checkStoreStatus checks the read and favorite state of items, one at a
+// time, in batches and all at once
+func checkStoreStatus(t *testing.T, store Store) {
+	const feedURL = "http://example.com/feed"
+	published := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	var items []models.FeedItem
+	var ids []string
+	for i := 0; i < 3; i++ {
+		item := storeItem(feedURL, fmt.Sprint(i), true, published.Add(time.Duration(i)*time.Hour))
+		items = append(items, item)
+		ids = append(ids, item.ID)
+	}
+	if _, err := store.SaveFeedItems(feedURL, items); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.GetFeedItemReadStatus(ids[0]) || store.GetFeedItemFavoriteStatus(ids[0]) {
+		t.Error("new item is read or a favorite")
+	}
+	if err := store.SetFeedItemReadStatus(ids[0], true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetFeedItemFavoriteStatus(ids[0], true); err != nil {
+		t.Fatal(err)
+	}
+	if !store.GetFeedItemReadStatus(ids[0]) || !store.GetFeedItemFavoriteStatus(ids[0]) {
+		t.Error("item is not read and a favorite after setting both")
+	}
+	if err := store.SetFeedItemFavoriteStatus(ids[0], false); err != nil {
+		t.Fatal(err)
+	}
+	if store.GetFeedItemFavoriteStatus(ids[0]) {
+		t.Error("item is still a favorite after clearing it")
+	}
+
+	if err := store.SetFeedItemFavoriteStatuses(ids[1:], true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetFeedItemReadStatuses(ids, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if store.GetFeedItemReadStatus(id) {
+			t.Errorf("item %s is read after marking all unread", id)
+		}
+		if want := id != ids[0]; store.GetFeedItemFavoriteStatus(id) != want {
+			t.Errorf("item %s favorite %v, want %v", id, !want, want)
+		}
+	}
+
+	if err := store.SetFeedItemReadStatus(ids[2], true); err != nil {
+		t.Fatal(err)
+	}
+	if marked, err := store.MarkAllFeedItemsRead(); err != nil || marked != 2 {
+		t.Errorf("MarkAllFeedItemsRead marked %d (%v), want 2", marked, err)
+	}
+	if marked, err := store.MarkAllFeedItemsRead(); err != nil || marked != 0 {
+		t.Errorf("MarkAllFeedItemsRead again marked %d (%v), want 0", marked, err)
+	}
+	if counts, err := store.CountUnreadFeedItems(); err != nil || len(counts) != 0 {
+		t.Errorf("CountUnreadFeedItems = %v (%v), want none", counts, err)
+	}
+}
+
+// checkStoreRename checks that renaming a feed moves its items to IDs of
+// the new URL, along with their state and extraction
+func checkStoreRename(t *testing.T, store Store) {
+	const oldURL, newURL = "http://old.example/feed", "http://new.example/feed"
+	item := storeItem(oldURL, "one", true, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	if err := store.SaveFeed(models.Feed{URL: oldURL, Title: "Feed"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SaveFeedItems(oldURL, []models.FeedItem{item}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetFeedItemReadStatus(item.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetFeedItemFavoriteStatus(item.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveExtraction(item.ID, models.Extraction{Content: "<p>Full</p>"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.RenameFeed(oldURL, models.Feed{URL: newURL, Title: "Feed"}); err != nil {
+		t.Fatal(err)
+	}
+	feeds, err := store.LoadFeeds()
+	if err != nil || len(feeds) != 1 || feeds[0].URL != newURL {
+		t.Errorf("LoadFeeds after renaming = %+v (%v), want only %s", feeds, err, newURL)
+	}
+	if items, err := store.LoadFeedItems(oldURL); err != nil || len(items) != 0 {
+		t.Errorf("items left under the old URL: %v (%v)", itemTitles(items), err)
+	}
+	items, err := store.LoadFeedItems(newURL)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("items under the new URL: %v (%v), want one", itemTitles(items), err)
+	}
+	moved := items[0]
+	if want := utils.ItemID(newURL, item.GUID, item.Link, item.Title); moved.ID != want || moved.FeedURLOrigin != newURL {
+		t.Errorf("moved item has ID %s of feed %s, want %s of %s", moved.ID, moved.FeedURLOrigin, want, newURL)
+	}
+	if !moved.Read || !moved.Favorite || moved.FullContent != "<p>Full</p>" {
+		t.Errorf("moved item %+v lost its state or extraction", moved)
+	}
+	if store.GetFeedItemReadStatus(item.ID) || store.GetFeedItemFavoriteStatus(item.ID) {
+		t.Error("state was left under the old item ID")
+	}
+}
+
+// checkStoreRemove checks that removing a feed removes its items and their
+// state, and nothing of other feeds
+func checkStoreRemove(t *testing.T, store Store) {
+	const removed, kept = "http://removed.example/feed", "http://kept.example/feed"
+	published := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	items := map[string]models.FeedItem{
+		removed: storeItem(removed, "gone", true, published),
+		kept:    storeItem(kept, "stays", true, published),
+	}
+	for feedURL, item := range items {
+		if err := store.SaveFeed(models.Feed{URL: feedURL}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.SaveFeedItems(feedURL, []models.FeedItem{item}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetFeedItemReadStatus(item.ID, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.RemoveFeed(removed); err != nil {
+		t.Fatal(err)
+	}
+	feeds, err := store.LoadFeeds()
+	if err != nil || len(feeds) != 1 || feeds[0].URL != kept {
+		t.Errorf("LoadFeeds after removing = %+v (%v), want only %s", feeds, err, kept)
+	}
+	if counts, err := store.CountFeedItems(); err != nil || !reflect.DeepEqual(counts, map[string]int{kept: 1}) {
+		t.Errorf("CountFeedItems after removing = %v (%v), want only the kept item", counts, err)
+	}
+	if store.GetFeedItemReadStatus(items[removed].ID) {
+		t.Error("the removed item kept its read state")
+	}
+	if !store.GetFeedItemReadStatus(items[kept].ID) {
+		t.Error("the kept item lost its read state")
+	}
+}
+
+// checkStoreRetention checks which items a retention policy prunes:
+// favorites and, if asked, unread items are kept, and undated items are
+// only pruned by count
+func checkStoreRetention(t *testing.T, store Store) {
+	now := time.Now()
+	tests := []struct {
+		policy   models.RetentionPolicy
+		read     []string
+		favorite []string
+		want     []string
+	}{
+		{models.RetentionPolicy{}, nil, nil, []string{"d1", "d2", "d3", "d4", "d5", "undated"}},
+		{models.RetentionPolicy{MaxItems: 2}, nil, []string{"d4"}, []string{"d1", "d2", "d4"}},
+		{models.RetentionPolicy{MaxAgeDays: 3}, nil, []string{"d4"}, []string{"d1", "d2", "d3", "d4", "undated"}},
+		{models.RetentionPolicy{MaxItems: 1, KeepUnread: true}, []string{"d2", "d5"}, []string{"d4"}, []string{"d1", "d3", "d4", "undated"}},
+	}
+	for i, tt := range tests {
+		feedURL := fmt.Sprintf("http://example.com/%d", i)
+		ids := make(map[string]string)
+		items := []models.FeedItem{storeItem(feedURL, "undated", true, time.Time{})}
+		for day := 1; day <= 5; day++ {
+			// An hour short of whole days, so d3 is within three days
+			items = append(items, storeItem(feedURL, fmt.Sprintf("d%d", day), true, now.AddDate(0, 0, -day).Add(time.Hour)))
+		}
+		for _, item := range items {
+			ids[item.Title] = item.ID
+		}
+		if _, err := store.SaveFeedItems(feedURL, items); err != nil {
+			t.Fatal(err)
+		}
+		for _, title := range tt.read {
+			if err := store.SetFeedItemReadStatus(ids[title], true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, title := range tt.favorite {
+			if err := store.SetFeedItemFavoriteStatus(ids[title], true); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		pruned, err := store.PruneFeedItems(feedURL, tt.policy, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := len(items) - len(tt.want); pruned != want {
+			t.Errorf("policy %+v pruned %d items, want %d", tt.policy, pruned, want)
+		}
+		kept, err := store.LoadFeedItems(feedURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := itemTitles(kept); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("policy %+v kept %v, want %v", tt.policy, got, tt.want)
+		}
+		for _, title := range tt.read {
+			if store.GetFeedItemReadStatus(ids[title]) != contains(tt.want, title) {
+				t.Errorf("policy %+v: read state of %s does not match whether it was kept", tt.policy, title)
+			}
+		}
+	}
+}
+
+// contains reports whether list holds s
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
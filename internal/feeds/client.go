@@ -0,0 +1,168 @@
+package feeds
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// ClientOptions configure the HTTP client shared by every feed request
+type ClientOptions struct {
+	ProxyURL string // http, https or socks5 proxy for all requests, the proxy environment variables are used if empty
+	CAFile   string // PEM bundle of CAs trusted in addition to the system roots
+	CertFile string // PEM client certificate presented to servers that ask for one
+	KeyFile  string // PEM private key of CertFile
+
+	DenyPrivate    bool     // refuse connections to private, loopback and link-local addresses
+	DeniedNetworks []string // further networks to refuse, in CIDR notation
+	MaxRedirects   int      // redirects followed per request, DefaultMaxRedirects if zero
+}
+
+// proxyContextKey carries the proxy of a single feed on a request context
+type proxyContextKey struct{}
+
+// globalProxyContextKey carries the host:port of the global proxy on the
+// context of a request sent through it
+type globalProxyContextKey struct{}
+
+// defaultClient is used when the manager has no client of its own
+var defaultClient, _ = NewClient(ClientOptions{})
+
+// NewClient builds the HTTP client for feed requests. Its transport routes
+// every request through the global proxy, unless the request context holds
+// a per-feed proxy set with withProxy. Only http and https URLs are
+// fetched, and denied addresses are refused after DNS resolution, on every
+// redirect.
+func NewClient(opts ClientOptions) (*http.Client, error) {
+	guard, err := newAddressGuard(opts.DenyPrivate, opts.DeniedNetworks)
+	if err != nil {
+		return nil, err
+	}
+
+	globalProxy := http.ProxyFromEnvironment
+	if opts.ProxyURL != "" {
+		proxyURL, err := ParseProxyURL(opts.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		globalProxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		proxyURL, perFeed := req.Context().Value(proxyContextKey{}).(*url.URL)
+		if !perFeed {
+			var err error
+			if proxyURL, err = globalProxy(req); err != nil {
+				return nil, err
+			}
+		}
+		if proxyURL != nil && guard.enabled() {
+			if err := guard.checkHost(req.Context(), req.URL); err != nil {
+				return nil, err
+			}
+		}
+		return proxyURL, nil
+	}
+	var roundTripper http.RoundTripper = transport
+	if guard.enabled() {
+		transport.DialContext = guard.dialContext(transport.DialContext)
+		roundTripper = &globalProxyTransport{next: transport, proxy: globalProxy}
+	}
+
+	maxRedirects := opts.MaxRedirects
+	if maxRedirects <= 0 {
+		maxRedirects = DefaultMaxRedirects
+	}
+
+	return &http.Client{
+		Transport:     &schemeTransport{next: roundTripper},
+		CheckRedirect: limitRedirects(maxRedirects),
+	}, nil
+}
+
+// ParseProxyURL parses and validates a proxy URL
+func ParseProxyURL(raw string) (*url.URL, error) {
+	proxyURL, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, expected http, https or socks5", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, errors.New("proxy URL has no host")
+	}
+	return proxyURL, nil
+}
+
+// globalProxyTransport marks requests sent through the global proxy, so
+// the address guard lets their connection to the proxy through. Only the
+// proxy the operator configured may be on a denied network; per-feed
+// proxies are set from the web form and are checked like any other
+// address, as is a feed that points at the global proxy itself.
+type globalProxyTransport struct {
+	next  http.RoundTripper
+	proxy func(*http.Request) (*url.URL, error)
+}
+
+func (t *globalProxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, perFeed := req.Context().Value(proxyContextKey{}).(*url.URL); !perFeed {
+		if proxyURL, err := t.proxy(req); err == nil && proxyURL != nil {
+			req = req.WithContext(context.WithValue(req.Context(), globalProxyContextKey{}, proxyAddress(proxyURL)))
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// withProxy returns a context routing requests through proxy instead of the
+// global proxy. An empty proxy leaves ctx unchanged.
+func withProxy(ctx context.Context, proxy string) (context.Context, error) {
+	if proxy == "" {
+		return ctx, nil
+	}
+	proxyURL, err := ParseProxyURL(proxy)
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, proxyContextKey{}, proxyURL), nil
+}
+
+// httpClient returns the client to use for feed requests
+func (m *Manager) httpClient() *http.Client {
+	if m.Client != nil {
+		return m.Client
+	}
+	return defaultClient
+}
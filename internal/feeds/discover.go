@@ -0,0 +1,130 @@
+package feeds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/mmcdole/gofeed"
+
+	"deel/internal/models"
+)
+
+// feedLinkTypes are the <link rel="alternate"> types that point at a feed
+var feedLinkTypes = map[string]bool{
+	"application/rss+xml":   true,
+	"application/atom+xml":  true,
+	"application/feed+json": true,
+}
+
+// commonFeedPaths are probed, in order, when a page advertises no feeds
+var commonFeedPaths = []string{
+	"/feed",
+	"/rss",
+	"/feed.xml",
+	"/rss.xml",
+	"/atom.xml",
+	"/index.xml",
+	"/feed.json",
+}
+
+// MultipleFeedsError is returned by AddFeed when a page advertises more
+// than one feed and the user has to pick one
+type MultipleFeedsError struct {
+	PageURL    string
+	Candidates []models.FeedCandidate
+}
+
+func (e *MultipleFeedsError) Error() string {
+	return fmt.Sprintf("found %d feeds at %s", len(e.Candidates), e.PageURL)
+}
+
+// discoverFeeds looks for feeds advertised by an HTML page through
+// <link rel="alternate"> tags, falling back to probing common feed paths
+// with the request settings the page was fetched with
+func (m *Manager) discoverFeeds(ctx context.Context, pageURL string, body []byte, settings models.RequestSettings) ([]models.FeedCandidate, error) {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	// A <base href> changes how relative links resolve
+	if href, ok := doc.Find("base[href]").First().Attr("href"); ok {
+		if baseHref, err := base.Parse(strings.TrimSpace(href)); err == nil {
+			base = baseHref
+		}
+	}
+
+	var candidates []models.FeedCandidate
+	seen := make(map[string]bool)
+	doc.Find("link[rel][href]").Each(func(_ int, s *goquery.Selection) {
+		rel, _ := s.Attr("rel")
+		if !hasToken(rel, "alternate") {
+			return
+		}
+		linkType, _ := s.Attr("type")
+		linkType = strings.ToLower(strings.TrimSpace(linkType))
+		if !feedLinkTypes[linkType] {
+			return
+		}
+
+		href, _ := s.Attr("href")
+		resolved, err := base.Parse(strings.TrimSpace(href))
+		if err != nil || seen[resolved.String()] {
+			return
+		}
+		seen[resolved.String()] = true
+
+		title, _ := s.Attr("title")
+		candidates = append(candidates, models.FeedCandidate{
+			URL:   resolved.String(),
+			Title: strings.TrimSpace(title),
+			Type:  linkType,
+		})
+	})
+	if len(candidates) > 0 {
+		return candidates, nil
+	}
+
+	return m.probeFeedPaths(ctx, base, settingsFor(pageURL, base.String(), settings)), nil
+}
+
+// probeFeedPaths tries the common feed locations on the page's host and
+// returns the first one that serves a recognizable feed
+func (m *Manager) probeFeedPaths(ctx context.Context, base *url.URL, settings models.RequestSettings) []models.FeedCandidate {
+	for _, path := range commonFeedPaths {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		probe := &url.URL{Scheme: base.Scheme, Host: base.Host, Path: path}
+		resp, err := m.fetch(ctx, models.Feed{URL: probe.String(), Request: settings}, false)
+		if err != nil {
+			continue
+		}
+		if gofeed.DetectFeedType(bytes.NewReader(resp.Body)) == gofeed.FeedTypeUnknown {
+			continue
+		}
+
+		return []models.FeedCandidate{{URL: probe.String()}}
+	}
+	return nil
+}
+
+// hasToken reports whether a space separated attribute contains token
+func hasToken(attr, token string) bool {
+	for _, field := range strings.Fields(attr) {
+		if strings.EqualFold(field, token) {
+			return true
+		}
+	}
+	return false
+}
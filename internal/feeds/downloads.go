@@ -0,0 +1,444 @@
+package feeds
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"deel/internal/models"
+)
+
+// MediaURLPrefix is the path downloaded episodes are served under
+const MediaURLPrefix = "/media/"
+
+// partialSuffix marks an episode that is still being downloaded
+const partialSuffix = ".part"
+
+const (
+	// DefaultMaxEpisodeSize bounds the size of a downloaded episode
+	DefaultMaxEpisodeSize = 2 << 30
+
+	// DefaultDownloadTimeout bounds how long a single episode download may
+	// take; an unfinished download is resumed on the next sync
+	DefaultDownloadTimeout = 30 * time.Minute
+)
+
+// Downloader saves podcast episodes to a local directory so they can be
+// played offline. Interrupted downloads are resumed on the next sync.
+type Downloader struct {
+	Dir     string        // directory the episodes are saved to, one subdirectory per feed
+	Client  *http.Client  // client used for downloads, see NewClient; one with default options if nil
+	MaxSize int64         // largest episode downloaded, DefaultMaxEpisodeSize if zero
+	Timeout time.Duration // deadline for downloading a single episode, DefaultDownloadTimeout if zero
+
+	mu sync.Mutex // serializes syncs so a file is never written twice at once
+
+	runningMu  sync.Mutex
+	running    string             // feed URL of the running sync, guarded by runningMu
+	cancelSync context.CancelFunc // cancels the running sync, guarded by runningMu
+}
+
+// NewDownloader creates a downloader saving episodes to dir, creating the
+// directory if needed
+func NewDownloader(dir string) (*Downloader, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Downloader{Dir: dir}, nil
+}
+
+// Sync makes sure the episodes of the newest keep items of a feed are
+// downloaded and removes every other episode of the feed. items must be
+// sorted newest first. A keep of zero removes all episodes of the feed.
+func (d *Downloader) Sync(ctx context.Context, feedURL string, keep int, items []models.FeedItem) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	d.setRunning(feedURL, cancel)
+	defer d.setRunning("", nil)
+
+	wanted := make(map[string]bool)
+	for _, item := range items {
+		if len(wanted) >= keep {
+			break
+		}
+		enclosure, ok := episodeEnclosure(item)
+		if !ok {
+			continue
+		}
+		name := episodeName(feedURL, item, enclosure)
+		wanted[path.Base(name)] = true
+
+		dest := d.path(name)
+		if _, err := os.Stat(dest); err == nil {
+			continue
+		}
+		if err := d.download(ctx, enclosure.URL, dest); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Error downloading episode %s: %v", enclosure.URL, err)
+		}
+	}
+
+	// Drop episodes that are no longer among the newest, including their
+	// partial downloads
+	dir := filepath.Join(d.Dir, feedKey(feedURL))
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if wanted[strings.TrimSuffix(entry.Name(), partialSuffix)] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			log.Printf("Error removing episode %s: %v", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Remove deletes every downloaded episode of a feed. It cancels a running
+// sync of the feed rather than wait for it, so removing a feed never blocks
+// on a download. The cancelled sync may still have written to the feed's
+// directory by the time it returns; syncDownloads removes it again then.
+func (d *Downloader) Remove(feedURL string) error {
+	d.runningMu.Lock()
+	if d.running == feedURL && d.cancelSync != nil {
+		d.cancelSync()
+	}
+	d.runningMu.Unlock()
+	return os.RemoveAll(filepath.Join(d.Dir, feedKey(feedURL)))
+}
+
+// setRunning records the feed of the running sync and how to cancel it
+func (d *Downloader) setRunning(feedURL string, cancel context.CancelFunc) {
+	d.runningMu.Lock()
+	defer d.runningMu.Unlock()
+	d.running, d.cancelSync = feedURL, cancel
+}
+
+// Annotate sets the LocalURL of every enclosure that has been downloaded
+func (d *Downloader) Annotate(items []models.FeedItem) {
+	for i := range items {
+		item := &items[i]
+		for j := range item.Enclosures {
+			enclosure := &item.Enclosures[j]
+			if !enclosure.IsMedia() {
+				continue
+			}
+			name := episodeName(item.FeedURLOrigin, *item, *enclosure)
+			if _, err := os.Stat(d.path(name)); err == nil {
+				enclosure.LocalURL = MediaURLPrefix + name
+			}
+		}
+	}
+}
+
+// Open opens a completely downloaded episode by its path relative to Dir
+func (d *Downloader) Open(name string) (*os.File, os.FileInfo, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" || strings.HasSuffix(name, partialSuffix) {
+		return nil, nil, os.ErrNotExist
+	}
+
+	f, err := os.Open(d.path(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, nil, os.ErrNotExist
+	}
+	return f, info, nil
+}
+
+// download fetches url into dest. The body is written to a partial file
+// first, and an existing partial file is resumed with a Range request.
+// Episodes larger than MaxSize are refused and their partial file removed.
+func (d *Downloader) download(ctx context.Context, rawURL, dest string) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout())
+	defer cancel()
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	partial := dest + partialSuffix
+
+	var offset int64
+	if info, err := os.Stat(partial); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	client := d.Client
+	if client == nil {
+		client = defaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0 &&
+		contentRangeStart(resp.Header.Get("Content-Range")) == offset:
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusOK:
+		// The server ignored the range, start over
+		flags |= os.O_TRUNC
+	default:
+		// A partial file the server cannot resume is useless
+		os.Remove(partial)
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	if flags&os.O_TRUNC != 0 {
+		offset = 0
+	}
+
+	maxSize := d.maxSize()
+	if resp.ContentLength > maxSize-offset {
+		os.Remove(partial)
+		return fmt.Errorf("episode exceeds the maximum size of %d bytes", maxSize)
+	}
+
+	f, err := os.OpenFile(partial, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	// Read one byte past the limit to tell a body that is too large from one
+	// that is exactly as large as allowed
+	n, err := io.Copy(f, io.LimitReader(resp.Body, maxSize-offset+1))
+	if err != nil {
+		f.Close() // keep what was written so the next sync can resume
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if offset+n > maxSize {
+		os.Remove(partial)
+		return fmt.Errorf("episode exceeds the maximum size of %d bytes", maxSize)
+	}
+	return os.Rename(partial, dest)
+}
+
+// maxSize returns the configured episode size limit or the default
+func (d *Downloader) maxSize() int64 {
+	if d.MaxSize <= 0 {
+		return DefaultMaxEpisodeSize
+	}
+	return d.MaxSize
+}
+
+// timeout returns the configured per-download timeout or the default
+func (d *Downloader) timeout() time.Duration {
+	if d.Timeout <= 0 {
+		return DefaultDownloadTimeout
+	}
+	return d.Timeout
+}
+
+// path returns the file system path of an episode name
+func (d *Downloader) path(name string) string {
+	return filepath.Join(d.Dir, filepath.FromSlash(name))
+}
+
+// episodeEnclosure returns the enclosure downloaded for an item: its first
+// audio or video file
+func episodeEnclosure(item models.FeedItem) (models.Enclosure, bool) {
+	for _, enclosure := range item.Enclosures {
+		if enclosure.IsMedia() {
+			return enclosure, true
+		}
+	}
+	return models.Enclosure{}, false
+}
+
+// episodeName returns the path of an episode relative to the download
+// directory. Episodes are named after their item ID.
+func episodeName(feedURL string, item models.FeedItem, enclosure models.Enclosure) string {
+	return feedKey(feedURL) + "/" + item.ID + mediaExtension(enclosure)
+}
+
+// mediaExtension returns the file extension of an enclosure, taken from its
+// URL or else from its MIME type
+func mediaExtension(enclosure models.Enclosure) string {
+	if u, err := url.Parse(enclosure.URL); err == nil {
+		if ext := strings.ToLower(path.Ext(u.Path)); safeExtension(ext) {
+			return ext
+		}
+	}
+	if exts, err := mime.ExtensionsByType(enclosure.Type); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// safeExtension reports whether ext is a short alphanumeric file extension
+func safeExtension(ext string) bool {
+	if len(ext) < 2 || len(ext) > 6 {
+		return false
+	}
+	for _, r := range ext[1:] {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// contentRangeStart returns the first byte of a Content-Range header such
+// as "bytes 100-199/200", or -1 if it cannot be parsed
+func contentRangeStart(header string) int64 {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(header), "bytes ")
+	if !ok {
+		return -1
+	}
+	start, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// RunDownloads keeps the downloaded episodes of every feed in line with its
+// KeepEpisodes setting until ctx is cancelled. It syncs once at startup and
+// again whenever feeds are refreshed or their settings change. It returns
+// immediately if downloads are disabled.
+func (m *Manager) RunDownloads(ctx context.Context) {
+	if m.Downloads == nil {
+		return
+	}
+	for {
+		m.syncDownloads(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.downloadsDue:
+		}
+	}
+}
+
+// SetKeepEpisodes sets how many of the newest episodes of a feed are kept
+// downloaded. Zero disables downloads for the feed and removes its episodes.
+func (m *Manager) SetKeepEpisodes(feedURL string, keep int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.Feeds {
+		feed := &m.Feeds[i]
+		if feed.URL != feedURL {
+			continue
+		}
+		feed.KeepEpisodes = keep
+		if err := m.DB.SaveFeed(*feed); err != nil {
+			return err
+		}
+		m.scheduleDownloads()
+		return nil
+	}
+	return nil
+}
+
+// scheduleDownloads asks RunDownloads to sync without waiting for it
+func (m *Manager) scheduleDownloads() {
+	select {
+	case m.downloadsDue <- struct{}{}:
+	default: // a sync is already pending
+	}
+}
+
+// syncDownloads syncs the episodes of every feed. A feed removed or moved
+// while its episodes sync has its directory removed again once the sync has
+// stopped writing to it.
+func (m *Manager) syncDownloads(ctx context.Context) {
+	for _, feed := range m.GetFeeds() {
+		var items []models.FeedItem
+		if feed.KeepEpisodes > 0 {
+			var err error
+			if items, err = m.DB.LoadFeedItems(feed.URL); err != nil {
+				log.Printf("Error loading items for feed %s: %v", feed.URL, err)
+				continue
+			}
+		}
+		// Episodes are fetched through the feed's proxy, but without its
+		// credentials, which are meant for the feed's host only
+		feedCtx, err := withProxy(ctx, feed.Request.Proxy)
+		if err != nil {
+			log.Printf("Error syncing episodes for feed %s: %v", feed.URL, err)
+			continue
+		}
+		err = m.Downloads.Sync(feedCtx, feed.URL, feed.KeepEpisodes, items)
+		if ctx.Err() != nil {
+			return
+		}
+		if m.dropUnsubscribedDownloads(feed.URL) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error syncing episodes for feed %s: %v", feed.URL, err)
+		}
+	}
+}
+
+// dropUnsubscribedDownloads removes the episodes of a feed that is no
+// longer subscribed and reports whether it did. Holding m.mu orders this
+// with removeFeed: either the feed is gone here, or removeFeed runs after
+// the sync that checked it has finished.
+func (m *Manager) dropUnsubscribedDownloads(feedURL string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.subscribed(feedURL) {
+		return false
+	}
+	m.removeDownloads(feedURL)
+	return true
+}
+
+// removeDownloads deletes the downloaded episodes of a feed
+func (m *Manager) removeDownloads(feedURL string) {
+	if m.Downloads == nil {
+		return
+	}
+	if err := m.Downloads.Remove(feedURL); err != nil {
+		log.Printf("Error removing episodes of feed %s: %v", feedURL, err)
+	}
+}
@@ -0,0 +1,134 @@
+package feeds
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"deel/internal/models"
+)
+
+// TestDownloadLimits checks that oversized episodes are refused whether or
+// not their size is announced, and that a stalled download is cut off
+func TestDownloadLimits(t *testing.T) {
+	stall := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small.mp3":
+			w.Write([]byte(strings.Repeat("a", 10)))
+		case "/large.mp3":
+			w.Write([]byte(strings.Repeat("a", 11)))
+		case "/unannounced.mp3":
+			// Flushing first sends the body chunked, without a Content-Length
+			w.Write([]byte(strings.Repeat("a", 5)))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(strings.Repeat("a", 6)))
+		case "/stalled.mp3":
+			w.Write([]byte(strings.Repeat("a", 5)))
+			w.(http.Flusher).Flush()
+			select {
+			case <-stall:
+			case <-r.Context().Done():
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	defer close(stall)
+
+	d, err := NewDownloader(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.MaxSize = 10
+	d.Timeout = 200 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		wantErr bool
+		partial bool // whether a partial file is kept for resuming
+	}{
+		{"small.mp3", false, false},
+		{"large.mp3", true, false},
+		{"unannounced.mp3", true, false},
+		{"stalled.mp3", true, true},
+	}
+	for _, tt := range tests {
+		dest := filepath.Join(d.Dir, tt.name)
+		err := d.download(context.Background(), srv.URL+"/"+tt.name, dest)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("download %s: error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if _, err := os.Stat(dest); (err == nil) == tt.wantErr {
+			t.Errorf("download %s: episode saved %v, want %v", tt.name, err == nil, !tt.wantErr)
+		}
+		if _, err := os.Stat(dest + partialSuffix); (err == nil) != tt.partial {
+			t.Errorf("download %s: partial file kept %v, want %v", tt.name, err == nil, tt.partial)
+		}
+	}
+}
+
+// TestRemoveDuringSync checks that removing a feed while one of its
+// episodes downloads leaves nothing of the feed in the media directory, not
+// even the episodes the sync would have downloaded next
+func TestRemoveDuringSync(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 5)))
+		if r.URL.Path == "/new.mp3" {
+			w.(http.Flusher).Flush()
+			close(started)
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+		w.Write([]byte(strings.Repeat("a", 5)))
+	}))
+	defer srv.Close()
+
+	m := policyManager(t, ClientOptions{})
+	var err error
+	if m.Downloads, err = NewDownloader(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	feed := models.Feed{URL: "http://feeds.example/podcast", KeepEpisodes: 2}
+	var items []models.FeedItem
+	for i, name := range []string{"old", "new"} {
+		items = append(items, models.FeedItem{
+			ID:            name,
+			PublishedTime: time.Date(2024, 1, i+1, 0, 0, 0, 0, time.UTC),
+			Enclosures:    []models.Enclosure{{URL: srv.URL + "/" + name + ".mp3", Type: "audio/mpeg"}},
+		})
+	}
+	if err := m.DB.SaveFeed(feed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.DB.SaveFeedItems(feed.URL, items); err != nil {
+		t.Fatal(err)
+	}
+	m.Feeds = append(m.Feeds, feed)
+
+	synced := make(chan struct{})
+	go func() {
+		m.syncDownloads(context.Background())
+		close(synced)
+	}()
+	<-started
+	if err := m.RemoveFeed(feed.URL); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	<-synced
+
+	if _, err := os.Stat(filepath.Join(m.Downloads.Dir, feedKey(feed.URL))); !os.IsNotExist(err) {
+		t.Errorf("episode directory of the removed feed exists (%v)", err)
+	}
+}
@@ -0,0 +1,286 @@
+package feeds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+
+	"deel/internal/models"
+)
+
+const (
+	// maxExtractionsPerFeed bounds how many of the newest items of a feed
+	// are extracted per pass, so subscribing to a long feed stays cheap
+	maxExtractionsPerFeed = 20
+
+	// minParagraphLength is the shortest text that counts as a paragraph
+	minParagraphLength = 25
+
+	// minArticleLength is the shortest extracted text accepted as an article
+	minArticleLength = 140
+)
+
+var (
+	// positiveClass and negativeClass match class and id attributes that
+	// hint at the main content or at page furniture
+	positiveClass = regexp.MustCompile(`(?i)article|body|content|entry|main|page|post|text|blog|story`)
+	negativeClass = regexp.MustCompile(`(?i)comment|meta|footer|footnote|sidebar|share|social|related|nav|menu|promo|banner|sponsor|widget|advert|cookie|popup|subscribe`)
+
+	// clutterSelector matches elements that never hold the article text
+	clutterSelector = "script, style, noscript, iframe, form, nav, header, footer, aside, button, input, select, textarea, svg"
+)
+
+// RunExtractions extracts the articles of new items of feeds with
+// FetchFullContent set until ctx is cancelled. It runs once at startup and
+// then whenever a refresh stores new items.
+func (m *Manager) RunExtractions(ctx context.Context) {
+	for {
+		m.extractDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.extractionsDue:
+		}
+	}
+}
+
+// SetFetchFullContent sets whether the articles of a feed's items are
+// downloaded and extracted
+func (m *Manager) SetFetchFullContent(feedURL string, fetch bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.Feeds {
+		feed := &m.Feeds[i]
+		if feed.URL != feedURL {
+			continue
+		}
+		feed.FetchFullContent = fetch
+		if err := m.DB.SaveFeed(*feed); err != nil {
+			return err
+		}
+		m.scheduleExtractions()
+		return nil
+	}
+	return nil
+}
+
+// ExtractItem extracts the article of a single item right away, replacing
+// any cached result, whether or not its feed fetches full content
+func (m *Manager) ExtractItem(ctx context.Context, feedURL, itemID string) error {
+	var feed models.Feed
+	found := false
+	for _, f := range m.GetFeeds() {
+		if f.URL == feedURL {
+			feed, found = f, true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("feed %s is not subscribed", feedURL)
+	}
+
+	items, err := m.DB.LoadFeedItems(feedURL)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if item.ID == itemID {
+			return m.extractItem(ctx, feed, item)
+		}
+	}
+	return fmt.Errorf("item %s not found in feed %s", itemID, feedURL)
+}
+
+// scheduleExtractions asks RunExtractions to run without waiting for it
+func (m *Manager) scheduleExtractions() {
+	select {
+	case m.extractionsDue <- struct{}{}:
+	default: // a run is already pending
+	}
+}
+
+// extractDue extracts the newest items of every feed with FetchFullContent
+// set that have no cached extraction yet. Failures are cached as well and
+// only retried on demand.
+func (m *Manager) extractDue(ctx context.Context) {
+	for _, feed := range m.GetFeeds() {
+		if !feed.FetchFullContent {
+			continue
+		}
+		items, err := m.DB.LoadFeedItems(feed.URL)
+		if err != nil {
+			log.Printf("Error loading items for feed %s: %v", feed.URL, err)
+			continue
+		}
+		if len(items) > maxExtractionsPerFeed {
+			items = items[:maxExtractionsPerFeed]
+		}
+		for _, item := range items {
+			if item.FullContent != "" || item.ExtractionError != "" || item.Link == "" {
+				continue
+			}
+			if err := m.extractItem(ctx, feed, item); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("Error extracting article %s: %v", item.Link, err)
+			}
+		}
+	}
+}
+
+// extractItem downloads the article of an item and caches its main text, or
+// the reason extraction failed. It only returns an error if the result
+// could not be cached or ctx was cancelled.
+func (m *Manager) extractItem(ctx context.Context, feed models.Feed, item models.FeedItem) error {
+	fetchCtx, cancel := context.WithTimeout(ctx, m.feedTimeout())
+	defer cancel()
+
+	content, err := m.fetchArticle(fetchCtx, feed, item.Link)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	extraction := models.Extraction{Content: content, Extracted: time.Now()}
+	if err != nil {
+		extraction.Error = err.Error()
+	}
+	return m.DB.SaveExtraction(item.ID, extraction)
+}
+
+// fetchArticle downloads an article and extracts its main text. The feed's
+// request settings are only sent to the feed's own host; elsewhere just its
+// proxy and user agent are used.
+func (m *Manager) fetchArticle(ctx context.Context, feed models.Feed, link string) (string, error) {
+	resp, err := m.fetch(ctx, models.Feed{URL: link, Request: settingsFor(feed.URL, link, feed.Request)}, false)
+	if err != nil {
+		return "", err
+	}
+	return extractArticle(resp.Body, link)
+}
+
+// extractArticle finds the main text of a web page in the manner of
+// Readability: paragraphs award points to their parent and grandparent,
+// weighted by class names and link density, and the best scoring element
+// is taken as the article. Relative links and images are made absolute.
+func extractArticle(body []byte, pageURL string) (string, error) {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return "", err
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	if href, ok := doc.Find("base[href]").First().Attr("href"); ok {
+		if baseHref, err := base.Parse(strings.TrimSpace(href)); err == nil {
+			base = baseHref
+		}
+	}
+	doc.Find(clutterSelector).Remove()
+
+	scores := make(map[*html.Node]float64)
+	var candidates []*goquery.Selection
+	doc.Find("p, pre, td, blockquote").Each(func(_ int, paragraph *goquery.Selection) {
+		text := collapseSpace(paragraph.Text())
+		if len(text) < minParagraphLength {
+			return
+		}
+		points := 1 + float64(strings.Count(text, ",")) + math.Min(float64(len(text))/100, 3)
+
+		parent := paragraph.Parent()
+		for depth, ancestor := range []*goquery.Selection{parent, parent.Parent()} {
+			if ancestor.Length() == 0 {
+				break
+			}
+			node := ancestor.Get(0)
+			if _, ok := scores[node]; !ok {
+				scores[node] = classWeight(ancestor)
+				candidates = append(candidates, ancestor)
+			}
+			scores[node] += points / float64(depth+1)
+		}
+	})
+
+	var best *goquery.Selection
+	bestScore := 0.0
+	for _, candidate := range candidates {
+		score := scores[candidate.Get(0)] * (1 - linkDensity(candidate))
+		if best == nil || score > bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+	if best == nil {
+		// No paragraphs, fall back to the semantic containers
+		best = doc.Find("article, main, [role=main]").First()
+	}
+	if best.Length() == 0 || len(collapseSpace(best.Text())) < minArticleLength {
+		return "", errors.New("no article text found on the page")
+	}
+
+	absolutize(best, base)
+	content, err := best.Html()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(content), nil
+}
+
+// classWeight scores an element by its class and id attributes
+func classWeight(s *goquery.Selection) float64 {
+	weight := 0.0
+	for _, attr := range []string{"class", "id"} {
+		value, ok := s.Attr(attr)
+		if !ok || value == "" {
+			continue
+		}
+		if negativeClass.MatchString(value) {
+			weight -= 25
+		}
+		if positiveClass.MatchString(value) {
+			weight += 25
+		}
+	}
+	switch goquery.NodeName(s) {
+	case "article", "main":
+		weight += 10
+	case "div":
+		weight += 5
+	}
+	return weight
+}
+
+// linkDensity returns the share of an element's text that is link text
+func linkDensity(s *goquery.Selection) float64 {
+	total := len(collapseSpace(s.Text()))
+	if total == 0 {
+		return 0
+	}
+	links := 0
+	s.Find("a").Each(func(_ int, a *goquery.Selection) {
+		links += len(collapseSpace(a.Text()))
+	})
+	return float64(links) / float64(total)
+}
+
+// absolutize resolves the link and image URLs inside s against base
+func absolutize(s *goquery.Selection, base *url.URL) {
+	for selector, attr := range map[string]string{"a[href]": "href", "img[src]": "src"} {
+		s.Find(selector).Each(func(_ int, el *goquery.Selection) {
+			value, _ := el.Attr(attr)
+			if resolved, err := base.Parse(strings.TrimSpace(value)); err == nil {
+				el.SetAttr(attr, resolved.String())
+			}
+		})
+	}
+}
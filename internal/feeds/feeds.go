@@ -2,8 +2,16 @@
 package feeds
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
-	"sort"
+	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/mmcdole/gofeed"
@@ -13,96 +21,335 @@ import (
 	"deel/internal/utils"
 )
 
-// Manager handles feed operations
+// Manager handles feed operations.
+// It is safe for concurrent use; Feeds is guarded by mu. Feed items live in
+// the database and are queried from there.
 type Manager struct {
-	DB        *database.DB // Changed db.DB to database.DB
-	Feeds     []models.Feed
-	FeedItems []models.FeedItem
+	DB    database.Store
+	Feeds []models.Feed
+
+	Client      *http.Client  // Client used for feed requests, see NewClient; one with default options if nil
+	Workers     int           // Number of feeds fetched in parallel, DefaultWorkers if zero
+	FeedTimeout time.Duration // Deadline for fetching a single feed, DefaultFeedTimeout if zero
+	MaxBodySize int64         // Largest feed document accepted, DefaultMaxBodySize if zero
+	PageItems   int           // Newest items returned by GetFilteredItems, DefaultPageItems if zero
+
+	RefreshInterval time.Duration // Global polling interval, DefaultRefreshInterval if zero
+
+	Downloads *Downloader // Saves podcast episodes of feeds with KeepEpisodes set, downloads are disabled if nil
+
+	Retention models.RetentionPolicy // Global retention policy, applied to feeds without their own
+
+	// WebSubCallbackURL is the public URL of WebSubPathPrefix on this server,
+	// such as https://reader.example.com/websub/. Hubs must be able to reach
+	// it; WebSub is disabled if empty.
+	WebSubCallbackURL string
+
+	mu             sync.RWMutex
+	refreshMu      sync.Mutex        // Serializes refreshes so results are merged one at a time
+	downloadsDue   chan struct{}     // Wakes RunDownloads, holds at most one pending request
+	extractionsDue chan struct{}     // Wakes RunExtractions, holds at most one pending request
+	unsubscribing  map[string]string // Topics of removed feeds awaiting hub verification, by callback key
 }
 
 // NewManager creates a new feed manager
-func NewManager(db *database.DB) (*Manager, error) { // Changed db *db.DB to db *database.DB
+func NewManager(db database.Store) (*Manager, error) {
 	feeds, err := db.LoadFeeds()
 	if err != nil {
 		return nil, err
 	}
 
 	manager := &Manager{
-		DB:    db,
-		Feeds: feeds,
+		DB:              db,
+		Feeds:           feeds,
+		Workers:         DefaultWorkers,
+		FeedTimeout:     DefaultFeedTimeout,
+		PageItems:       DefaultPageItems,
+		RefreshInterval: DefaultRefreshInterval,
+		downloadsDue:    make(chan struct{}, 1),
+		extractionsDue:  make(chan struct{}, 1),
+		unsubscribing:   make(map[string]string),
 	}
 
-	// Initialize feed items
-	manager.RefreshFeeds()
+	// Stored items are served right away; the scheduler fetches whatever is due
+	manager.updateUnreadCounts()
 
 	return manager, nil
 }
 
-// RefreshFeeds updates the feed items from all feeds
-func (m *Manager) RefreshFeeds() {
-	m.FeedItems = []models.FeedItem{}
+// RefreshFeeds updates the feed items from all feeds that are still alive.
+// Feeds are fetched in parallel without holding the manager lock, and the
+// results are merged into the item store in a single step once all fetches
+// finish. Items that disappear from a feed are kept.
+func (m *Manager) RefreshFeeds(ctx context.Context) {
+	m.refresh(ctx, func(feed models.Feed) bool { return !feed.Dead })
+}
+
+// refresh fetches the feeds selected by include and merges the results
+func (m *Manager) refresh(ctx context.Context, include func(models.Feed) bool) {
+	m.refreshMu.Lock()
+	defer m.refreshMu.Unlock()
 
-	fp := gofeed.NewParser()
+	m.mu.RLock()
+	var feedsToFetch []models.Feed
 	for _, feed := range m.Feeds {
-		parsedFeed, err := fp.ParseURL(feed.URL)
-		if err != nil {
-			log.Printf("Error refreshing feed %s: %v", feed.URL, err)
+		if include(feed) {
+			feedsToFetch = append(feedsToFetch, feed)
+		}
+	}
+	m.mu.RUnlock()
+
+	// Only feeds whose items are already stored can be skipped when unchanged
+	conditional := make(map[string]bool)
+	counts, err := m.DB.CountFeedItems()
+	if err != nil {
+		log.Printf("Error counting stored feed items: %v", err)
+	}
+	for feedURL, count := range counts {
+		conditional[feedURL] = count > 0
+	}
+
+	if len(feedsToFetch) == 0 {
+		return
+	}
+	results := m.fetchAll(ctx, feedsToFetch, conditional)
+
+	m.mu.Lock()
+	m.mergeResults(results)
+	m.mu.Unlock()
+
+	m.scheduleDownloads()
+	m.scheduleExtractions()
+}
+
+// mergeResults stores the items of every successfully fetched feed along
+// with the new cache validators and schedule. Results are applied in feed
+// order, so the outcome does not depend on the order in which fetches
+// completed. The caller must hold m.mu.
+func (m *Manager) mergeResults(results []fetchResult) {
+	for _, result := range results {
+		// A cancelled refresh says nothing about the health of the feed
+		if errors.Is(result.Err, context.Canceled) {
+			continue
+		}
+		m.updateFeedState(result)
+		if result.Err != nil {
+			log.Printf("Error refreshing feed %s: %v", result.FeedURL, result.Err)
+			continue
+		}
+		if result.PermanentURL != "" && m.moveFeed(result.FeedURL, result.PermanentURL) {
+			for i, item := range result.Items {
+				result.Items[i].FeedURLOrigin = result.PermanentURL
+				result.Items[i].ID = utils.ItemID(result.PermanentURL, item.GUID, item.Link, item.Title)
+			}
+			result.FeedURL = result.PermanentURL
+		}
+		if result.NotModified || !m.subscribed(result.FeedURL) {
+			continue
+		}
+		if err := m.saveItems(result.FeedURL, result.Items); err != nil {
+			log.Printf("Error saving items for feed %s: %v", result.FeedURL, err)
+		}
+	}
+
+	m.updateUnreadCounts()
+}
+
+// subscribed reports whether a feed URL is in the feed list.
+// The caller must hold m.mu.
+func (m *Manager) subscribed(feedURL string) bool {
+	for _, feed := range m.Feeds {
+		if feed.URL == feedURL {
+			return true
+		}
+	}
+	return false
+}
+
+// saveItems stores fetched items of a feed. Read items the publisher edited
+// are marked unread again if the feed asks for it. The caller must hold m.mu.
+func (m *Manager) saveItems(feedURL string, items []models.FeedItem) error {
+	result, err := m.DB.SaveFeedItems(feedURL, items)
+	if err != nil || len(result.Revised) == 0 {
+		return err
+	}
+
+	log.Printf("%d read items of feed %s were updated", len(result.Revised), feedURL)
+	for _, feed := range m.Feeds {
+		if feed.URL != feedURL || !feed.MarkUpdatedUnread {
 			continue
 		}
+		return m.DB.SetFeedItemReadStatuses(result.Revised, false)
+	}
+	return nil
+}
 
-		for _, item := range parsedFeed.Items {
-			var pubTime time.Time
-			var formatted string
-
-			if item.PublishedParsed != nil {
-				pubTime = *item.PublishedParsed
-				formatted = pubTime.Format("Jan 2, 2006 15:04")
-			} else if item.UpdatedParsed != nil {
-				pubTime = *item.UpdatedParsed
-				formatted = pubTime.Format("Jan 2, 2006 15:04")
-			} else if item.Published != "" {
-				parsed, pErr := utils.ParseDate(item.Published)
-				if pErr == nil {
-					pubTime = parsed
-					formatted = pubTime.Format("Jan 2, 2006 15:04")
-				} else {
-					formatted = item.Published
-				}
-			} else if item.Updated != "" {
-				parsed, pErr := utils.ParseDate(item.Updated)
-				if pErr == nil {
-					pubTime = parsed
-					formatted = pubTime.Format("Jan 2, 2006 15:04")
-				} else {
-					formatted = item.Updated
-				}
+// SetMarkUpdatedUnread sets whether read items of a feed are marked unread
+// again when the publisher edits them
+func (m *Manager) SetMarkUpdatedUnread(feedURL string, markUnread bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.Feeds {
+		feed := &m.Feeds[i]
+		if feed.URL != feedURL {
+			continue
+		}
+		feed.MarkUpdatedUnread = markUnread
+		return m.DB.SaveFeed(*feed)
+	}
+	return nil
+}
+
+// updateFeedState stores the health, cache validators and publisher hint of
+// a fetch on its feed, schedules the next poll and persists the feed.
+// The caller must hold m.mu.
+func (m *Manager) updateFeedState(result fetchResult) {
+	for i := range m.Feeds {
+		feed := &m.Feeds[i]
+		if feed.URL != result.FeedURL {
+			continue
+		}
+		feed.LastStatus = result.StatusCode
+		if result.Err != nil {
+			feed.ConsecutiveFailures++
+			feed.LastError = result.Err.Error()
+			if result.StatusCode == http.StatusGone {
+				log.Printf("Feed %s is gone, it will no longer be polled", feed.URL)
+				feed.Dead = true
+			}
+		} else {
+			feed.Dead = false
+			feed.ConsecutiveFailures = 0
+			feed.LastError = ""
+			feed.LastSuccess = time.Now()
+			feed.ETag = result.ETag
+			feed.LastModified = result.LastModified
+			feed.ContentHash = result.ContentHash
+			// A 304 carries no feed body, so keep the last known feed-level hint
+			if !result.NotModified || result.Hint > 0 {
+				feed.HintInterval = result.Hint
 			}
+			if !result.NotModified {
+				setHub(feed, result.Hub, result.Topic)
+			}
+		}
+		feed.NextRefresh = m.nextRefresh(*feed, time.Now())
+		if err := m.DB.SaveFeed(*feed); err != nil {
+			log.Printf("Error saving state for feed %s: %v", feed.URL, err)
+		}
+		return
+	}
+}
 
-			m.FeedItems = append(m.FeedItems, models.FeedItem{
-				Title:         item.Title,
-				Link:          item.Link,
-				Description:   item.Description,
-				Published:     formatted,
-				FeedTitle:     parsedFeed.Title,
-				PublishedTime: pubTime,
-				Read:          m.DB.GetFeedItemReadStatus(item.Link),
-				Favorite:      m.DB.GetFeedItemFavoriteStatus(item.Link), // Add this line
-				FeedURLOrigin: feed.URL,
-			})
+// moveFeed rewrites the URL of a feed after a permanent redirect, keeping
+// its metadata and settings; headers and credentials are dropped if it
+// moved to another host. If the new URL is already subscribed, the old
+// feed is dropped in favor of it. It reports whether the feed now lives at
+// newURL. The caller must hold m.mu.
+func (m *Manager) moveFeed(oldURL, newURL string) bool {
+	oldIndex := -1
+	for i, feed := range m.Feeds {
+		if feed.URL == newURL {
+			log.Printf("Feed %s redirects to already subscribed %s, removing it", oldURL, newURL)
+			if err := m.removeFeed(oldURL); err != nil {
+				log.Printf("Error removing redirected feed %s: %v", oldURL, err)
+			}
+			return false
+		}
+		if feed.URL == oldURL {
+			oldIndex = i
 		}
 	}
-	m.SortFeedItemsByDate()
-	m.UpdateUnreadCounts()
+	if oldIndex < 0 {
+		return false
+	}
+
+	moved := m.Feeds[oldIndex]
+	moved.URL = newURL
+	moved.Request = settingsFor(oldURL, newURL, moved.Request)
+	// The WebSub callback is derived from the feed URL, so subscribe again
+	moved.HubLeaseExpiry = time.Time{}
+	moved.HubRequested = time.Time{}
+	if err := m.DB.RenameFeed(oldURL, moved); err != nil {
+		log.Printf("Error moving feed %s to %s: %v", oldURL, newURL, err)
+		return false
+	}
+	log.Printf("Feed %s moved permanently to %s", oldURL, newURL)
+	m.Feeds[oldIndex] = moved
+	m.removeDownloads(oldURL) // item IDs change with the URL, episodes are downloaded again
+	return true
 }
 
-// AddFeed adds a new feed
-func (m *Manager) AddFeed(feedURL string) (*models.Feed, error) {
+// AddFeed adds a new feed, fetched with the given request settings.
+// Credentials embedded in feedURL are moved into the settings. When feedURL
+// points at a web page instead of a feed, the feeds advertised by the page
+// are discovered; if there is more than one, a *MultipleFeedsError listing
+// them is returned.
+func (m *Manager) AddFeed(feedURL string, settings models.RequestSettings) (*models.Feed, error) {
+	feedURL, settings = extractCredentials(feedURL, settings)
+
 	// Parse the feed to get its title
-	fp := gofeed.NewParser()
-	feed, err := fp.ParseURL(feedURL)
+	ctx, cancel := context.WithTimeout(context.Background(), m.feedTimeout())
+	defer cancel()
+	fp := newParser()
+	var resp *fetchResponse
+	var feed *gofeed.Feed
+	var err error
+	if rewritten, ok := RewriteFeedURL(feedURL); ok {
+		// The rewrite is a guess; if it is not a feed, use the URL as given
+		rewrittenSettings := settingsFor(feedURL, rewritten, settings)
+		if resp, err = m.fetch(ctx, models.Feed{URL: rewritten, Request: rewrittenSettings}, false); err == nil {
+			feed, err = fp.Parse(bytes.NewReader(resp.Body))
+		}
+		if err == nil {
+			log.Printf("Using feed %s for %s", rewritten, feedURL)
+			feedURL, settings = rewritten, rewrittenSettings
+		} else {
+			log.Printf("Feed %s guessed for %s does not work, using the page: %v", rewritten, feedURL, err)
+			resp = nil
+		}
+	}
+	if resp == nil {
+		if resp, err = m.fetch(ctx, models.Feed{URL: feedURL, Request: settings}, false); err != nil {
+			return nil, err
+		}
+		feed, err = fp.Parse(bytes.NewReader(resp.Body))
+	}
+	if errors.Is(err, gofeed.ErrFeedTypeNotDetected) {
+		// Not a feed, look for the feeds the page links to
+		candidates, dErr := m.discoverFeeds(ctx, feedURL, resp.Body, settings)
+		if dErr != nil {
+			return nil, dErr
+		}
+		switch len(candidates) {
+		case 0:
+			return nil, fmt.Errorf("no feed found at %s", feedURL)
+		case 1:
+			// The page's settings are not sent to a feed on another host
+			settings = settingsFor(feedURL, candidates[0].URL, settings)
+			feedURL = candidates[0].URL
+		default:
+			return nil, &MultipleFeedsError{PageURL: feedURL, Candidates: candidates}
+		}
+
+		resp, err = m.fetch(ctx, models.Feed{URL: feedURL, Request: settings}, false)
+		if err != nil {
+			return nil, err
+		}
+		feed, err = fp.Parse(bytes.NewReader(resp.Body))
+	}
 	if err != nil {
 		return nil, err
 	}
+	if resp.PermanentURL != "" {
+		// Subscribe to where the feed lives now
+		settings = settingsFor(feedURL, resp.PermanentURL, settings)
+		feedURL = resp.PermanentURL
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	// Check if feed already exists
 	for _, f := range m.Feeds {
@@ -113,9 +360,19 @@ func (m *Manager) AddFeed(feedURL string) (*models.Feed, error) {
 
 	// Add the new feed
 	newFeed := models.Feed{
-		URL:   feedURL,
-		Title: feed.Title,
+		URL:          feedURL,
+		Title:        feed.Title,
+		ETag:         resp.ETag,
+		LastModified: resp.LastModified,
+		ContentHash:  resp.ContentHash,
+		HintInterval: publisherHint(feed, resp.Header),
+		LastSuccess:  time.Now(),
+		LastStatus:   resp.StatusCode,
+		Request:      settings,
 	}
+	hub, self := hubLinks(resp.Body, resp.Header)
+	setHub(&newFeed, hub, self)
+	newFeed.NextRefresh = m.nextRefresh(newFeed, time.Now())
 	m.Feeds = append(m.Feeds, newFeed)
 
 	// Save to database
@@ -125,192 +382,211 @@ func (m *Manager) AddFeed(feedURL string) (*models.Feed, error) {
 	}
 
 	// Add the feed items
-	for _, item := range feed.Items {
-		var pubTime time.Time
-		var formatted string
-
-		if item.PublishedParsed != nil {
-			pubTime = *item.PublishedParsed
-			formatted = pubTime.Format("Jan 2, 2006 15:04")
-		} else if item.UpdatedParsed != nil {
-			pubTime = *item.UpdatedParsed
-			formatted = pubTime.Format("Jan 2, 2006 15:04")
-		} else if item.Published != "" {
-			parsed, pErr := utils.ParseDate(item.Published)
-			if pErr == nil {
-				pubTime = parsed
-				formatted = pubTime.Format("Jan 2, 2006 15:04")
-			} else {
-				formatted = item.Published
-			}
-		} else if item.Updated != "" {
-			parsed, pErr := utils.ParseDate(item.Updated)
-			if pErr == nil {
-				pubTime = parsed
-				formatted = pubTime.Format("Jan 2, 2006 15:04")
-			} else {
-				formatted = item.Updated
-			}
-		}
-
-		m.FeedItems = append(m.FeedItems, models.FeedItem{
-			Title:         item.Title,
-			Link:          item.Link,
-			Description:   item.Description,
-			Published:     formatted,
-			FeedTitle:     feed.Title,
-			PublishedTime: pubTime,
-			Read:          m.DB.GetFeedItemReadStatus(item.Link),
-			Favorite:      m.DB.GetFeedItemFavoriteStatus(item.Link), // Add this line
-			FeedURLOrigin: newFeed.URL,
-		})
-	}
-	m.SortFeedItemsByDate()
-	m.UpdateUnreadCounts()
+	if _, err := m.DB.SaveFeedItems(newFeed.URL, m.admitItems(convertItems(feed, newFeed.URL), m.Retention, time.Now())); err != nil {
+		log.Printf("Error saving items for feed %s: %v", newFeed.URL, err)
+		return nil, err
+	}
+	m.updateUnreadCounts()
 
 	return &newFeed, nil
 }
 
+// SetRequestSettings replaces the HTTP settings a feed is fetched with.
+// An empty password keeps the stored one as long as the username is
+// unchanged, so the password never has to be sent back to the browser.
+// The feed is fetched again on the next scheduler run.
+func (m *Manager) SetRequestSettings(feedURL string, settings models.RequestSettings) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.Feeds {
+		feed := &m.Feeds[i]
+		if feed.URL != feedURL {
+			continue
+		}
+		if settings.Password == "" && settings.Username == feed.Request.Username {
+			settings.Password = feed.Request.Password
+		}
+		if settings.Username == "" {
+			settings.Password = ""
+		}
+		feed.Request = settings
+		feed.NextRefresh = time.Now()
+		return m.DB.SaveFeed(*feed)
+	}
+	return nil
+}
+
 // RemoveFeed removes a feed
 func (m *Manager) RemoveFeed(feedURL string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.removeFeed(feedURL)
+}
+
+// removeFeed removes a feed and its items. The caller must hold m.mu.
+func (m *Manager) removeFeed(feedURL string) error {
 	for i, feed := range m.Feeds {
 		if feed.URL == feedURL {
 			// Remove from slice
 			m.Feeds = append(m.Feeds[:i], m.Feeds[i+1:]...)
-			// Remove from database
+			// Remove from database, along with the feed's stored items
 			if err := m.DB.RemoveFeed(feedURL); err != nil {
 				log.Printf("Error removing feed from database: %v", err)
 				return err
 			}
+			m.removeDownloads(feedURL)
+			if feed.PushSubscribed() {
+				go m.unsubscribe(feed)
+			}
 			break
 		}
 	}
-
-	// Refresh feed items to reflect the change
-	m.RefreshFeeds()
 	return nil
 }
 
-// ToggleReadStatus toggles the read/unread status of a single feed item
-func (m *Manager) ToggleReadStatus(itemLink string) error {
-	currentStatus := m.DB.GetFeedItemReadStatus(itemLink)
+// ToggleReadStatus toggles the read/unread status of a single feed item by its ID
+func (m *Manager) ToggleReadStatus(itemID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	currentStatus := m.DB.GetFeedItemReadStatus(itemID)
 	newStatus := !currentStatus
-	err := m.DB.SetFeedItemReadStatus(itemLink, newStatus)
+	err := m.DB.SetFeedItemReadStatus(itemID, newStatus)
 	if err != nil {
-		log.Printf("Error toggling read status for %s: %v", itemLink, err)
+		log.Printf("Error toggling read status for %s: %v", itemID, err)
 		return err
 	}
 
-	// Update in-memory feedItems for immediate reflection
-	for i, item := range m.FeedItems {
-		if item.Link == itemLink {
-			m.FeedItems[i].Read = newStatus
-			break
-		}
-	}
-	m.UpdateUnreadCounts()
+	m.updateUnreadCounts()
 	return nil
 }
 
-// ToggleFavoriteStatus toggles the favorite status of a single feed item
-func (m *Manager) ToggleFavoriteStatus(itemLink string) error {
-	currentStatus := m.DB.GetFeedItemFavoriteStatus(itemLink)
+// ToggleFavoriteStatus toggles the favorite status of a single feed item by its ID
+func (m *Manager) ToggleFavoriteStatus(itemID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	currentStatus := m.DB.GetFeedItemFavoriteStatus(itemID)
 	newStatus := !currentStatus
-	err := m.DB.SetFeedItemFavoriteStatus(itemLink, newStatus)
+	err := m.DB.SetFeedItemFavoriteStatus(itemID, newStatus)
 	if err != nil {
-		log.Printf("Error toggling favorite status for %s: %v", itemLink, err)
+		log.Printf("Error toggling favorite status for %s: %v", itemID, err)
 		return err
 	}
 
-	// Update in-memory feedItems for immediate reflection
-	for i, item := range m.FeedItems {
-		if item.Link == itemLink {
-			m.FeedItems[i].Favorite = newStatus
-			break
-		}
-	}
 	// Note: Unlike read status, unread counts are not affected by favoriting.
 	return nil
 }
 
 // MarkAllRead marks all currently unread feed items as read
 func (m *Manager) MarkAllRead() error {
-	for i, item := range m.FeedItems {
-		if !item.Read {
-			err := m.DB.SetFeedItemReadStatus(item.Link, true)
-			if err != nil {
-				log.Printf("Error marking item %s as read during mark all: %v", item.Link, err)
-				// Continue trying to mark others
-			}
-			m.FeedItems[i].Read = true // Update in-memory representation
-		}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.DB.MarkAllFeedItemsRead(); err != nil {
+		log.Printf("Error marking all items as read: %v", err)
+		return err
 	}
-	m.UpdateUnreadCounts()
+	m.updateUnreadCounts()
 	return nil
 }
 
-// GetFilteredItems returns filtered feed items based on the provided criteria
+// GetFeeds returns a snapshot of the subscribed feeds
+func (m *Manager) GetFeeds() []models.Feed {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	feeds := make([]models.Feed, len(m.Feeds))
+	copy(feeds, m.Feeds)
+	return feeds
+}
+
+// DefaultPageItems is the number of newest items shown on a page
+const DefaultPageItems = 500
+
+// GetFilteredItems returns the newest feed items matching the filter
+// ("unread", "favorites" or anything else for all items) of a single feed,
+// or of every feed if feedURL is empty. The store filters and limits them,
+// so only the items shown are loaded.
 func (m *Manager) GetFilteredItems(filter, feedURL string) []models.FeedItem {
-	var itemsToDisplay []models.FeedItem
-	
-	// Start with all feed items
-	workingItemsList := m.FeedItems
-
-	// 1. Filter by feed URL if provided
-	if feedURL != "" {
-		var tempItems []models.FeedItem
-		for _, item := range workingItemsList {
-			if item.FeedURLOrigin == feedURL {
-				tempItems = append(tempItems, item)
-			}
-		}
-		workingItemsList = tempItems // Update working list
+	items, err := m.DB.QueryFeedItems(database.ItemQuery{
+		FeedURL:  feedURL,
+		Unread:   filter == "unread",
+		Favorite: filter == "favorites",
+		Limit:    m.pageItems(),
+	})
+	if err != nil {
+		log.Printf("Error loading feed items: %v", err)
+		return nil
 	}
 
-	// 2. Then, filter by read/unread/favorite status on the (potentially feed-filtered) list
-	if filter == "unread" {
-		for _, item := range workingItemsList {
-			if !item.Read {
-				itemsToDisplay = append(itemsToDisplay, item)
-			}
-		}
-	} else if filter == "favorites" { // Add this condition
-		for _, item := range workingItemsList {
-			if item.Favorite {
-				itemsToDisplay = append(itemsToDisplay, item)
-			}
-		}
-	} else { // "all" (or no read/unread filter)
-		itemsToDisplay = make([]models.FeedItem, len(workingItemsList))
-		copy(itemsToDisplay, workingItemsList)
+	if m.Downloads != nil {
+		m.Downloads.Annotate(items)
 	}
-	
-	return itemsToDisplay
+
+	return items
 }
 
-// SortFeedItemsByDate sorts feedItems in place by PublishedTime (descending)
-func (m *Manager) SortFeedItemsByDate() {
-	sort.Slice(m.FeedItems, func(i, j int) bool {
-		return m.FeedItems[i].PublishedTime.After(m.FeedItems[j].PublishedTime)
-	})
+// pageItems returns the configured number of items shown on a page or the
+// default
+func (m *Manager) pageItems() int {
+	if m.PageItems <= 0 {
+		return DefaultPageItems
+	}
+	return m.PageItems
 }
 
-// UpdateUnreadCounts calculates and updates the unread count for each feed
-func (m *Manager) UpdateUnreadCounts() {
-	// Reset all counts
+// updateUnreadCounts calculates and updates the unread count for each feed
+// from the item store. The caller must hold m.mu.
+func (m *Manager) updateUnreadCounts() {
+	counts, err := m.DB.CountUnreadFeedItems()
+	if err != nil {
+		log.Printf("Error counting unread items: %v", err)
+		return
+	}
 	for i := range m.Feeds {
-		m.Feeds[i].UnreadCount = 0
-	}
-	
-	// Count unread items for each feed
-	for _, item := range m.FeedItems {
-		if !item.Read {
-			for i := range m.Feeds {
-				if m.Feeds[i].URL == item.FeedURLOrigin {
-					m.Feeds[i].UnreadCount++
-					break
-				}
-			}
-		}
+		m.Feeds[i].UnreadCount = counts[m.Feeds[i].URL]
+	}
+}
+
+// setHub records the WebSub hub and topic a feed advertises. A feed that
+// moved to another hub, or dropped it, has to be subscribed again.
+func setHub(feed *models.Feed, hub, topic string) {
+	if topic == "" {
+		topic = feed.URL
+	}
+	if hub == "" {
+		topic = ""
+	}
+	if feed.Hub == hub && feed.Topic == topic {
+		return
+	}
+	feed.Hub = hub
+	feed.Topic = topic
+	feed.HubLeaseExpiry = time.Time{}
+	feed.HubRequested = time.Time{}
+}
+
+// feedKey returns a short identifier of a feed that is safe to use in file
+// names and URL paths
+func feedKey(feedURL string) string {
+	sum := sha256.Sum256([]byte(feedURL))
+	return hex.EncodeToString(sum[:8])
+}
+
+// extractCredentials moves the user info of a feed URL into the basic auth
+// settings, so credentials are never stored as part of the URL
+func extractCredentials(feedURL string, settings models.RequestSettings) (string, models.RequestSettings) {
+	u, err := url.Parse(feedURL)
+	if err != nil || u.User == nil {
+		return feedURL, settings
+	}
+	if settings.Username == "" {
+		settings.Username = u.User.Username()
+		settings.Password, _ = u.User.Password()
 	}
+	u.User = nil
+	return u.String(), settings
 }
@@ -0,0 +1,194 @@
+package feeds
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+
+	"deel/internal/models"
+)
+
+// UserAgent is sent with every feed request
+const UserAgent = "deeL/1.0 (+https://github.com/chrisdettloff/deeL)"
+
+// fetchResponse holds the raw result of fetching a feed over HTTP
+type fetchResponse struct {
+	Body         []byte
+	NotModified  bool   // true on a 304 or when the body hash is unchanged
+	ETag         string // ETag validator returned by the server
+	LastModified string // Last-Modified validator returned by the server
+	ContentHash  string // hex encoded SHA-256 of the body
+	Header       http.Header
+	StatusCode   int
+	PermanentURL string // final URL when every redirect followed was permanent
+}
+
+// fetch downloads a feed document. When conditional is true, the validators
+// stored on the feed are sent so an unchanged feed can be skipped entirely.
+func (m *Manager) fetch(ctx context.Context, feed models.Feed, conditional bool) (*fetchResponse, error) {
+	ctx, err := withProxy(ctx, feed.Request.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feed.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	applyRequestSettings(req, feed.Request)
+	if conditional {
+		if feed.ETag != "" {
+			req.Header.Set("If-None-Match", feed.ETag)
+		}
+		if feed.LastModified != "" {
+			req.Header.Set("If-Modified-Since", feed.LastModified)
+		}
+	}
+
+	// Track the redirect chain on a copy of the client, so the shared
+	// client is left untouched
+	client := *m.httpClient()
+	redirects := &redirectTracker{permanent: true, next: client.CheckRedirect}
+	for name := range feed.Request.Headers {
+		redirects.private = append(redirects.private, name)
+	}
+	client.CheckRedirect = redirects.check
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &fetchResponse{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		ContentHash:  feed.ContentHash,
+		Header:       resp.Header,
+		StatusCode:   resp.StatusCode,
+	}
+	if redirects.permanent && redirects.location != "" && redirects.location != feed.URL {
+		result.PermanentURL = redirects.location
+	}
+
+	if resp.StatusCode == http.StatusNotModified && conditional {
+		// Some servers omit validators on a 304, keep the ones we sent
+		if result.ETag == "" {
+			result.ETag = feed.ETag
+		}
+		if result.LastModified == "" {
+			result.LastModified = feed.LastModified
+		}
+		result.NotModified = true
+		return result, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, gofeed.HTTPError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+
+	if err := checkContentType(resp.Header); err != nil {
+		return nil, err
+	}
+	maxBody := m.maxBodySize()
+	if resp.ContentLength > maxBody {
+		return nil, &PolicyError{Reason: fmt.Sprintf("feed is larger than %d bytes", maxBody)}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxBody {
+		return nil, &PolicyError{Reason: fmt.Sprintf("feed is larger than %d bytes", maxBody)}
+	}
+	result.Body = body
+
+	sum := sha256.Sum256(body)
+	result.ContentHash = hex.EncodeToString(sum[:])
+	result.NotModified = conditional && result.ContentHash == feed.ContentHash
+
+	return result, nil
+}
+
+// redirectTracker records whether every redirect of a request was permanent
+// and keeps the custom headers of a feed from reaching other hosts
+type redirectTracker struct {
+	permanent bool
+	location  string
+	private   []string // custom headers only sent to the host of the first request
+	next      func(req *http.Request, via []*http.Request) error
+}
+
+// check is used as http.Client.CheckRedirect
+func (t *redirectTracker) check(req *http.Request, via []*http.Request) error {
+	if req.Response == nil ||
+		(req.Response.StatusCode != http.StatusMovedPermanently && req.Response.StatusCode != http.StatusPermanentRedirect) {
+		t.permanent = false
+	}
+	t.location = req.URL.String()
+
+	// Go copies every header but Authorization, Cookie and WWW-Authenticate
+	// to the next host, and custom headers often hold API tokens
+	if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+		for _, name := range t.private {
+			req.Header.Del(name)
+		}
+	}
+
+	if t.next != nil {
+		return t.next(req, via)
+	}
+	return limitRedirects(DefaultMaxRedirects)(req, via)
+}
+
+// maxBodySize returns the configured feed size limit or the default
+func (m *Manager) maxBodySize() int64 {
+	if m.MaxBodySize <= 0 {
+		return DefaultMaxBodySize
+	}
+	return m.MaxBodySize
+}
+
+// applyRequestSettings adds the per-feed headers, cookies and credentials
+// to a request. They are meant for the feed's host only: when a redirect
+// leaves it, Go's client drops the Authorization and Cookie headers and
+// fetch drops the custom headers.
+func applyRequestSettings(req *http.Request, settings models.RequestSettings) {
+	if settings.UserAgent != "" {
+		req.Header.Set("User-Agent", settings.UserAgent)
+	}
+	for name, value := range settings.Headers {
+		req.Header.Set(name, value)
+	}
+	if settings.Cookies != "" {
+		req.Header.Set("Cookie", settings.Cookies)
+	}
+	if settings.Username != "" {
+		req.SetBasicAuth(settings.Username, settings.Password)
+	}
+}
+
+// settingsFor returns the request settings of a feed at fromURL to use for
+// a request to toURL. Headers, cookies and credentials are only sent to the
+// feed's own host; elsewhere just its proxy and user agent are used.
+func settingsFor(fromURL, toURL string, settings models.RequestSettings) models.RequestSettings {
+	from, err := url.Parse(fromURL)
+	if err != nil {
+		return models.RequestSettings{UserAgent: settings.UserAgent, Proxy: settings.Proxy}
+	}
+	to, err := url.Parse(toURL)
+	if err != nil || !strings.EqualFold(from.Host, to.Host) {
+		return models.RequestSettings{UserAgent: settings.UserAgent, Proxy: settings.Proxy}
+	}
+	return settings
+}
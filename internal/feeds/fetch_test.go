@@ -0,0 +1,108 @@
+package feeds
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"deel/internal/database"
+	"deel/internal/models"
+)
+
+// headerRecorder remembers the X-Api-Key header received for each path
+type headerRecorder struct {
+	mu   sync.Mutex
+	seen map[string]string
+}
+
+func (r *headerRecorder) record(req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seen == nil {
+		r.seen = make(map[string]string)
+	}
+	r.seen[req.URL.Path] = req.Header.Get("X-Api-Key")
+}
+
+func (r *headerRecorder) get(path string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	value, ok := r.seen[path]
+	return value, ok
+}
+
+// TestCustomHeadersStayOnHost checks that the custom headers of a feed are
+// sent on redirects within its host but not to another host, neither on a
+// redirect nor when a page links to a feed elsewhere
+func TestCustomHeadersStayOnHost(t *testing.T) {
+	var other headerRecorder
+	otherSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		other.record(r)
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, testRSS)
+	}))
+	defer otherSrv.Close()
+
+	var own headerRecorder
+	ownSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		own.record(r)
+		switch r.URL.Path {
+		case "/moved":
+			http.Redirect(w, r, "/feed", http.StatusFound)
+		case "/away":
+			http.Redirect(w, r, otherSrv.URL+"/redirected", http.StatusFound)
+		case "/page":
+			fmt.Fprintf(w, `<html><head><link rel="alternate" type="application/rss+xml" href="%s/discovered"></head></html>`, otherSrv.URL)
+		default:
+			w.Header().Set("Content-Type", "application/rss+xml")
+			fmt.Fprint(w, testRSS)
+		}
+	}))
+	defer ownSrv.Close()
+
+	db, err := database.NewDB(filepath.Join(t.TempDir(), database.DBPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m, err := NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := models.RequestSettings{Headers: map[string]string{"X-Api-Key": "secret"}}
+
+	// Redirects
+	for _, path := range []string{"/moved", "/away"} {
+		if _, err := m.fetch(context.Background(), models.Feed{URL: ownSrv.URL + path, Request: settings}, false); err != nil {
+			t.Fatalf("fetch %s: %v", path, err)
+		}
+	}
+	if key, _ := own.get("/feed"); key != "secret" {
+		t.Errorf("redirect within the host sent X-Api-Key %q, want it kept", key)
+	}
+	if key, ok := other.get("/redirected"); !ok || key != "" {
+		t.Errorf("redirect to another host sent X-Api-Key %q (reached: %v), want it dropped", key, ok)
+	}
+
+	// Discovery
+	feed, err := m.AddFeed(ownSrv.URL+"/page", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := own.get("/page"); key != "secret" {
+		t.Errorf("page fetch sent X-Api-Key %q, want it kept", key)
+	}
+	if key, ok := other.get("/discovered"); !ok || key != "" {
+		t.Errorf("discovered feed on another host was fetched with X-Api-Key %q (reached: %v), want none", key, ok)
+	}
+	if feed == nil || feed.URL != otherSrv.URL+"/discovered" {
+		t.Fatalf("subscribed to %v, want %s/discovered", feed, otherSrv.URL)
+	}
+	if len(feed.Request.Headers) != 0 {
+		t.Errorf("feed on another host kept the page's headers %v", feed.Request.Headers)
+	}
+}
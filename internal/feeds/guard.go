@@ -0,0 +1,182 @@
+package feeds
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultMaxBodySize bounds the size of a feed document
+	DefaultMaxBodySize = 10 << 20
+
+	// DefaultMaxRedirects bounds the number of redirects followed per request
+	DefaultMaxRedirects = 5
+
+	// Dialer settings, as used by http.DefaultTransport
+	dialTimeout   = 30 * time.Second
+	dialKeepAlive = 30 * time.Second
+)
+
+// PolicyError reports a request refused because it breaks the fetch policy,
+// for instance because it targets a private address
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Reason
+}
+
+// cgnatNetwork is the carrier-grade NAT range, which net.IP.IsPrivate leaves out
+var cgnatNetwork = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// refusedContentTypes are media types no feed or web page is served as
+var refusedContentTypes = []string{"image/", "audio/", "video/", "font/", "application/pdf", "application/zip", "application/gzip"}
+
+// addressGuard refuses connections to denied networks. The address is
+// checked after DNS resolution, right before connecting, so every redirect
+// and every DNS answer is covered.
+type addressGuard struct {
+	denyPrivate bool
+	denied      []*net.IPNet
+}
+
+// newAddressGuard parses the extra denied networks given in CIDR notation
+func newAddressGuard(denyPrivate bool, networks []string) (*addressGuard, error) {
+	guard := &addressGuard{denyPrivate: denyPrivate}
+	for _, cidr := range networks {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid denied network %q: %w", cidr, err)
+		}
+		guard.denied = append(guard.denied, network)
+	}
+	return guard, nil
+}
+
+// enabled reports whether any address is denied
+func (g *addressGuard) enabled() bool {
+	return g.denyPrivate || len(g.denied) > 0
+}
+
+// proxyAddress returns the host:port connections to a proxy are dialed to
+func proxyAddress(proxyURL *url.URL) string {
+	port := proxyURL.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443", "socks5": "1080"}[proxyURL.Scheme]
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+// checkHost resolves the host of a request sent through a proxy and
+// refuses it if any of its addresses is denied. The proxy may resolve the
+// name differently, so this is a best effort.
+func (g *addressGuard) checkHost(ctx context.Context, target *url.URL) error {
+	host := target.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		return g.check(net.JoinHostPort(host, "0"))
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil // leave resolving to the proxy
+	}
+	for _, addr := range addrs {
+		if err := g.check(net.JoinHostPort(addr.IP.String(), "0")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dialContext wraps a dial function, refusing denied addresses. The
+// connection of a request to the global proxy is exempt, see
+// globalProxyTransport; the proxy resolves the target itself, which
+// checkHost has vetted.
+func (g *addressGuard) dialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if proxy, ok := ctx.Value(globalProxyContextKey{}).(string); ok && proxy == address {
+			return dial(ctx, network, address)
+		}
+		dialer := &net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: dialKeepAlive,
+			Control: func(_, address string, _ syscall.RawConn) error {
+				return g.check(address)
+			},
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+}
+
+// check refuses a resolved host:port in a denied network
+func (g *addressGuard) check(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return &PolicyError{Reason: fmt.Sprintf("cannot check address %s", host)}
+	}
+
+	if g.denyPrivate && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || cgnatNetwork.Contains(ip)) {
+		return &PolicyError{Reason: fmt.Sprintf("address %s is private, loopback or link-local", ip)}
+	}
+	for _, network := range g.denied {
+		if network.Contains(ip) {
+			return &PolicyError{Reason: fmt.Sprintf("address %s is in denied network %s", ip, network)}
+		}
+	}
+	return nil
+}
+
+// schemeTransport only lets http and https requests through
+type schemeTransport struct {
+	next http.RoundTripper
+}
+
+func (t *schemeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, &PolicyError{Reason: fmt.Sprintf("URL scheme %q is not allowed, use http or https", req.URL.Scheme)}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// limitRedirects returns a CheckRedirect policy following at most max redirects
+func limitRedirects(max int) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > max {
+			return &PolicyError{Reason: fmt.Sprintf("stopped after %d redirects", max)}
+		}
+		return nil
+	}
+}
+
+// checkContentType refuses responses that cannot be a feed or a web page
+func checkContentType(header http.Header) error {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil // a broken header says nothing about the body
+	}
+	for _, refused := range refusedContentTypes {
+		if strings.HasPrefix(mediaType, refused) {
+			return &PolicyError{Reason: fmt.Sprintf("content type %s is not a feed", mediaType)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package feeds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"deel/internal/database"
+	"deel/internal/models"
+)
+
+// TestFetchPolicy checks every way a feed can break the fetch policy and
+// the reason shown for it on the add-feed form
+func TestFetchPolicy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/feed":
+			w.Header().Set("Content-Type", "application/rss+xml")
+			fmt.Fprint(w, testRSS)
+		case r.URL.Path == "/large":
+			w.Header().Set("Content-Type", "application/rss+xml")
+			fmt.Fprint(w, strings.Repeat(" ", 200))
+		case r.URL.Path == "/unannounced":
+			// Flushing first sends the body chunked, without a Content-Length
+			w.Header().Set("Content-Type", "application/rss+xml")
+			fmt.Fprint(w, strings.Repeat(" ", 50))
+			w.(http.Flusher).Flush()
+			fmt.Fprint(w, strings.Repeat(" ", 150))
+		case r.URL.Path == "/image":
+			w.Header().Set("Content-Type", "image/png")
+			fmt.Fprint(w, testRSS)
+		case r.URL.Path == "/elsewhere":
+			http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+		case strings.HasPrefix(r.URL.Path, "/loop/"):
+			n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/loop/"))
+			http.Redirect(w, r, fmt.Sprintf("/loop/%d", n+1), http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	// A second server on another loopback address, denied on its own
+	other, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("cannot listen on 127.0.0.2: %v", err)
+	}
+	otherSrv := httptest.NewUnstartedServer(srv.Config.Handler)
+	otherSrv.Listener.Close()
+	otherSrv.Listener = other
+	otherSrv.Start()
+	defer otherSrv.Close()
+
+	tests := []struct {
+		name    string
+		opts    ClientOptions
+		maxBody int64
+		url     string
+		want    string // regular expression matching the whole reason
+	}{
+		{
+			name: "scheme",
+			url:  "ftp://" + srv.Listener.Addr().String() + "/feed",
+			want: regexp.QuoteMeta(`URL scheme "ftp" is not allowed, use http or https`),
+		},
+		{
+			name: "private address",
+			opts: ClientOptions{DenyPrivate: true},
+			url:  srv.URL + "/feed",
+			want: regexp.QuoteMeta("address 127.0.0.1 is private, loopback or link-local"),
+		},
+		{
+			name: "private address after DNS",
+			opts: ClientOptions{DenyPrivate: true},
+			url:  "http://localhost:" + port + "/feed",
+			want: `address (127\.0\.0\.1|::1) is private, loopback or link-local`,
+		},
+		{
+			name: "denied network",
+			opts: ClientOptions{DeniedNetworks: []string{"127.0.0.0/8"}},
+			url:  srv.URL + "/feed",
+			want: regexp.QuoteMeta("address 127.0.0.1 is in denied network 127.0.0.0/8"),
+		},
+		{
+			name: "denied network on redirect",
+			opts: ClientOptions{DeniedNetworks: []string{"127.0.0.2/32"}},
+			url:  srv.URL + "/elsewhere?to=" + otherSrv.URL + "/feed",
+			want: regexp.QuoteMeta("address 127.0.0.2 is in denied network 127.0.0.2/32"),
+		},
+		{
+			name:    "announced body size",
+			maxBody: 100,
+			url:     srv.URL + "/large",
+			want:    regexp.QuoteMeta("feed is larger than 100 bytes"),
+		},
+		{
+			name:    "unannounced body size",
+			maxBody: 100,
+			url:     srv.URL + "/unannounced",
+			want:    regexp.QuoteMeta("feed is larger than 100 bytes"),
+		},
+		{
+			name: "content type",
+			url:  srv.URL + "/image",
+			want: regexp.QuoteMeta("content type image/png is not a feed"),
+		},
+		{
+			name: "redirect count",
+			opts: ClientOptions{MaxRedirects: 2},
+			url:  srv.URL + "/loop/0",
+			want: regexp.QuoteMeta("stopped after 2 redirects"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := policyManager(t, tt.opts)
+			m.MaxBodySize = tt.maxBody
+			_, err := m.AddFeed(tt.url, models.RequestSettings{})
+			var policyErr *PolicyError
+			if !errors.As(err, &policyErr) {
+				t.Fatalf("AddFeed(%s) = %v, want a policy error", tt.url, err)
+			}
+			if !regexp.MustCompile("^" + tt.want + "$").MatchString(policyErr.Error()) {
+				t.Errorf("AddFeed(%s) refused with %q, want %q", tt.url, policyErr.Error(), tt.want)
+			}
+		})
+	}
+
+	// Within the limits the same feed is accepted
+	m := policyManager(t, ClientOptions{DeniedNetworks: []string{"127.0.0.2/32"}, MaxRedirects: 2})
+	if _, err := m.AddFeed(srv.URL+"/elsewhere?to=/feed", models.RequestSettings{}); err != nil {
+		t.Errorf("AddFeed of an allowed feed: %v", err)
+	}
+}
+
+// TestGlobalProxyExemption checks that the global proxy may be on a denied
+// network, but only for the connections made to reach it
+func TestGlobalProxyExemption(t *testing.T) {
+	// A forward proxy serving every feed itself
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.URL.IsAbs() {
+			http.Error(w, "not a proxy request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/rss+xml")
+		io.WriteString(w, testRSS)
+	}))
+	defer proxy.Close()
+
+	client, err := NewClient(ClientOptions{ProxyURL: proxy.URL, DenyPrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Feeds are fetched through the proxy, even though it is on loopback
+	resp, err := client.Get("http://feeds.example/feed")
+	if err != nil {
+		t.Fatalf("fetch through the proxy: %v", err)
+	}
+	resp.Body.Close()
+
+	// A feed pointing at the proxy is checked like any other target
+	var policyErr *PolicyError
+	if _, err := client.Get(proxy.URL + "/feed"); !errors.As(err, &policyErr) {
+		t.Errorf("fetch of the proxy itself = %v, want a policy error", err)
+	}
+
+	// So is a connection to the proxy that does not carry a proxied request
+	transport := client.Transport.(*schemeTransport).next.(*globalProxyTransport).next.(*http.Transport)
+	conn, err := transport.DialContext(context.Background(), "tcp", proxy.Listener.Addr().String())
+	if err == nil {
+		conn.Close()
+	}
+	if !errors.As(err, &policyErr) {
+		t.Errorf("direct dial of the proxy = %v, want a policy error", err)
+	}
+}
+
+// policyManager returns a manager fetching with a client built from opts
+func policyManager(t *testing.T, opts ClientOptions) *Manager {
+	t.Helper()
+	db, err := database.NewDB(filepath.Join(t.TempDir(), database.DBPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	m, err := NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Client, err = NewClient(opts); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
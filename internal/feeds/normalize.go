@@ -0,0 +1,193 @@
+package feeds
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+
+	"deel/internal/models"
+	"deel/internal/utils"
+)
+
+// convertItems converts the items of a parsed feed into FeedItems.
+// Read and favorite status are left unset.
+func convertItems(parsedFeed *gofeed.Feed, feedURL string) []models.FeedItem {
+	items := make([]models.FeedItem, 0, len(parsedFeed.Items))
+	for _, item := range parsedFeed.Items {
+		items = append(items, normalizeItem(item, parsedFeed.Title, feedURL))
+	}
+	return items
+}
+
+// normalizeItem converts a single parsed item into a FeedItem. It is the one
+// place where gofeed items are mapped onto the model, so every fetch path
+// stores the same fields.
+func normalizeItem(item *gofeed.Item, feedTitle, feedURL string) models.FeedItem {
+	pubTime, formatted := itemPublished(item)
+
+	var updated time.Time
+	if item.UpdatedParsed != nil {
+		updated = *item.UpdatedParsed
+	} else if item.Updated != "" {
+		updated, _ = utils.ParseDate(item.Updated)
+	}
+
+	return models.FeedItem{
+		ID:            utils.ItemID(feedURL, item.GUID, item.Link, item.Title),
+		GUID:          item.GUID,
+		Title:         item.Title,
+		Link:          item.Link,
+		Description:   item.Description,
+		Content:       item.Content,
+		Authors:       itemAuthors(item),
+		Categories:    itemCategories(item),
+		Enclosures:    itemEnclosures(item),
+		ImageURL:      itemImage(item),
+		Published:     formatted,
+		FeedTitle:     feedTitle,
+		PublishedTime: pubTime,
+		UpdatedTime:   updated,
+		FeedURLOrigin: feedURL,
+	}
+}
+
+// itemPublished returns the publish time of an item and its display form,
+// falling back to the updated time and then to the raw date strings
+func itemPublished(item *gofeed.Item) (time.Time, string) {
+	if item.PublishedParsed != nil {
+		return *item.PublishedParsed, item.PublishedParsed.Format("Jan 2, 2006 15:04")
+	}
+	if item.UpdatedParsed != nil {
+		return *item.UpdatedParsed, item.UpdatedParsed.Format("Jan 2, 2006 15:04")
+	}
+	for _, raw := range []string{item.Published, item.Updated} {
+		if raw == "" {
+			continue
+		}
+		parsed, _ := utils.ParseDate(raw)
+		if parsed.IsZero() {
+			return time.Time{}, raw
+		}
+		return parsed, parsed.Format("Jan 2, 2006 15:04")
+	}
+	return time.Time{}, ""
+}
+
+// itemAuthors returns the display names of an item's authors
+func itemAuthors(item *gofeed.Item) []string {
+	var authors []string
+	for _, person := range item.Authors {
+		if person == nil {
+			continue
+		}
+		name := strings.TrimSpace(person.Name)
+		if name == "" {
+			name = strings.TrimSpace(person.Email)
+		}
+		if name != "" {
+			authors = append(authors, name)
+		}
+	}
+	if len(authors) == 0 && item.ITunesExt != nil && item.ITunesExt.Author != "" {
+		authors = append(authors, strings.TrimSpace(item.ITunesExt.Author))
+	}
+	return authors
+}
+
+// itemCategories returns the distinct, non-empty categories of an item
+func itemCategories(item *gofeed.Item) []string {
+	var categories []string
+	seen := make(map[string]bool)
+	for _, category := range item.Categories {
+		category = strings.TrimSpace(category)
+		key := strings.ToLower(category)
+		if category == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		categories = append(categories, category)
+	}
+	return categories
+}
+
+// itemEnclosures returns the files attached to an item. The iTunes episode
+// duration is recorded on its audio and video enclosures.
+func itemEnclosures(item *gofeed.Item) []models.Enclosure {
+	var duration time.Duration
+	if item.ITunesExt != nil {
+		duration = itunesDuration(item.ITunesExt.Duration)
+	}
+
+	var enclosures []models.Enclosure
+	for _, enclosure := range item.Enclosures {
+		if enclosure == nil || enclosure.URL == "" {
+			continue
+		}
+		length, _ := strconv.ParseInt(strings.TrimSpace(enclosure.Length), 10, 64)
+		e := models.Enclosure{
+			URL:    enclosure.URL,
+			Type:   strings.ToLower(strings.TrimSpace(enclosure.Type)),
+			Length: length,
+		}
+		if e.IsMedia() {
+			e.Duration = duration
+		}
+		enclosures = append(enclosures, e)
+	}
+	return enclosures
+}
+
+// itunesDuration parses an itunes:duration value, which is either a number
+// of seconds or one of HH:MM:SS and MM:SS. It returns zero if value is invalid.
+func itunesDuration(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	parts := strings.Split(value, ":")
+	if len(parts) > 3 {
+		return 0
+	}
+	var total float64
+	for _, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0
+		}
+		total = total*60 + n
+	}
+	return time.Duration(total * float64(time.Second))
+}
+
+// itemImage returns the lead image of an item: its own image, an image
+// enclosure, a Media RSS thumbnail or image, or its iTunes artwork
+func itemImage(item *gofeed.Item) string {
+	if item.Image != nil && item.Image.URL != "" {
+		return item.Image.URL
+	}
+	for _, enclosure := range item.Enclosures {
+		if enclosure != nil && enclosure.URL != "" && strings.HasPrefix(enclosure.Type, "image/") {
+			return enclosure.URL
+		}
+	}
+	if media, ok := item.Extensions["media"]; ok {
+		for _, thumbnail := range media["thumbnail"] {
+			if url := thumbnail.Attrs["url"]; url != "" {
+				return url
+			}
+		}
+		for _, content := range media["content"] {
+			if url := content.Attrs["url"]; url != "" &&
+				(content.Attrs["medium"] == "image" || strings.HasPrefix(content.Attrs["type"], "image/")) {
+				return url
+			}
+		}
+	}
+	if item.ITunesExt != nil && item.ITunesExt.Image != "" {
+		return item.ITunesExt.Image
+	}
+	return ""
+}
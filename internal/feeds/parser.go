@@ -0,0 +1,37 @@
+package feeds
+
+import (
+	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/rss"
+)
+
+// newParser returns a gofeed parser that keeps the RSS fields deeL needs
+// but the universal feed type drops
+func newParser() *gofeed.Parser {
+	fp := gofeed.NewParser()
+	fp.RSSTranslator = &rssTranslator{}
+	return fp
+}
+
+// rssTranslator extends the default RSS translator to carry the channel
+// <ttl> over into Feed.Custom["ttl"]
+type rssTranslator struct {
+	gofeed.DefaultRSSTranslator
+}
+
+// Translate converts an RSS feed into the universal feed type
+func (t *rssTranslator) Translate(feed interface{}) (*gofeed.Feed, error) {
+	result, err := t.DefaultRSSTranslator.Translate(feed)
+	if err != nil {
+		return nil, err
+	}
+
+	if rssFeed, ok := feed.(*rss.Feed); ok && rssFeed.TTL != "" {
+		if result.Custom == nil {
+			result.Custom = make(map[string]string)
+		}
+		result.Custom["ttl"] = rssFeed.TTL
+	}
+
+	return result, nil
+}
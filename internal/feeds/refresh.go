@@ -0,0 +1,148 @@
+package feeds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+
+	"deel/internal/models"
+)
+
+const (
+	// DefaultWorkers is the number of feeds fetched in parallel during a refresh
+	DefaultWorkers = 8
+
+	// DefaultFeedTimeout bounds how long a single feed fetch may take
+	DefaultFeedTimeout = 30 * time.Second
+)
+
+// fetchResult holds the outcome of fetching a single feed
+type fetchResult struct {
+	FeedURL      string
+	Items        []models.FeedItem
+	NotModified  bool // the feed is unchanged and was not parsed
+	ETag         string
+	LastModified string
+	ContentHash  string
+	Hint         time.Duration // polling interval requested by the publisher
+	StatusCode   int           // HTTP status of the response, zero if none was received
+	PermanentURL string        // new feed URL after a permanent redirect
+	Hub          string        // WebSub hub advertised by the feed
+	Topic        string        // WebSub topic (self URL) advertised by the feed
+	Err          error
+}
+
+// fetchAll fetches the given feeds using a bounded pool of workers.
+// Results are returned in the same order as feedsToFetch, regardless of
+// the order in which the fetches complete. Feeds listed in conditional are
+// fetched with their stored validators and skipped when unchanged.
+func (m *Manager) fetchAll(ctx context.Context, feedsToFetch []models.Feed, conditional map[string]bool) []fetchResult {
+	results := make([]fetchResult, len(feedsToFetch))
+	if len(feedsToFetch) == 0 {
+		return results
+	}
+
+	workers := m.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if workers > len(feedsToFetch) {
+		workers = len(feedsToFetch)
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// gofeed.Parser is not safe for concurrent use, so each worker gets its own
+			fp := newParser()
+			for i := range jobs {
+				feed := feedsToFetch[i]
+				results[i] = m.fetchFeed(ctx, fp, feed, conditional[feed.URL])
+			}
+		}()
+	}
+
+	for i := range feedsToFetch {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			// Mark the remaining feeds as cancelled without fetching them
+			for j := i; j < len(feedsToFetch); j++ {
+				results[j] = fetchResult{FeedURL: feedsToFetch[j].URL, Err: ctx.Err()}
+			}
+			close(jobs)
+			wg.Wait()
+			return results
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// fetchFeed fetches and parses a single feed, bounded by the per-feed timeout
+func (m *Manager) fetchFeed(ctx context.Context, fp *gofeed.Parser, feed models.Feed, conditional bool) fetchResult {
+	ctx, cancel := context.WithTimeout(ctx, m.feedTimeout())
+	defer cancel()
+
+	resp, err := m.fetch(ctx, feed, conditional)
+	if err != nil {
+		result := fetchResult{FeedURL: feed.URL, Err: err}
+		var httpErr gofeed.HTTPError
+		if errors.As(err, &httpErr) {
+			result.StatusCode = httpErr.StatusCode
+		}
+		return result
+	}
+
+	result := fetchResult{
+		FeedURL:      feed.URL,
+		StatusCode:   resp.StatusCode,
+		PermanentURL: resp.PermanentURL,
+		NotModified:  resp.NotModified,
+		ETag:         resp.ETag,
+		LastModified: resp.LastModified,
+		ContentHash:  resp.ContentHash,
+	}
+	if resp.NotModified {
+		result.Hint = publisherHint(nil, resp.Header)
+		return result
+	}
+
+	if feed.Scrape != nil {
+		_, result.Items, err = scrapeItems(resp.Body, feed.URL, *feed.Scrape)
+		if err != nil {
+			return fetchResult{FeedURL: feed.URL, StatusCode: resp.StatusCode, Err: err}
+		}
+		result.Items = m.admitItems(result.Items, m.retentionPolicy(feed), time.Now())
+		result.Hint = publisherHint(nil, resp.Header)
+		return result
+	}
+
+	parsedFeed, err := fp.Parse(bytes.NewReader(resp.Body))
+	if err != nil {
+		return fetchResult{FeedURL: feed.URL, StatusCode: resp.StatusCode, Err: err}
+	}
+	result.Items = m.admitItems(convertItems(parsedFeed, feed.URL), m.retentionPolicy(feed), time.Now())
+	result.Hint = publisherHint(parsedFeed, resp.Header)
+	result.Hub, result.Topic = hubLinks(resp.Body, resp.Header)
+
+	return result
+}
+
+// feedTimeout returns the configured per-feed timeout or the default
+func (m *Manager) feedTimeout() time.Duration {
+	if m.FeedTimeout <= 0 {
+		return DefaultFeedTimeout
+	}
+	return m.FeedTimeout
+}
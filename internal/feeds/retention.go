@@ -0,0 +1,113 @@
+package feeds
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"deel/internal/models"
+)
+
+// RetentionInterval is how often RunRetention prunes old items
+const RetentionInterval = time.Hour
+
+// RunRetention prunes the items that fall outside the retention policies
+// until ctx is cancelled. It prunes once at startup and then every
+// RetentionInterval.
+func (m *Manager) RunRetention(ctx context.Context) {
+	ticker := time.NewTicker(RetentionInterval)
+	defer ticker.Stop()
+
+	for {
+		m.PruneItems()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PruneItems applies the retention policy of every feed and returns the
+// number of items deleted
+func (m *Manager) PruneItems() int {
+	now := time.Now()
+	total := 0
+	for _, feed := range m.GetFeeds() {
+		pruned, err := m.DB.PruneFeedItems(feed.URL, m.retentionPolicy(feed), now)
+		if err != nil {
+			log.Printf("Error pruning items of feed %s: %v", feed.URL, err)
+			continue
+		}
+		total += pruned
+	}
+	if total == 0 {
+		return 0
+	}
+
+	log.Printf("Pruned %d items past their retention", total)
+	m.mu.Lock()
+	m.updateUnreadCounts()
+	m.mu.Unlock()
+	m.scheduleDownloads()
+	return total
+}
+
+// SetRetention sets the retention policy of a feed. A nil policy reverts
+// the feed to the global policy.
+func (m *Manager) SetRetention(feedURL string, policy *models.RetentionPolicy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.Feeds {
+		feed := &m.Feeds[i]
+		if feed.URL != feedURL {
+			continue
+		}
+		feed.Retention = policy
+		return m.DB.SaveFeed(*feed)
+	}
+	return nil
+}
+
+// retentionPolicy returns the policy that applies to a feed
+func (m *Manager) retentionPolicy(feed models.Feed) models.RetentionPolicy {
+	if feed.Retention != nil {
+		return *feed.Retention
+	}
+	return m.Retention
+}
+
+// admitItems drops fetched items the retention policy would prune right
+// away, so items a feed keeps listing are not stored again, as unread,
+// after every prune. Items are ranked newest first, as PruneFeedItems does.
+// Favorites are not known here, so only the limits are applied; under a
+// policy that keeps unread items, an item outside the limits is only
+// dropped if it is already stored and read.
+func (m *Manager) admitItems(items []models.FeedItem, policy models.RetentionPolicy, now time.Time) []models.FeedItem {
+	if !policy.Prunes() {
+		return items
+	}
+
+	ranked := append([]models.FeedItem(nil), items...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].PublishedTime.After(ranked[j].PublishedTime)
+	})
+
+	cutoff := policy.Cutoff(now)
+	admitted := make([]models.FeedItem, 0, len(ranked))
+	for rank, item := range ranked {
+		tooMany := policy.MaxItems > 0 && rank >= policy.MaxItems
+		tooOld := !cutoff.IsZero() && !item.PublishedTime.IsZero() && item.PublishedTime.Before(cutoff)
+		if !tooMany && !tooOld {
+			admitted = append(admitted, item)
+			continue
+		}
+		// Read state is only kept for stored items
+		if policy.KeepUnread && !m.DB.GetFeedItemReadStatus(item.ID) {
+			admitted = append(admitted, item)
+		}
+	}
+	return admitted
+}
@@ -0,0 +1,57 @@
+package feeds
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"deel/internal/database"
+	"deel/internal/models"
+)
+
+// TestAdmitItems checks that fetched items outside the retention limits are
+// dropped, except unread ones under a policy that keeps them
+func TestAdmitItems(t *testing.T) {
+	db, err := database.NewDB(filepath.Join(t.TempDir(), database.DBPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m, err := NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	items := []models.FeedItem{
+		{ID: "old", PublishedTime: now.AddDate(0, 0, -30)},
+		{ID: "new", PublishedTime: now},
+		{ID: "older", PublishedTime: now.AddDate(0, 0, -60)},
+	}
+	if err := db.SetFeedItemReadStatus("older", true); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy models.RetentionPolicy
+		want   []string
+	}{
+		{models.RetentionPolicy{}, []string{"old", "new", "older"}},
+		{models.RetentionPolicy{MaxItems: 1}, []string{"new"}},
+		{models.RetentionPolicy{MaxAgeDays: 7}, []string{"new"}},
+		{models.RetentionPolicy{MaxItems: 2}, []string{"new", "old"}},
+		{models.RetentionPolicy{MaxItems: 1, KeepUnread: true}, []string{"new", "old"}},
+		{models.RetentionPolicy{MaxAgeDays: 7, KeepUnread: true}, []string{"new", "old"}},
+		{models.RetentionPolicy{MaxAgeDays: 90, KeepUnread: true}, []string{"new", "old", "older"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, item := range m.admitItems(items, tt.policy, now) {
+			got = append(got, item.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("admitItems under %+v = %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+}
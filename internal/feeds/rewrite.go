@@ -0,0 +1,180 @@
+package feeds
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Rewriter turns the address of a web page into the address of its feed.
+// Rewrite must not do any I/O and returns false for URLs it does not
+// recognize.
+type Rewriter interface {
+	Rewrite(u *url.URL) (string, bool)
+}
+
+// RewriterFunc adapts a function to the Rewriter interface
+type RewriterFunc func(u *url.URL) (string, bool)
+
+// Rewrite calls f(u)
+func (f RewriterFunc) Rewrite(u *url.URL) (string, bool) {
+	return f(u)
+}
+
+var (
+	rewritersMu sync.RWMutex
+	rewriters   = []Rewriter{
+		RewriterFunc(rewriteYouTube),
+		RewriterFunc(rewriteGitHub),
+		RewriterFunc(rewriteReddit),
+		RewriterFunc(rewriteMastodon),
+	}
+)
+
+// RegisterRewriter adds a rewriter. Rewriters are tried in the order they
+// were registered, after the built-in ones, and the first match wins.
+func RegisterRewriter(r Rewriter) {
+	rewritersMu.Lock()
+	defer rewritersMu.Unlock()
+	rewriters = append(rewriters, r)
+}
+
+// RewriteFeedURL returns the feed address for a known kind of web page,
+// such as a YouTube channel or a GitHub repository. It returns false if no
+// rewriter recognizes the URL. The result is a guess made offline; callers
+// should fall back to rawURL if it does not serve a feed.
+func RewriteFeedURL(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", false
+	}
+
+	rewritersMu.RLock()
+	defer rewritersMu.RUnlock()
+	for _, r := range rewriters {
+		if rewritten, ok := r.Rewrite(u); ok && rewritten != rawURL {
+			return rewritten, true
+		}
+	}
+	return "", false
+}
+
+// rewriteYouTube maps channel, legacy user and playlist pages to their
+// videos.xml feed. Handle pages (/@name) advertise their feed and are left
+// to discovery, as the channel ID cannot be derived offline.
+func rewriteYouTube(u *url.URL) (string, bool) {
+	if !hostIs(u, "youtube.com") {
+		return "", false
+	}
+
+	feed := url.URL{Scheme: "https", Host: "www.youtube.com", Path: "/feeds/videos.xml"}
+	segments := pathSegments(u)
+	switch {
+	case len(segments) >= 2 && segments[0] == "channel":
+		feed.RawQuery = url.Values{"channel_id": {segments[1]}}.Encode()
+	case len(segments) >= 2 && segments[0] == "user":
+		feed.RawQuery = url.Values{"user": {segments[1]}}.Encode()
+	case len(segments) >= 1 && segments[0] == "playlist" && u.Query().Get("list") != "":
+		feed.RawQuery = url.Values{"playlist_id": {u.Query().Get("list")}}.Encode()
+	default:
+		return "", false
+	}
+	return feed.String(), true
+}
+
+// githubReserved are top-level GitHub paths that are not user profiles
+var githubReserved = map[string]bool{
+	"about": true, "apps": true, "collections": true, "codespaces": true, "enterprise": true,
+	"explore": true, "features": true, "issues": true, "login": true, "marketplace": true,
+	"new": true, "notifications": true, "orgs": true, "organizations": true, "pricing": true,
+	"pulls": true, "search": true, "settings": true, "signup": true, "sponsors": true,
+	"topics": true, "trending": true,
+}
+
+// rewriteGitHub maps a repository or its releases page to the releases
+// feed, its tags or commits pages to the matching Atom feed, and a user
+// profile to their activity. Other pages of a repository, such as its
+// issues or wiki, are left alone.
+func rewriteGitHub(u *url.URL) (string, bool) {
+	if !hostIs(u, "github.com") {
+		return "", false
+	}
+
+	segments := pathSegments(u)
+	if len(segments) == 0 || strings.HasSuffix(u.Path, ".atom") {
+		return "", false
+	}
+	feed := url.URL{Scheme: "https", Host: "github.com"}
+	switch {
+	case len(segments) == 1 && !githubReserved[strings.ToLower(segments[0])]:
+		feed.Path = "/" + segments[0] + ".atom"
+	case len(segments) == 2 && !githubReserved[strings.ToLower(segments[0])]:
+		feed.Path = "/" + segments[0] + "/" + segments[1] + "/releases.atom"
+	case len(segments) == 3 && segments[2] == "releases":
+		feed.Path = "/" + segments[0] + "/" + segments[1] + "/releases.atom"
+	case len(segments) == 3 && segments[2] == "tags":
+		feed.Path = "/" + segments[0] + "/" + segments[1] + "/tags.atom"
+	case len(segments) == 4 && segments[2] == "commits":
+		feed.Path = "/" + segments[0] + "/" + segments[1] + "/commits/" + segments[3] + ".atom"
+	default:
+		return "", false
+	}
+	return feed.String(), true
+}
+
+// rewriteReddit maps a subreddit or user page to its RSS feed
+func rewriteReddit(u *url.URL) (string, bool) {
+	if !hostIs(u, "reddit.com") {
+		return "", false
+	}
+
+	segments := pathSegments(u)
+	if len(segments) != 2 || (segments[0] != "r" && segments[0] != "user" && segments[0] != "u") {
+		return "", false
+	}
+	if segments[0] == "u" {
+		segments[0] = "user"
+	}
+	feed := url.URL{Scheme: "https", Host: "www.reddit.com", Path: "/" + segments[0] + "/" + segments[1] + "/.rss"}
+	return feed.String(), true
+}
+
+// notMastodonHosts use /@name profile paths without being Mastodon servers
+var notMastodonHosts = []string{"youtube.com", "medium.com", "tiktok.com", "threads.net", "dev.to", "substack.com", "hashnode.dev", "pinterest.com"}
+
+// rewriteMastodon maps a profile page, /@name, to its RSS feed. Mastodon
+// servers run on their own domains, so the path shape is all there is to
+// go on; sites known to use it otherwise are skipped, and AddFeed falls
+// back to the page itself when the guess is not a feed.
+func rewriteMastodon(u *url.URL) (string, bool) {
+	for _, host := range notMastodonHosts {
+		if hostIs(u, host) {
+			return "", false
+		}
+	}
+
+	segments := pathSegments(u)
+	if len(segments) != 1 || len(segments[0]) < 2 || segments[0][0] != '@' ||
+		strings.ContainsAny(segments[0][1:], "@.") {
+		return "", false
+	}
+	feed := url.URL{Scheme: "https", Host: u.Host, Path: "/" + segments[0] + ".rss"}
+	return feed.String(), true
+}
+
+// hostIs reports whether u is on domain or one of its subdomains
+func hostIs(u *url.URL, domain string) bool {
+	host := strings.ToLower(u.Hostname())
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// pathSegments returns the non-empty segments of a URL path
+func pathSegments(u *url.URL) []string {
+	var segments []string
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
@@ -0,0 +1,133 @@
+package feeds
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"deel/internal/database"
+	"deel/internal/models"
+)
+
+func TestRewriteFeedURL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // empty if the URL must be left alone
+	}{
+		// YouTube
+		{"https://www.youtube.com/channel/UC123", "https://www.youtube.com/feeds/videos.xml?channel_id=UC123"},
+		{"https://youtube.com/user/someone", "https://www.youtube.com/feeds/videos.xml?user=someone"},
+		{"https://www.youtube.com/playlist?list=PL42", "https://www.youtube.com/feeds/videos.xml?playlist_id=PL42"},
+		{"https://www.youtube.com/@handle", ""},
+		{"https://www.youtube.com/watch?v=abc", ""},
+
+		// GitHub
+		{"https://github.com/golang/go", "https://github.com/golang/go/releases.atom"},
+		{"https://github.com/golang/go/releases", "https://github.com/golang/go/releases.atom"},
+		{"https://github.com/golang/go/tags", "https://github.com/golang/go/tags.atom"},
+		{"https://github.com/golang/go/commits/master", "https://github.com/golang/go/commits/master.atom"},
+		{"https://github.com/rsc", "https://github.com/rsc.atom"},
+		{"https://github.com/golang/go/issues", ""},
+		{"https://github.com/golang/go/wiki", ""},
+		{"https://github.com/golang/go/settings", ""},
+		{"https://github.com/golang/go/blob/master/README.md", ""},
+		{"https://github.com/settings", ""},
+		{"https://github.com/explore", ""},
+		{"https://github.com/settings/profile", ""},
+		{"https://github.com/golang/go/releases.atom", ""},
+		{"https://github.com/", ""},
+
+		// Reddit
+		{"https://www.reddit.com/r/golang", "https://www.reddit.com/r/golang/.rss"},
+		{"https://old.reddit.com/u/spez", "https://www.reddit.com/user/spez/.rss"},
+		{"https://www.reddit.com/r/golang/comments/abc/title", ""},
+		{"https://www.reddit.com/", ""},
+
+		// Mastodon
+		{"https://mastodon.social/@Gargron", "https://mastodon.social/@Gargron.rss"},
+		{"https://fosstodon.org/@someone", "https://fosstodon.org/@someone.rss"},
+		{"https://mastodon.social/@Gargron.rss", ""},
+		{"https://mastodon.social/@Gargron/111", ""},
+		{"https://mastodon.social/@someone@other.example", ""},
+		{"https://medium.com/@writer", ""},
+		{"https://dev.to/@writer", ""},
+		{"https://www.tiktok.com/@someone", ""},
+
+		// Unknown sites and schemes
+		{"https://example.com/blog", ""},
+		{"ftp://github.com/golang/go", ""},
+		{"not a url", ""},
+	}
+	for _, tt := range tests {
+		got, ok := RewriteFeedURL(tt.in)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("RewriteFeedURL(%q) = %q, want no rewrite", tt.in, got)
+			}
+			continue
+		}
+		if !ok || got != tt.want {
+			t.Errorf("RewriteFeedURL(%q) = %q, %v, want %q", tt.in, got, ok, tt.want)
+		}
+	}
+}
+
+const testRSS = `<?xml version="1.0"?><rss version="2.0"><channel><title>Test</title><item><title>A</title><link>http://example.com/a</link><guid>a</guid></item></channel></rss>`
+
+// TestAddFeedRewriteFallback checks that AddFeed subscribes to the URL as
+// given when the rewritten one does not serve a feed
+func TestAddFeedRewriteFallback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/feed", "/works.rss":
+			w.Header().Set("Content-Type", "application/rss+xml")
+			fmt.Fprint(w, testRSS)
+		case "/html.rss":
+			fmt.Fprint(w, "<html><body>Not a feed</body></html>")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	// Rewrites /feed?to=<path> on the test server to <path>
+	RegisterRewriter(RewriterFunc(func(u *url.URL) (string, bool) {
+		if u.Host != srvURL.Host || u.Query().Get("to") == "" {
+			return "", false
+		}
+		return srv.URL + u.Query().Get("to"), true
+	}))
+
+	db, err := database.NewDB(filepath.Join(t.TempDir(), database.DBPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m, err := NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		to   string
+		want string
+	}{
+		{"/works.rss", srv.URL + "/works.rss"},
+		{"/missing.rss", srv.URL + "/feed?to=/missing.rss"},
+		{"/html.rss", srv.URL + "/feed?to=/html.rss"},
+	}
+	for _, tt := range tests {
+		feed, err := m.AddFeed(srv.URL+"/feed?to="+tt.to, models.RequestSettings{})
+		if err != nil {
+			t.Errorf("AddFeed with rewrite to %s: %v", tt.to, err)
+			continue
+		}
+		if feed == nil || feed.URL != tt.want {
+			t.Errorf("AddFeed with rewrite to %s subscribed to %v, want %s", tt.to, feed, tt.want)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package feeds
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+
+	"deel/internal/models"
+)
+
+const (
+	// DefaultRefreshInterval is how often a feed is polled when neither the
+	// feed settings nor the publisher ask for something else
+	DefaultRefreshInterval = 30 * time.Minute
+
+	// MinRefreshInterval is the shortest interval any feed is polled at
+	MinRefreshInterval = 5 * time.Minute
+
+	// MaxRefreshInterval caps publisher hints so a feed is polled at least daily
+	MaxRefreshInterval = 24 * time.Hour
+
+	// refreshJitter is the fraction of the interval added or removed at random,
+	// so feeds added together do not stay in lockstep
+	refreshJitter = 0.1
+
+	// MaxRetryDelay caps the exponential backoff applied to failing feeds
+	MaxRetryDelay = 24 * time.Hour
+
+	// schedulerMaxWait is the longest the scheduler sleeps between checks,
+	// so changes to the feed list are picked up promptly
+	schedulerMaxWait = time.Minute
+)
+
+// RunScheduler refreshes feeds as they become due until ctx is cancelled
+func (m *Manager) RunScheduler(ctx context.Context) {
+	timer := time.NewTimer(m.untilNextRefresh())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		m.RefreshDueFeeds(ctx)
+		m.renewSubscriptions(ctx)
+		timer.Reset(m.untilNextRefresh())
+	}
+}
+
+// RetryFeed refreshes a single feed immediately, regardless of its schedule.
+// This is the only way a dead feed is polled again.
+func (m *Manager) RetryFeed(ctx context.Context, feedURL string) {
+	m.refresh(ctx, func(feed models.Feed) bool {
+		return feed.URL == feedURL
+	})
+}
+
+// RefreshDueFeeds refreshes only the feeds whose next poll time has passed
+func (m *Manager) RefreshDueFeeds(ctx context.Context) {
+	now := time.Now()
+	m.refresh(ctx, func(feed models.Feed) bool {
+		return !feed.Dead && !feed.NextRefresh.After(now)
+	})
+}
+
+// SetRefreshInterval sets the per-feed refresh interval override.
+// A zero interval reverts the feed to the global default.
+func (m *Manager) SetRefreshInterval(feedURL string, interval time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.Feeds {
+		feed := &m.Feeds[i]
+		if feed.URL != feedURL {
+			continue
+		}
+		feed.RefreshInterval = interval
+		feed.NextRefresh = m.nextRefresh(*feed, time.Now())
+		return m.DB.SaveFeed(*feed)
+	}
+	return nil
+}
+
+// untilNextRefresh returns how long the scheduler should sleep before the
+// next feed becomes due
+func (m *Manager) untilNextRefresh() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	wait := schedulerMaxWait
+	now := time.Now()
+	for _, feed := range m.Feeds {
+		if feed.Dead {
+			continue
+		}
+		if until := feed.NextRefresh.Sub(now); until < wait {
+			wait = until
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// refreshInterval returns the polling interval for a feed. A per-feed
+// override always wins; otherwise the global default is used unless the
+// publisher asked to be polled less often. Feeds whose updates are pushed
+// through WebSub are only polled daily, as a fallback.
+func (m *Manager) refreshInterval(feed models.Feed) time.Duration {
+	if feed.RefreshInterval > 0 {
+		return clampInterval(feed.RefreshInterval)
+	}
+	if feed.PushSubscribed() {
+		return MaxRefreshInterval
+	}
+
+	interval := m.RefreshInterval
+	if interval <= 0 {
+		interval = DefaultRefreshInterval
+	}
+	if feed.HintInterval > interval {
+		interval = feed.HintInterval
+	}
+	return clampInterval(interval)
+}
+
+// retryDelay returns the backoff delay for a failing feed. The delay starts
+// at the feed's normal interval and doubles with every consecutive failure.
+func (m *Manager) retryDelay(feed models.Feed) time.Duration {
+	delay := m.refreshInterval(feed)
+	for i := 1; i < feed.ConsecutiveFailures && delay < MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > MaxRetryDelay {
+		delay = MaxRetryDelay
+	}
+	return delay
+}
+
+// nextRefresh returns the jittered time at which a feed should next be
+// polled, backing off exponentially while the feed is failing
+func (m *Manager) nextRefresh(feed models.Feed, from time.Time) time.Time {
+	interval := m.refreshInterval(feed)
+	if feed.Failing() {
+		interval = m.retryDelay(feed)
+	}
+	spread := int64(float64(interval) * refreshJitter)
+	if spread > 0 {
+		interval += time.Duration(rand.Int63n(2*spread) - spread)
+	}
+	return from.Add(interval)
+}
+
+// clampInterval bounds an interval to [MinRefreshInterval, MaxRefreshInterval]
+func clampInterval(interval time.Duration) time.Duration {
+	if interval < MinRefreshInterval {
+		return MinRefreshInterval
+	}
+	if interval > MaxRefreshInterval {
+		return MaxRefreshInterval
+	}
+	return interval
+}
+
+// publisherHint returns the longest polling interval requested by the
+// publisher through RSS <ttl>, sy:updatePeriod/sy:updateFrequency or the
+// Cache-Control max-age of the response. parsedFeed may be nil.
+func publisherHint(parsedFeed *gofeed.Feed, header http.Header) time.Duration {
+	var hint time.Duration
+
+	if maxAge := cacheMaxAge(header); maxAge > hint {
+		hint = maxAge
+	}
+	if parsedFeed == nil {
+		return hint
+	}
+
+	if ttl, err := strconv.Atoi(strings.TrimSpace(parsedFeed.Custom["ttl"])); err == nil && ttl > 0 {
+		if d := time.Duration(ttl) * time.Minute; d > hint {
+			hint = d
+		}
+	}
+
+	if d := syndicationInterval(parsedFeed); d > hint {
+		hint = d
+	}
+
+	return hint
+}
+
+// syndicationInterval reads the RSS syndication module hints
+func syndicationInterval(parsedFeed *gofeed.Feed) time.Duration {
+	sy, ok := parsedFeed.Extensions["sy"]
+	if !ok {
+		return 0
+	}
+
+	var period time.Duration
+	if values := sy["updatePeriod"]; len(values) > 0 {
+		switch strings.ToLower(strings.TrimSpace(values[0].Value)) {
+		case "hourly":
+			period = time.Hour
+		case "daily":
+			period = 24 * time.Hour
+		case "weekly":
+			period = 7 * 24 * time.Hour
+		case "monthly":
+			period = 30 * 24 * time.Hour
+		case "yearly":
+			period = 365 * 24 * time.Hour
+		}
+	}
+	if period == 0 {
+		return 0
+	}
+
+	frequency := 1
+	if values := sy["updateFrequency"]; len(values) > 0 {
+		if f, err := strconv.Atoi(strings.TrimSpace(values[0].Value)); err == nil && f > 0 {
+			frequency = f
+		}
+	}
+
+	return period / time.Duration(frequency)
+}
+
+// cacheMaxAge returns the max-age directive of a Cache-Control header
+func cacheMaxAge(header http.Header) time.Duration {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(directive), "=")
+		if !found || !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 0
+}
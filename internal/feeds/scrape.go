@@ -0,0 +1,200 @@
+package feeds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+
+	"deel/internal/models"
+	"deel/internal/utils"
+)
+
+// ValidateScrapeRule checks that a scrape rule has an item selector and
+// that all of its selectors compile
+func ValidateScrapeRule(rule models.ScrapeRule) error {
+	if strings.TrimSpace(rule.Item) == "" {
+		return fmt.Errorf("the item selector is required")
+	}
+	for name, selector := range map[string]string{
+		"item":    rule.Item,
+		"title":   rule.Title,
+		"link":    rule.Link,
+		"date":    rule.Date,
+		"summary": rule.Summary,
+	} {
+		if strings.TrimSpace(selector) == "" {
+			continue
+		}
+		if _, err := cascadia.Compile(selector); err != nil {
+			return fmt.Errorf("invalid %s selector %q: %v", name, selector, err)
+		}
+	}
+	return nil
+}
+
+// PreviewScrape fetches a web page and returns its title and the items the
+// rule extracts from it, without saving anything
+func (m *Manager) PreviewScrape(ctx context.Context, pageURL string, rule models.ScrapeRule) (string, []models.FeedItem, error) {
+	if err := ValidateScrapeRule(rule); err != nil {
+		return "", nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.feedTimeout())
+	defer cancel()
+	resp, err := m.fetch(ctx, models.Feed{URL: pageURL}, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return scrapeItems(resp.Body, pageURL, rule)
+}
+
+// AddScrapedFeed subscribes to a web page through a scrape rule. Saving the
+// rule of a page that is already scraped replaces its rule.
+func (m *Manager) AddScrapedFeed(ctx context.Context, pageURL string, rule models.ScrapeRule) (*models.Feed, error) {
+	title, items, err := m.PreviewScrape(ctx, pageURL, rule)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("the selectors match no items on %s", pageURL)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var feed *models.Feed
+	for i := range m.Feeds {
+		if m.Feeds[i].URL == pageURL {
+			if m.Feeds[i].Scrape == nil {
+				return nil, fmt.Errorf("%s is already subscribed as a feed", pageURL)
+			}
+			feed = &m.Feeds[i]
+			break
+		}
+	}
+	if feed == nil {
+		m.Feeds = append(m.Feeds, models.Feed{URL: pageURL, Title: title})
+		feed = &m.Feeds[len(m.Feeds)-1]
+	}
+
+	feed.Scrape = &rule
+	feed.LastSuccess = time.Now()
+	// The next refresh must apply the new rule even if the page is unchanged
+	feed.ETag, feed.LastModified, feed.ContentHash = "", "", ""
+	feed.NextRefresh = m.nextRefresh(*feed, time.Now())
+	if err := m.DB.SaveFeed(*feed); err != nil {
+		return nil, err
+	}
+	if err := m.saveItems(feed.URL, m.admitItems(items, m.retentionPolicy(*feed), time.Now())); err != nil {
+		return nil, err
+	}
+	m.updateUnreadCounts()
+
+	saved := *feed
+	return &saved, nil
+}
+
+// scrapeItems turns a web page into feed items using a scrape rule. It
+// returns the page title along with the items.
+func scrapeItems(body []byte, pageURL string, rule models.ScrapeRule) (string, []models.FeedItem, error) {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return "", nil, err
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return "", nil, err
+	}
+	if href, ok := doc.Find("base[href]").First().Attr("href"); ok {
+		if baseHref, err := base.Parse(strings.TrimSpace(href)); err == nil {
+			base = baseHref
+		}
+	}
+
+	pageTitle := strings.TrimSpace(doc.Find("title").First().Text())
+	if pageTitle == "" {
+		pageTitle = base.Host
+	}
+
+	var items []models.FeedItem
+	seen := make(map[string]bool)
+	doc.Find(rule.Item).Each(func(_ int, container *goquery.Selection) {
+		title := collapseSpace(selectWithin(container, rule.Title).Text())
+		link := scrapedLink(container, rule.Link, base)
+		if title == "" && link == "" {
+			return
+		}
+		// Pages often repeat an item, for instance in a sidebar
+		key := link + "\x00" + title
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+
+		item := models.FeedItem{
+			ID:            utils.ItemID(pageURL, link, link, title),
+			GUID:          link,
+			Title:         title,
+			Link:          link,
+			FeedTitle:     pageTitle,
+			FeedURLOrigin: pageURL,
+		}
+		if rule.Summary != "" {
+			item.Description, _ = container.Find(rule.Summary).First().Html()
+		}
+		if rule.Date != "" {
+			date := container.Find(rule.Date).First()
+			raw, ok := date.Attr("datetime")
+			if !ok {
+				raw = collapseSpace(date.Text())
+			}
+			if published, _ := utils.ParseDate(raw); !published.IsZero() {
+				item.PublishedTime = published
+				item.Published = published.Format("Jan 2, 2006 15:04")
+			} else {
+				item.Published = raw
+			}
+		}
+		items = append(items, item)
+	})
+
+	return pageTitle, items, nil
+}
+
+// selectWithin returns the first match of selector inside container, or the
+// container itself if selector is empty
+func selectWithin(container *goquery.Selection, selector string) *goquery.Selection {
+	if strings.TrimSpace(selector) == "" {
+		return container
+	}
+	return container.Find(selector).First()
+}
+
+// scrapedLink returns the absolute item link of a container. The selected
+// element may be the link itself or contain it.
+func scrapedLink(container *goquery.Selection, selector string, base *url.URL) string {
+	selected := selectWithin(container, selector)
+	href, ok := selected.Attr("href")
+	if !ok {
+		href, ok = selected.Find("a[href]").First().Attr("href")
+	}
+	if !ok {
+		return ""
+	}
+	resolved, err := base.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return ""
+	}
+	return resolved.String()
+}
+
+// collapseSpace trims text and collapses runs of whitespace to one space
+func collapseSpace(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
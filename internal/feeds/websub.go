@@ -0,0 +1,346 @@
+package feeds
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"deel/internal/models"
+)
+
+const (
+	// WebSubPathPrefix is the path WebSub callbacks are served under
+	WebSubPathPrefix = "/websub/"
+
+	// webSubLease is the subscription lease requested from hubs
+	webSubLease = 7 * 24 * time.Hour
+
+	// webSubRenewMargin is how long before a lease expires it is renewed
+	webSubRenewMargin = time.Hour
+
+	// webSubRetryDelay is how long to wait for a hub to verify a request
+	// before asking again
+	webSubRetryDelay = 10 * time.Minute
+)
+
+// ErrUnknownSubscription is returned for WebSub callbacks that do not match
+// any subscription
+var ErrUnknownSubscription = errors.New("unknown WebSub subscription")
+
+// hubLinks returns the hub and self URLs a feed advertises through HTTP Link
+// headers or <link rel="hub"> and <link rel="self"> elements in the body.
+// Links in the header take precedence, as the WebSub spec requires.
+func hubLinks(body []byte, header http.Header) (hub, self string) {
+	for _, value := range header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			target, params, found := strings.Cut(link, ";")
+			if !found {
+				continue
+			}
+			target = strings.Trim(strings.TrimSpace(target), "<>")
+			for _, param := range strings.Split(params, ";") {
+				name, rel, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if !strings.EqualFold(name, "rel") {
+					continue
+				}
+				rel = strings.Trim(rel, `"`)
+				if hub == "" && hasToken(rel, "hub") {
+					hub = target
+				}
+				if self == "" && hasToken(rel, "self") {
+					self = target
+				}
+			}
+		}
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.Strict = false
+	for hub == "" || self == "" {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "link" {
+			continue
+		}
+		var rel, href string
+		for _, attr := range start.Attr {
+			switch attr.Name.Local {
+			case "rel":
+				rel = attr.Value
+			case "href":
+				href = strings.TrimSpace(attr.Value)
+			}
+		}
+		if href == "" {
+			continue
+		}
+		if hub == "" && hasToken(rel, "hub") {
+			hub = href
+		}
+		if self == "" && hasToken(rel, "self") {
+			self = href
+		}
+	}
+	return hub, self
+}
+
+// webSubEnabled reports whether push subscriptions can be made, which needs
+// a callback URL the hubs can reach
+func (m *Manager) webSubEnabled() bool {
+	return m.WebSubCallbackURL != ""
+}
+
+// webSubCallback returns the callback URL of a feed's subscription
+func (m *Manager) webSubCallback(feedURL string) string {
+	return strings.TrimSuffix(m.WebSubCallbackURL, "/") + "/" + feedKey(feedURL)
+}
+
+// renewSubscriptions subscribes to the hub of every feed that advertises one
+// and is not subscribed yet, and renews leases that are about to expire
+func (m *Manager) renewSubscriptions(ctx context.Context) {
+	if !m.webSubEnabled() {
+		return
+	}
+
+	now := time.Now()
+	for _, feed := range m.GetFeeds() {
+		if feed.Hub == "" || feed.Dead {
+			continue
+		}
+		if feed.HubLeaseExpiry.Sub(now) > webSubRenewMargin {
+			continue // subscribed, nothing to do yet
+		}
+		if now.Sub(feed.HubRequested) < webSubRetryDelay {
+			continue // waiting for the hub to verify the last request
+		}
+		if err := m.subscribe(ctx, feed); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Error subscribing to hub %s for feed %s: %v", feed.Hub, feed.URL, err)
+		}
+	}
+}
+
+// subscribe asks the hub of a feed to push its updates to us. The hub
+// confirms the subscription later through VerifyWebSub.
+func (m *Manager) subscribe(ctx context.Context, feed models.Feed) error {
+	secret := feed.HubSecret
+	if secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		secret = hex.EncodeToString(buf)
+	}
+
+	// Record the request first, so a failing hub is not asked again right away
+	m.mu.Lock()
+	for i := range m.Feeds {
+		if m.Feeds[i].URL == feed.URL {
+			m.Feeds[i].HubSecret = secret
+			m.Feeds[i].HubRequested = time.Now()
+			if err := m.DB.SaveFeed(m.Feeds[i]); err != nil {
+				log.Printf("Error saving subscription state for feed %s: %v", feed.URL, err)
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	return m.hubRequest(ctx, feed.Hub, url.Values{
+		"hub.mode":          {"subscribe"},
+		"hub.topic":         {feed.Topic},
+		"hub.callback":      {m.webSubCallback(feed.URL)},
+		"hub.secret":        {secret},
+		"hub.lease_seconds": {strconv.Itoa(int(webSubLease / time.Second))},
+	})
+}
+
+// unsubscribe asks the hub of a removed feed to stop pushing updates
+func (m *Manager) unsubscribe(feed models.Feed) {
+	key := feedKey(feed.URL)
+	m.mu.Lock()
+	m.unsubscribing[key] = feed.Topic
+	m.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.feedTimeout())
+	defer cancel()
+	err := m.hubRequest(ctx, feed.Hub, url.Values{
+		"hub.mode":     {"unsubscribe"},
+		"hub.topic":    {feed.Topic},
+		"hub.callback": {m.webSubCallback(feed.URL)},
+	})
+	if err != nil {
+		log.Printf("Error unsubscribing from hub %s for feed %s: %v", feed.Hub, feed.URL, err)
+	}
+}
+
+// hubRequest sends a subscription request to a hub, which must accept it
+// with a 2xx status
+func (m *Manager) hubRequest(ctx context.Context, hub string, form url.Values) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hub, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", UserAgent)
+
+	resp, err := m.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("hub rejected %s request: %s", form.Get("hub.mode"), resp.Status)
+	}
+	return nil
+}
+
+// VerifyWebSub handles the verification request a hub sends to the callback
+// identified by key. It returns the challenge to echo back when the request
+// matches a subscription we asked for.
+func (m *Manager) VerifyWebSub(key string, query url.Values) (string, error) {
+	mode := query.Get("hub.mode")
+	topic := query.Get("hub.topic")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch mode {
+	case "subscribe":
+		for i := range m.Feeds {
+			feed := &m.Feeds[i]
+			if feedKey(feed.URL) != key || feed.Topic != topic || feed.HubRequested.IsZero() {
+				continue
+			}
+			lease, err := strconv.Atoi(query.Get("hub.lease_seconds"))
+			if err != nil || lease <= 0 {
+				lease = int(webSubLease / time.Second)
+			}
+			feed.HubLeaseExpiry = time.Now().Add(time.Duration(lease) * time.Second)
+			feed.NextRefresh = m.nextRefresh(*feed, time.Now())
+			if err := m.DB.SaveFeed(*feed); err != nil {
+				log.Printf("Error saving subscription state for feed %s: %v", feed.URL, err)
+			}
+			log.Printf("Subscribed to %s through hub %s", feed.URL, feed.Hub)
+			return query.Get("hub.challenge"), nil
+		}
+
+	case "unsubscribe":
+		if pending, ok := m.unsubscribing[key]; ok && pending == topic {
+			delete(m.unsubscribing, key)
+			return query.Get("hub.challenge"), nil
+		}
+
+	case "denied":
+		for i := range m.Feeds {
+			feed := &m.Feeds[i]
+			if feedKey(feed.URL) == key && feed.Topic == topic {
+				log.Printf("Hub %s denied subscription to %s: %s", feed.Hub, feed.URL, query.Get("hub.reason"))
+				feed.HubLeaseExpiry = time.Time{}
+				if err := m.DB.SaveFeed(*feed); err != nil {
+					log.Printf("Error saving subscription state for feed %s: %v", feed.URL, err)
+				}
+				return "", nil
+			}
+		}
+	}
+
+	return "", ErrUnknownSubscription
+}
+
+// ReceiveWebSub merges the content a hub pushed to the callback identified
+// by key. Content whose signature does not match the subscription secret
+// is dropped.
+func (m *Manager) ReceiveWebSub(key string, body []byte, signature string) error {
+	m.mu.RLock()
+	var feed models.Feed
+	found := false
+	for _, f := range m.Feeds {
+		if feedKey(f.URL) == key {
+			feed, found = f, true
+			break
+		}
+	}
+	m.mu.RUnlock()
+	if !found {
+		return ErrUnknownSubscription
+	}
+
+	if feed.HubSecret == "" || !validSignature(feed.HubSecret, signature, body) {
+		return fmt.Errorf("invalid signature on content pushed for feed %s", feed.URL)
+	}
+
+	parsedFeed, err := newParser().Parse(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	items := m.admitItems(convertItems(parsedFeed, feed.URL), m.retentionPolicy(feed), time.Now())
+
+	m.mu.Lock()
+	if m.subscribed(feed.URL) {
+		if err = m.saveItems(feed.URL, items); err == nil {
+			m.updateUnreadCounts()
+		}
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	m.scheduleDownloads()
+	m.scheduleExtractions()
+	return nil
+}
+
+// validSignature checks an X-Hub-Signature header such as "sha256=<hex>"
+// against the HMAC of body
+func validSignature(secret, signature string, body []byte) bool {
+	method, digest, found := strings.Cut(signature, "=")
+	if !found {
+		return false
+	}
+
+	var newHash func() hash.Hash
+	switch strings.ToLower(method) {
+	case "sha1":
+		newHash = sha1.New
+	case "sha256":
+		newHash = sha256.New
+	case "sha384":
+		newHash = sha512.New384
+	case "sha512":
+		newHash = sha512.New
+	default:
+		return false
+	}
+
+	expected, err := hex.DecodeString(digest)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
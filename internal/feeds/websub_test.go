@@ -0,0 +1,215 @@
+package feeds
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"deel/internal/database"
+	"deel/internal/models"
+)
+
+const webSubFeed = `<?xml version="1.0"?>
+<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom"><channel><title>Pushed</title>
+<atom:link rel="self" href="%[1]s/feed"/><atom:link rel="hub" href="%[1]s/hub"/>
+<item><title>First</title><link>http://example.com/1</link><guid>1</guid></item>
+</channel></rss>`
+
+const webSubPush = `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Pushed</title>
+<item><title>Second</title><link>http://example.com/2</link><guid>2</guid></item>
+</channel></rss>`
+
+// TestWebSub runs a subscription against a hub stand-in: the subscribe
+// request, the verification challenge, signed and forged pushes, and the
+// renewal of a lease about to expire
+func TestWebSub(t *testing.T) {
+	// The publisher serves the feed, the hub records subscribe requests
+	requests := make(chan url.Values, 4)
+	var publisher *httptest.Server
+	publisher = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/feed":
+			w.Header().Set("Content-Type", "application/rss+xml")
+			fmt.Fprintf(w, webSubFeed, publisher.URL)
+		case "/hub":
+			r.ParseForm()
+			requests <- r.PostForm
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer publisher.Close()
+
+	db, err := database.NewDB(filepath.Join(t.TempDir(), database.DBPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m, err := NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The callback endpoint, routed like handlers.HandleWebSub
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, WebSubPathPrefix)
+		if r.Method == http.MethodGet {
+			challenge, err := m.VerifyWebSub(key, r.URL.Query())
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			io.WriteString(w, challenge)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := m.ReceiveWebSub(key, body, r.Header.Get("X-Hub-Signature")); errors.Is(err, ErrUnknownSubscription) {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer callback.Close()
+	m.WebSubCallbackURL = callback.URL + WebSubPathPrefix
+
+	feedURL := publisher.URL + "/feed"
+	feed, err := m.AddFeed(feedURL, models.RequestSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feed.Hub != publisher.URL+"/hub" || feed.Topic != feedURL {
+		t.Fatalf("hub %q, topic %q not discovered", feed.Hub, feed.Topic)
+	}
+
+	// Subscribe
+	m.renewSubscriptions(context.Background())
+	form := receive(t, requests)
+	if form.Get("hub.mode") != "subscribe" || form.Get("hub.topic") != feedURL || form.Get("hub.secret") == "" {
+		t.Fatalf("unexpected subscribe request %v", form)
+	}
+	secret, callbackURL := form.Get("hub.secret"), form.Get("hub.callback")
+
+	// The hub verifies the intent; a challenge for another topic is refused
+	if status, _ := verify(t, callbackURL, "http://other.example/feed", "3600"); status != http.StatusNotFound {
+		t.Errorf("verification of another topic answered %d, want 404", status)
+	}
+	status, body := verify(t, callbackURL, feedURL, "3600")
+	if status != http.StatusOK || body != "challenge-token" {
+		t.Fatalf("verification answered %d %q, want the challenge echoed", status, body)
+	}
+	if lease := findFeed(m, feedURL).HubLeaseExpiry; time.Until(lease) < 59*time.Minute {
+		t.Errorf("lease expires at %v, want in an hour", lease)
+	}
+
+	// Pushed content is merged only with a valid signature
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(webSubPush))
+	for _, tt := range []struct {
+		signature string
+		items     int
+	}{
+		{"", 1},
+		{"sha256=" + strings.Repeat("00", 32), 1},
+		{"sha256=" + hex.EncodeToString(mac.Sum(nil)), 2},
+	} {
+		push(t, callbackURL, tt.signature)
+		items, err := db.LoadFeedItems(feedURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != tt.items {
+			t.Errorf("after push signed %q: %d items, want %d", tt.signature, len(items), tt.items)
+		}
+	}
+
+	// A valid lease is not renewed; one about to expire is, with the same
+	// secret, once the retry delay has passed
+	m.renewSubscriptions(context.Background())
+	select {
+	case form := <-requests:
+		t.Fatalf("unexpected request %v while the lease is valid", form)
+	default:
+	}
+	verify(t, callbackURL, feedURL, "60")
+	m.mu.Lock()
+	for i := range m.Feeds {
+		m.Feeds[i].HubRequested = time.Now().Add(-webSubRetryDelay - time.Minute)
+	}
+	m.mu.Unlock()
+	m.renewSubscriptions(context.Background())
+	form = receive(t, requests)
+	if form.Get("hub.mode") != "subscribe" || form.Get("hub.secret") != secret {
+		t.Errorf("unexpected renewal request %v", form)
+	}
+}
+
+// receive waits for a request to reach the hub
+func receive(t *testing.T, requests <-chan url.Values) url.Values {
+	t.Helper()
+	select {
+	case form := <-requests:
+		return form
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request reached the hub")
+		return nil
+	}
+}
+
+// verify sends the hub's verification of a subscription to the callback
+func verify(t *testing.T, callbackURL, topic, lease string) (int, string) {
+	t.Helper()
+	query := url.Values{
+		"hub.mode":          {"subscribe"},
+		"hub.topic":         {topic},
+		"hub.challenge":     {"challenge-token"},
+		"hub.lease_seconds": {lease},
+	}
+	resp, err := http.Get(callbackURL + "?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// push sends webSubPush to the callback as the hub would
+func push(t *testing.T, callbackURL, signature string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, callbackURL, strings.NewReader(webSubPush))
+	req.Header.Set("Content-Type", "application/rss+xml")
+	if signature != "" {
+		req.Header.Set("X-Hub-Signature", signature)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("push answered %d, want 202", resp.StatusCode)
+	}
+}
+
+// findFeed returns the subscribed feed with the given URL
+func findFeed(m *Manager, feedURL string) models.Feed {
+	for _, feed := range m.GetFeeds() {
+		if feed.URL == feedURL {
+			return feed
+		}
+	}
+	return models.Feed{}
+}
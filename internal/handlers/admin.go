@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"deel/internal/database"
+)
+
+// HandleBackup streams a consistent snapshot of the database while the
+// server keeps running. The key file encrypting the request settings is
+// not part of it. It requires the admin token.
+func (h *Handler) HandleBackup(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	db := h.FeedManager.DB
+	ext := ".db"
+	if db.Backend() == database.SQLiteBackend {
+		ext = ".sqlite"
+	}
+	name := "rss_feeds-" + time.Now().Format("20060102-150405") + ext
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("Cache-Control", "no-store")
+
+	// Once streaming has started the status cannot change; a failure cuts
+	// the download short, which the restore validation detects
+	if _, err := db.Snapshot(w); err != nil {
+		log.Printf("Error streaming database backup: %v", err)
+	}
+}
+
+// maintenanceActions maps the actions of the admin page to the maintenance
+// they run, like "deel db"
+var maintenanceActions = map[string]database.MaintenanceOptions{
+	"check":   {},
+	"gc":      {CollectGarbage: true},
+	"compact": {CollectGarbage: true, Compact: true},
+}
+
+// AdminPageData holds the data for the admin page
+type AdminPageData struct {
+	Backend string
+	Path    string
+	Report  *database.MaintenanceReport // last maintenance run, nil if none ran
+	Error   string                      // error of the last maintenance run
+}
+
+// HandleAdmin shows the admin page with the result of the last maintenance
+// run. It requires the admin token.
+func (h *Handler) HandleAdmin(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	h.maintenanceMu.Lock()
+	data := AdminPageData{
+		Backend: h.FeedManager.DB.Backend(),
+		Path:    h.FeedManager.DB.Path(),
+		Report:  h.lastMaintenance,
+		Error:   h.lastMaintenanceError,
+	}
+	h.maintenanceMu.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := h.Templates.ExecuteTemplate(w, "admin.html", data); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, "Failed to render page", http.StatusInternalServerError)
+	}
+}
+
+// HandleMaintenance runs a maintenance action on the database and shows
+// its report on the admin page. Runs are serialized. It requires the admin
+// token.
+func (h *Handler) HandleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Browsers resend basic auth credentials with forms posted from other
+	// sites, so only accept them from our own pages
+	if origin, err := url.Parse(r.Header.Get("Origin")); err == nil && origin.Host != "" && origin.Host != r.Host {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	options, ok := maintenanceActions[r.FormValue("action")]
+	if !ok {
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	h.maintenanceMu.Lock()
+	report, err := database.RunMaintenance(h.FeedManager.DB, options)
+	h.lastMaintenance, h.lastMaintenanceError = &report, ""
+	if err != nil {
+		log.Printf("Error maintaining database: %v", err)
+		h.lastMaintenanceError = err.Error()
+	}
+	h.maintenanceMu.Unlock()
+	for _, line := range report.Lines() {
+		log.Printf("Database maintenance: %s", line)
+	}
+
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// authorizeAdmin checks the admin token, given as a bearer token or as the
+// password of basic auth so browsers can prompt for it. It writes the error
+// response and returns false if the request may not proceed.
+func (h *Handler) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if h.AdminToken == "" {
+		http.NotFound(w, r)
+		return false
+	}
+
+	var token string
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = strings.TrimSpace(bearer)
+	} else if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="deel admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
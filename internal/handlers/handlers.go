@@ -2,20 +2,38 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"golang.org/x/net/http/httpguts"
+
+	"deel/internal/database"
 	"deel/internal/feeds"
 	"deel/internal/models"
 )
 
-// Handler encapsulates the dependencies for HTTP handlers
+// maxPushSize limits the size of content pushed by a WebSub hub
+const maxPushSize = 10 << 20
+
+// Handler encapsulates the dependencies for HTTP handlers.
+// The feed manager does its own locking, so handlers can run concurrently.
 type Handler struct {
 	FeedManager *feeds.Manager
 	Templates   *template.Template
-	Mutex       *sync.Mutex
+	AdminToken  string // password of the admin endpoints, which are disabled if empty
+
+	maintenanceMu        sync.Mutex                  // serializes maintenance runs
+	lastMaintenance      *database.MaintenanceReport // shown on the admin page
+	lastMaintenanceError string
 }
 
 // NewHandler creates a new Handler
@@ -23,15 +41,11 @@ func NewHandler(feedManager *feeds.Manager, templates *template.Template) *Handl
 	return &Handler{
 		FeedManager: feedManager,
 		Templates:   templates,
-		Mutex:       &sync.Mutex{},
 	}
 }
 
 // HandleIndex handles the index page request
 func (h *Handler) HandleIndex(w http.ResponseWriter, r *http.Request) {
-	h.Mutex.Lock()
-	defer h.Mutex.Unlock()
-
 	currentFilter := r.URL.Query().Get("filter") // read/unread/favorites filter
 	if currentFilter == "" {
 		currentFilter = "all"
@@ -41,11 +55,21 @@ func (h *Handler) HandleIndex(w http.ResponseWriter, r *http.Request) {
 	itemsToDisplay := h.FeedManager.GetFilteredItems(currentFilter, currentFeedURLFilter)
 
 	data := models.PageData{
-		Feeds:          h.FeedManager.Feeds,
+		Feeds:          h.FeedManager.GetFeeds(),
 		FeedItems:      itemsToDisplay,
 		Filter:         currentFilter,
 		BaseURL:        r.URL.Path, 
 		CurrentFeedURL: currentFeedURLFilter,
+		Downloads:      h.FeedManager.Downloads != nil,
+	}
+
+	// Open the scrape form on the rule of a scraped feed to edit it
+	if scrapeURL := r.URL.Query().Get("scrape"); scrapeURL != "" {
+		for _, feed := range data.Feeds {
+			if feed.URL == scrapeURL && feed.Scrape != nil {
+				data.Scrape = models.ScrapePreview{PageURL: feed.URL, Rule: *feed.Scrape}
+			}
+		}
 	}
 	
 	err := h.Templates.ExecuteTemplate(w, "index.html", data)
@@ -65,23 +89,48 @@ func (h *Handler) HandleAddFeed(w http.ResponseWriter, r *http.Request) {
 	feedURL := r.FormValue("feed_url")
 	if feedURL == "" {
 		data := models.PageData{
-			Feeds:     h.FeedManager.Feeds,
-			FeedItems: h.FeedManager.FeedItems,
+			Feeds:     h.FeedManager.GetFeeds(),
+			FeedItems: h.FeedManager.GetFilteredItems("all", ""),
 			Error:     "Feed URL cannot be empty",
 		}
 		h.Templates.ExecuteTemplate(w, "index.html", data)
 		return
 	}
 
-	h.Mutex.Lock()
-	feed, err := h.FeedManager.AddFeed(feedURL)
-	h.Mutex.Unlock()
+	settings, err := requestSettingsFromForm(r)
+	if err != nil {
+		data := models.PageData{
+			Feeds:     h.FeedManager.GetFeeds(),
+			FeedItems: h.FeedManager.GetFilteredItems("all", ""),
+			Error:     err.Error(),
+		}
+		h.Templates.ExecuteTemplate(w, "index.html", data)
+		return
+	}
 
+	feed, err := h.FeedManager.AddFeed(feedURL, settings)
+
+	var multipleFeeds *feeds.MultipleFeedsError
+	if errors.As(err, &multipleFeeds) {
+		// Let the user pick one of the feeds advertised by the page
+		data := models.PageData{
+			Feeds:          h.FeedManager.GetFeeds(),
+			FeedItems:      h.FeedManager.GetFilteredItems("all", ""),
+			FeedCandidates: multipleFeeds.Candidates,
+		}
+		h.Templates.ExecuteTemplate(w, "index.html", data)
+		return
+	}
 	if err != nil {
+		message := "Failed to parse feed: " + err.Error()
+		var policyErr *feeds.PolicyError
+		if errors.As(err, &policyErr) {
+			message = "Feed refused: " + policyErr.Error()
+		}
 		data := models.PageData{
-			Feeds:     h.FeedManager.Feeds,
-			FeedItems: h.FeedManager.FeedItems,
-			Error:     "Failed to parse feed: " + err.Error(),
+			Feeds:     h.FeedManager.GetFeeds(),
+			FeedItems: h.FeedManager.GetFilteredItems("all", ""),
+			Error:     message,
 		}
 		h.Templates.ExecuteTemplate(w, "index.html", data)
 		return
@@ -96,11 +145,60 @@ func (h *Handler) HandleAddFeed(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// HandleScrape handles the scrape form. The "preview" action shows the
+// items the selectors extract; the "save" action subscribes to the page.
+func (h *Handler) HandleScrape(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	preview := models.ScrapePreview{
+		PageURL: strings.TrimSpace(r.FormValue("page_url")),
+		Rule: models.ScrapeRule{
+			Item:    strings.TrimSpace(r.FormValue("item")),
+			Title:   strings.TrimSpace(r.FormValue("title")),
+			Link:    strings.TrimSpace(r.FormValue("link")),
+			Date:    strings.TrimSpace(r.FormValue("date")),
+			Summary: strings.TrimSpace(r.FormValue("summary")),
+		},
+	}
+
+	var err error
+	if preview.PageURL == "" {
+		err = errors.New("page URL cannot be empty")
+	} else if r.FormValue("action") == "save" {
+		if _, err = h.FeedManager.AddScrapedFeed(r.Context(), preview.PageURL, preview.Rule); err == nil {
+			http.Redirect(w, r, "/?feedURL="+url.QueryEscape(preview.PageURL), http.StatusSeeOther)
+			return
+		}
+	} else {
+		preview.Title, preview.Items, err = h.FeedManager.PreviewScrape(r.Context(), preview.PageURL, preview.Rule)
+		if err == nil && len(preview.Items) == 0 {
+			err = errors.New("the selectors match no items")
+		}
+	}
+	if err != nil {
+		preview.Error = err.Error()
+	}
+
+	data := models.PageData{
+		Feeds:     h.FeedManager.GetFeeds(),
+		FeedItems: h.FeedManager.GetFilteredItems("all", ""),
+		Filter:    "all",
+		BaseURL:   "/",
+		Downloads: h.FeedManager.Downloads != nil,
+		Scrape:    preview,
+	}
+	if err := h.Templates.ExecuteTemplate(w, "index.html", data); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, "Failed to render page", http.StatusInternalServerError)
+	}
+}
+
 // HandleRefresh handles refreshing the feeds
 func (h *Handler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
-	h.Mutex.Lock()
-	h.FeedManager.RefreshFeeds()
-	h.Mutex.Unlock()
+	h.FeedManager.RefreshFeeds(r.Context())
 	
 	http.Redirect(w, r, r.Header.Get("Referer"), http.StatusSeeOther) // Redirect back, preserving filters
 }
@@ -114,14 +212,248 @@ func (h *Handler) HandleRemoveFeed(w http.ResponseWriter, r *http.Request) {
 
 	feedURL := r.FormValue("feed_url")
 	if feedURL != "" {
-		h.Mutex.Lock()
 		h.FeedManager.RemoveFeed(feedURL)
-		h.Mutex.Unlock()
 	}
 
 	http.Redirect(w, r, r.Header.Get("Referer"), http.StatusSeeOther) // Redirect back
 }
 
+// HandleRetryFeed handles refreshing a single feed on demand
+func (h *Handler) HandleRetryFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	feedURL := r.FormValue("feed_url")
+	if feedURL != "" {
+		h.FeedManager.RetryFeed(r.Context(), feedURL)
+	}
+
+	http.Redirect(w, r, r.Header.Get("Referer"), http.StatusSeeOther) // Redirect back
+}
+
+// HandleSetRefreshInterval handles changing the refresh interval of a feed
+func (h *Handler) HandleSetRefreshInterval(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	feedURL := r.FormValue("feed_url")
+	minutes, err := strconv.Atoi(r.FormValue("interval"))
+	if feedURL == "" || err != nil || minutes < 0 {
+		http.Error(w, "Invalid refresh interval", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.FeedManager.SetRefreshInterval(feedURL, time.Duration(minutes)*time.Minute); err != nil {
+		log.Printf("Error setting refresh interval for %s: %v", feedURL, err)
+	}
+
+	http.Redirect(w, r, r.Header.Get("Referer"), http.StatusSeeOther) // Redirect back
+}
+
+// HandleSetRequestSettings handles changing the HTTP settings of a feed
+func (h *Handler) HandleSetRequestSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	feedURL := r.FormValue("feed_url")
+	settings, err := requestSettingsFromForm(r)
+	if feedURL == "" || err != nil {
+		http.Error(w, "Invalid request settings", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.FeedManager.SetRequestSettings(feedURL, settings); err != nil {
+		log.Printf("Error setting request settings for %s: %v", feedURL, err)
+	}
+
+	http.Redirect(w, r, r.Header.Get("Referer"), http.StatusSeeOther) // Redirect back
+}
+
+// HandleSetKeepEpisodes handles changing how many episodes of a feed are
+// kept downloaded
+func (h *Handler) HandleSetKeepEpisodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	feedURL := r.FormValue("feed_url")
+	keep, err := strconv.Atoi(r.FormValue("keep"))
+	if feedURL == "" || err != nil || keep < 0 {
+		http.Error(w, "Invalid number of episodes", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.FeedManager.SetKeepEpisodes(feedURL, keep); err != nil {
+		log.Printf("Error setting kept episodes for %s: %v", feedURL, err)
+	}
+
+	http.Redirect(w, r, r.Header.Get("Referer"), http.StatusSeeOther) // Redirect back
+}
+
+// HandleSetMarkUpdatedUnread handles changing whether read items of a feed
+// are marked unread again when the publisher edits them
+func (h *Handler) HandleSetMarkUpdatedUnread(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	feedURL := r.FormValue("feed_url")
+	if feedURL == "" {
+		http.Error(w, "Missing feed URL", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.FeedManager.SetMarkUpdatedUnread(feedURL, r.FormValue("mark_unread") != ""); err != nil {
+		log.Printf("Error setting updated item handling for %s: %v", feedURL, err)
+	}
+
+	http.Redirect(w, r, r.Header.Get("Referer"), http.StatusSeeOther) // Redirect back
+}
+
+// HandleSetFetchFullContent handles changing whether the full text of a
+// feed's articles is extracted
+func (h *Handler) HandleSetFetchFullContent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	feedURL := r.FormValue("feed_url")
+	if feedURL == "" {
+		http.Error(w, "Missing feed URL", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.FeedManager.SetFetchFullContent(feedURL, r.FormValue("full_content") != ""); err != nil {
+		log.Printf("Error setting full content fetching for %s: %v", feedURL, err)
+	}
+
+	http.Redirect(w, r, r.Header.Get("Referer"), http.StatusSeeOther) // Redirect back
+}
+
+// HandleExtractItem handles extracting the full text of a single article
+// again, on demand
+func (h *Handler) HandleExtractItem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	feedURL := r.FormValue("feed_url")
+	itemID := r.FormValue("item_id")
+	if feedURL == "" || itemID == "" {
+		http.Error(w, "Missing feed URL or item ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.FeedManager.ExtractItem(r.Context(), feedURL, itemID); err != nil {
+		log.Printf("Error extracting item %s of %s: %v", itemID, feedURL, err)
+	}
+
+	http.Redirect(w, r, r.Header.Get("Referer"), http.StatusSeeOther) // Redirect back
+}
+
+// HandleSetRetention handles changing the retention policy of a feed.
+// Resetting reverts the feed to the global policy.
+func (h *Handler) HandleSetRetention(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	feedURL := r.FormValue("feed_url")
+	if feedURL == "" {
+		http.Error(w, "Invalid retention policy", http.StatusBadRequest)
+		return
+	}
+
+	var policy *models.RetentionPolicy
+	if r.FormValue("reset") == "" {
+		maxItems, itemsErr := optionalCount(r.FormValue("max_items"))
+		maxAgeDays, daysErr := optionalCount(r.FormValue("max_age_days"))
+		if itemsErr != nil || daysErr != nil {
+			http.Error(w, "Invalid retention policy", http.StatusBadRequest)
+			return
+		}
+		policy = &models.RetentionPolicy{
+			MaxItems:   maxItems,
+			MaxAgeDays: maxAgeDays,
+			KeepUnread: r.FormValue("keep_unread") != "",
+		}
+	}
+
+	if err := h.FeedManager.SetRetention(feedURL, policy); err != nil {
+		log.Printf("Error setting retention policy for %s: %v", feedURL, err)
+	}
+
+	http.Redirect(w, r, r.Header.Get("Referer"), http.StatusSeeOther) // Redirect back
+}
+
+// HandleMedia serves downloaded podcast episodes. Range requests are
+// supported so the browser can seek during playback.
+func (h *Handler) HandleMedia(w http.ResponseWriter, r *http.Request) {
+	downloads := h.FeedManager.Downloads
+	if downloads == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, info, err := downloads.Open(strings.TrimPrefix(r.URL.Path, feeds.MediaURLPrefix))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// HandleWebSub is the callback WebSub hubs talk to. GET requests verify a
+// subscription by echoing the hub's challenge; POST requests push content.
+func (h *Handler) HandleWebSub(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, feeds.WebSubPathPrefix)
+
+	switch r.Method {
+	case http.MethodGet:
+		challenge, err := h.FeedManager.VerifyWebSub(key, r.URL.Query())
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(challenge))
+
+	case http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxPushSize))
+		if err != nil {
+			http.Error(w, "Failed to read content", http.StatusBadRequest)
+			return
+		}
+		err = h.FeedManager.ReceiveWebSub(key, body, r.Header.Get("X-Hub-Signature"))
+		if errors.Is(err, feeds.ErrUnknownSubscription) {
+			// Tells the hub to drop the subscription
+			http.Error(w, "Unknown subscription", http.StatusGone)
+			return
+		}
+		if err != nil {
+			// The hub is not to blame for content we cannot use, so it gets a 2xx either way
+			log.Printf("Error handling pushed content: %v", err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 // HandleToggleFavorite handles toggling the favorite status of a feed item
 func (h *Handler) HandleToggleFavorite(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -129,15 +461,13 @@ func (h *Handler) HandleToggleFavorite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	itemLink := r.FormValue("link")
-	if itemLink == "" {
-		http.Error(w, "Missing item link", http.StatusBadRequest)
+	itemID := r.FormValue("id")
+	if itemID == "" {
+		http.Error(w, "Missing item id", http.StatusBadRequest)
 		return
 	}
 
-	h.Mutex.Lock()
-	err := h.FeedManager.ToggleFavoriteStatus(itemLink)
-	h.Mutex.Unlock()
+	err := h.FeedManager.ToggleFavoriteStatus(itemID)
 
 	if err != nil {
 		log.Printf("Error toggling favorite status in handler: %v", err)
@@ -159,18 +489,16 @@ func (h *Handler) HandleToggleReadStatus(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	itemLink := r.FormValue("link")
-	if itemLink == "" {
-		http.Redirect(w, r, r.Header.Get("Referer"), http.StatusSeeOther) // Redirect back if link is missing
+	itemID := r.FormValue("id")
+	if itemID == "" {
+		http.Redirect(w, r, r.Header.Get("Referer"), http.StatusSeeOther) // Redirect back if id is missing
 		return
 	}
 
-	h.Mutex.Lock()
-	err := h.FeedManager.ToggleReadStatus(itemLink)
-	h.Mutex.Unlock()
+	err := h.FeedManager.ToggleReadStatus(itemID)
 
 	if err != nil {
-		log.Printf("Error toggling read status for %s: %v", itemLink, err)
+		log.Printf("Error toggling read status for %s: %v", itemID, err)
 	}
 
 	http.Redirect(w, r, r.Header.Get("Referer"), http.StatusSeeOther) // Redirect back to the previous page
@@ -183,9 +511,59 @@ func (h *Handler) HandleMarkAllRead(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.Mutex.Lock()
 	h.FeedManager.MarkAllRead()
-	h.Mutex.Unlock()
 
 	http.Redirect(w, r, r.Header.Get("Referer"), http.StatusSeeOther)
 }
+
+// requestSettingsFromForm reads the optional per-feed HTTP settings of the
+// add and settings forms. Headers are given one "Name: value" per line.
+func requestSettingsFromForm(r *http.Request) (models.RequestSettings, error) {
+	settings := models.RequestSettings{
+		UserAgent: strings.TrimSpace(r.FormValue("user_agent")),
+		Cookies:   strings.TrimSpace(r.FormValue("cookies")),
+		Username:  strings.TrimSpace(r.FormValue("username")),
+		Password:  r.FormValue("password"),
+		Proxy:     strings.TrimSpace(r.FormValue("proxy")),
+	}
+	if settings.Proxy != "" {
+		if _, err := feeds.ParseProxyURL(settings.Proxy); err != nil {
+			return settings, fmt.Errorf("invalid proxy: %v", err)
+		}
+	}
+
+	for _, line := range strings.Split(r.FormValue("headers"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+		if !found || !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return settings, fmt.Errorf("invalid header line %q, expected \"Name: value\"", line)
+		}
+		if settings.Headers == nil {
+			settings.Headers = make(map[string]string)
+		}
+		settings.Headers[http.CanonicalHeaderKey(name)] = value
+	}
+
+	if !httpguts.ValidHeaderFieldValue(settings.UserAgent) || !httpguts.ValidHeaderFieldValue(settings.Cookies) {
+		return settings, errors.New("invalid user agent or cookies")
+	}
+	return settings, nil
+}
+
+// optionalCount parses a non-negative form number, treating an empty value as zero
+func optionalCount(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid count %q", value)
+	}
+	return n, nil
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"html"
+	"html/template"
+	"strings"
+
+	"deel/internal/models"
+	"deel/internal/utils"
+)
+
+// TemplateFuncs returns the helper functions available to the templates.
+// They must be registered before the templates are parsed.
+func TemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		// sanitize renders untrusted feed HTML after reducing it to a safe subset
+		"sanitize": func(s string) template.HTML {
+			return template.HTML(utils.SanitizeHTML(s))
+		},
+		// wordDiff shows the words of an item that changed since the revision
+		"wordDiff": func(previous *models.ItemRevision, item models.FeedItem) template.HTML {
+			before := revisionText(previous.Title, previous.Description, previous.Content)
+			after := revisionText(item.Title, item.Description, item.Content)
+			return renderDiff(utils.WordDiff(before, after))
+		},
+	}
+}
+
+// revisionText returns the plain text of an item version for diffing
+func revisionText(title, description, content string) string {
+	body := content
+	if body == "" {
+		body = description
+	}
+	return title + "\n" + utils.HTMLText(body)
+}
+
+// renderDiff marks removed words with <del> and added words with <ins>
+func renderDiff(parts []utils.DiffPart) template.HTML {
+	var out strings.Builder
+	for i, part := range parts {
+		if i > 0 {
+			out.WriteString(" ")
+		}
+		text := html.EscapeString(part.Text)
+		switch part.Op {
+		case utils.DiffDelete:
+			out.WriteString("<del>" + text + "</del>")
+		case utils.DiffInsert:
+			out.WriteString("<ins>" + text + "</ins>")
+		default:
+			out.WriteString(text)
+		}
+	}
+	return template.HTML(out.String())
+}
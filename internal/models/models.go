@@ -1,26 +1,256 @@
 // Package models defines data structures for the RSS reader application
 package models
 
-import "time"
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
 
 // Feed represents an RSS feed
 type Feed struct {
 	URL         string
 	Title       string
 	UnreadCount int // Number of unread items for this feed
+
+	// HTTP cache validators from the last successful fetch
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+	ContentHash  string `json:",omitempty"` // hex encoded SHA-256 of the last body
+
+	// Refresh scheduling
+	RefreshInterval time.Duration `json:",omitempty"` // per-feed override, zero uses the global default
+	HintInterval    time.Duration `json:",omitempty"` // polling interval requested by the publisher
+	NextRefresh     time.Time     // when the scheduler should next poll this feed
+
+	// Health tracking
+	ConsecutiveFailures int       `json:",omitempty"` // failed refreshes since the last success
+	LastError           string    `json:",omitempty"` // error from the most recent failed refresh
+	LastSuccess         time.Time // time of the most recent successful refresh
+	LastStatus          int       `json:",omitempty"` // HTTP status of the most recent fetch, zero if none was received
+	Dead                bool      `json:",omitempty"` // the publisher retired the feed (410 Gone), it is no longer polled
+
+	// WebSub push subscription
+	Hub            string    `json:",omitempty"` // hub advertised by the feed, empty if it can only be polled
+	Topic          string    `json:",omitempty"` // URL the feed is published under at the hub
+	HubSecret      string    `json:",omitempty"` // HMAC secret shared with the hub
+	HubRequested   time.Time // when a subscription was last requested from the hub
+	HubLeaseExpiry time.Time // when the verified subscription lapses, zero if not subscribed
+
+	// Scrape is set for web pages without a feed, whose items are scraped
+	// with CSS selectors
+	Scrape *ScrapeRule `json:",omitempty"`
+
+	// Request holds the optional HTTP settings used on every fetch. It may
+	// carry credentials, so it is stored encrypted apart from the feed.
+	Request RequestSettings `json:"-"`
+
+	// Podcast downloads
+	KeepEpisodes int `json:",omitempty"` // most recent episodes kept downloaded, zero disables downloads for the feed
+
+	// FetchFullContent downloads each item's article and shows its extracted
+	// main text in place of the summary
+	FetchFullContent bool `json:",omitempty"`
+
+	// MarkUpdatedUnread marks read items unread again when the publisher edits them
+	MarkUpdatedUnread bool `json:",omitempty"`
+
+	// Retention overrides the global retention policy, nil uses the global one
+	Retention *RetentionPolicy `json:",omitempty"`
+}
+
+// RetentionPolicy decides which stored items are pruned. Favorites are
+// never pruned, and a zero limit does not prune anything.
+type RetentionPolicy struct {
+	MaxItems   int  `json:",omitempty"` // newest items kept per feed
+	MaxAgeDays int  `json:",omitempty"` // items published longer ago are pruned
+	KeepUnread bool `json:",omitempty"` // unread items are kept regardless of the limits
+}
+
+// Prunes reports whether the policy prunes anything
+func (p RetentionPolicy) Prunes() bool {
+	return p.MaxItems > 0 || p.MaxAgeDays > 0
+}
+
+// Cutoff returns the publish time before which items are pruned, zero if
+// items are not pruned by age
+func (p RetentionPolicy) Cutoff(now time.Time) time.Time {
+	if p.MaxAgeDays <= 0 {
+		return time.Time{}
+	}
+	return now.AddDate(0, 0, -p.MaxAgeDays)
+}
+
+// ScrapeRule describes how to turn a web page into feed items with goquery
+// CSS selectors. All selectors but Item are relative to the item container.
+type ScrapeRule struct {
+	Item    string // selects each item container
+	Title   string // item title, the container text if empty
+	Link    string // element holding or containing the item link, the first link in the container if empty
+	Date    string `json:",omitempty"` // item date, read from a datetime attribute or the text; optional
+	Summary string `json:",omitempty"` // item summary HTML; optional
+}
+
+// ScrapePreview holds the scrape form along with the items it extracts
+type ScrapePreview struct {
+	PageURL string
+	Rule    ScrapeRule
+	Title   string     // page title
+	Items   []FeedItem // items extracted by Rule, nil until previewed
+	Error   string
+}
+
+// RequestSettings are optional HTTP settings for fetching a feed
+type RequestSettings struct {
+	UserAgent string            `json:",omitempty"` // replaces the default User-Agent
+	Headers   map[string]string `json:",omitempty"` // extra request headers, such as an API token
+	Cookies   string            `json:",omitempty"` // sent as the Cookie header
+	Username  string            `json:",omitempty"` // HTTP basic auth user, basic auth is off if empty
+	Password  string            `json:",omitempty"` // HTTP basic auth password
+	Proxy     string            `json:",omitempty"` // http, https or socks5 proxy for this feed, overrides the global proxy
+}
+
+// Empty reports whether no setting is configured
+func (s RequestSettings) Empty() bool {
+	return s.UserAgent == "" && len(s.Headers) == 0 && s.Cookies == "" && s.Username == "" && s.Password == "" && s.Proxy == ""
+}
+
+// HeaderLines returns the extra headers as "Name: value" lines, sorted by name
+func (s RequestSettings) HeaderLines() string {
+	names := make([]string, 0, len(s.Headers))
+	for name := range s.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s: %s\n", name, s.Headers[name])
+	}
+	return b.String()
+}
+
+// Failing reports whether the most recent refresh of the feed failed
+func (f Feed) Failing() bool {
+	return f.ConsecutiveFailures > 0
+}
+
+// PushSubscribed reports whether the hub of the feed pushes its updates
+func (f Feed) PushSubscribed() bool {
+	return f.Hub != "" && f.HubLeaseExpiry.After(time.Now())
+}
+
+// RefreshIntervalMinutes returns the per-feed refresh override in minutes
+func (f Feed) RefreshIntervalMinutes() int {
+	return int(f.RefreshInterval / time.Minute)
 }
 
 // FeedItem represents an item from an RSS feed
 type FeedItem struct {
+	ID            string // stable identifier, see utils.ItemID
+	GUID          string // RSS guid or Atom id, empty if the feed has none
 	Title         string
 	Link          string
 	Description   string
+	Content       string    // full content (e.g. content:encoded), empty if the feed only has a summary
+	Authors       []string  // display names of the authors
+	Categories    []string
+	Enclosures    []Enclosure
+	ImageURL      string    // lead image, empty if the item has none
 	Published     string    // formatted for display
 	FeedTitle     string
 	PublishedTime time.Time // used for sorting, not shown in template
-	Read          bool      // true if read, false if unread
-	Favorite      bool      // true if favorited
+	UpdatedTime   time.Time // last update reported by the feed, zero if none
+	Read          bool      `json:"-"` // true if read, false if unread; stored in its own bucket
+	Favorite      bool      `json:"-"` // true if favorited; stored in its own bucket
 	FeedURLOrigin string    // URL of the feed this item came from
+
+	// Full text extracted from the article at Link, see Feed.FetchFullContent
+	FullContent     string `json:"-"` // cached in its own bucket
+	ExtractionError string `json:"-"` // why the last extraction failed
+
+	// Edits by the publisher
+	ContentHash string        `json:",omitempty"` // see utils.ContentHash
+	Previous    *ItemRevision `json:",omitempty"` // version the reader had read before the item changed, nil if unchanged
+}
+
+// Extraction is the cached result of extracting the full text of an
+// item's article
+type Extraction struct {
+	Content   string `json:",omitempty"` // HTML of the main article body
+	Error     string `json:",omitempty"` // set if extraction failed
+	Extracted time.Time
+}
+
+// ItemRevision is an earlier version of a feed item that was edited after
+// it had been read
+type ItemRevision struct {
+	Title       string
+	Description string
+	Content     string    `json:",omitempty"`
+	Replaced    time.Time // when the change was noticed
+}
+
+// FeedCandidate is a feed discovered on a web page
+type FeedCandidate struct {
+	URL   string
+	Title string // title attribute of the advertising <link>, may be empty
+	Type  string // MIME type advertised for the feed, may be empty
+}
+
+// Enclosure is a file attached to a feed item, such as a podcast episode
+type Enclosure struct {
+	URL      string
+	Type     string        // MIME type
+	Length   int64         // size in bytes, zero if unknown
+	Duration time.Duration `json:",omitempty"` // playing time from itunes:duration, zero if unknown
+	LocalURL string        `json:"-"`          // URL of the downloaded copy, empty if not downloaded
+}
+
+// IsAudio reports whether the enclosure is an audio file
+func (e Enclosure) IsAudio() bool {
+	return strings.HasPrefix(e.Type, "audio/")
+}
+
+// IsVideo reports whether the enclosure is a video file
+func (e Enclosure) IsVideo() bool {
+	return strings.HasPrefix(e.Type, "video/")
+}
+
+// IsMedia reports whether the enclosure can be played as a podcast episode
+func (e Enclosure) IsMedia() bool {
+	return e.IsAudio() || e.IsVideo()
+}
+
+// PlaybackURL returns the downloaded copy of the enclosure if there is one,
+// otherwise the original URL
+func (e Enclosure) PlaybackURL() string {
+	if e.LocalURL != "" {
+		return e.LocalURL
+	}
+	return e.URL
+}
+
+// FormattedDuration returns the duration as h:mm:ss or m:ss, empty if unknown
+func (e Enclosure) FormattedDuration() string {
+	if e.Duration <= 0 {
+		return ""
+	}
+	total := int(e.Duration / time.Second)
+	hours, minutes, seconds := total/3600, total/60%60, total%60
+	if hours > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", hours, minutes, seconds)
+	}
+	return fmt.Sprintf("%d:%02d", minutes, seconds)
+}
+
+// FormattedLength returns the size in megabytes, empty if unknown
+func (e Enclosure) FormattedLength() string {
+	if e.Length <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%.1f MB", float64(e.Length)/(1<<20))
 }
 
 // PageData holds the data for our templates
@@ -31,4 +261,7 @@ type PageData struct {
 	Filter         string // "all" or "unread"
 	BaseURL        string // e.g., "/"
 	CurrentFeedURL string // To highlight the active feed filter
+	FeedCandidates []FeedCandidate // Feeds to choose from when a page advertises several
+	Downloads      bool            // podcast downloads are enabled
+	Scrape         ScrapePreview   // scrape form being edited, the form is closed if its PageURL is empty
 }
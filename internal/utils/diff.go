@@ -0,0 +1,91 @@
+package utils
+
+import "strings"
+
+// maxDiffCells bounds the size of the table WordDiff builds. Larger texts
+// are shown as replaced entirely.
+const maxDiffCells = 4 << 20
+
+// DiffOp tells how a run of words changed between two texts
+type DiffOp int
+
+const (
+	DiffEqual  DiffOp = iota // in both texts
+	DiffDelete               // only in the old text
+	DiffInsert               // only in the new text
+)
+
+// DiffPart is a run of words sharing the same DiffOp
+type DiffPart struct {
+	Op   DiffOp
+	Text string
+}
+
+// WordDiff compares two texts word by word, based on their longest common
+// subsequence. Whitespace is normalized to single spaces.
+func WordDiff(before, after string) []DiffPart {
+	a, b := strings.Fields(before), strings.Fields(after)
+	if len(a)*len(b) > maxDiffCells {
+		return mergeParts([]DiffPart{
+			{Op: DiffDelete, Text: strings.Join(a, " ")},
+			{Op: DiffInsert, Text: strings.Join(b, " ")},
+		})
+	}
+
+	// lcs[i][j] is the length of the common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var parts []DiffPart
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			parts = append(parts, DiffPart{Op: DiffEqual, Text: a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			parts = append(parts, DiffPart{Op: DiffDelete, Text: a[i]})
+			i++
+		default:
+			parts = append(parts, DiffPart{Op: DiffInsert, Text: b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		parts = append(parts, DiffPart{Op: DiffDelete, Text: a[i]})
+	}
+	for ; j < len(b); j++ {
+		parts = append(parts, DiffPart{Op: DiffInsert, Text: b[j]})
+	}
+	return mergeParts(parts)
+}
+
+// mergeParts joins adjacent parts with the same op and drops empty ones
+func mergeParts(parts []DiffPart) []DiffPart {
+	var merged []DiffPart
+	for _, part := range parts {
+		if part.Text == "" {
+			continue
+		}
+		if n := len(merged); n > 0 && merged[n-1].Op == part.Op {
+			merged[n-1].Text += " " + part.Text
+			continue
+		}
+		merged = append(merged, part)
+	}
+	return merged
+}
@@ -0,0 +1,211 @@
+package utils
+
+import (
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// allowedTags maps the elements kept by SanitizeHTML to their allowed attributes
+var allowedTags = map[atom.Atom][]string{
+	atom.A:          {"href", "title"},
+	atom.Abbr:       {"title"},
+	atom.B:          nil,
+	atom.Blockquote: nil,
+	atom.Br:         nil,
+	atom.Code:       nil,
+	atom.Dd:         nil,
+	atom.Del:        nil,
+	atom.Div:        nil,
+	atom.Dl:         nil,
+	atom.Dt:         nil,
+	atom.Em:         nil,
+	atom.Figcaption: nil,
+	atom.Figure:     nil,
+	atom.H1:         nil,
+	atom.H2:         nil,
+	atom.H3:         nil,
+	atom.H4:         nil,
+	atom.H5:         nil,
+	atom.H6:         nil,
+	atom.Hr:         nil,
+	atom.I:          nil,
+	atom.Img:        {"src", "alt", "title", "width", "height"},
+	atom.Li:         nil,
+	atom.Ol:         nil,
+	atom.P:          nil,
+	atom.Pre:        nil,
+	atom.S:          nil,
+	atom.Small:      nil,
+	atom.Span:       nil,
+	atom.Strong:     nil,
+	atom.Sub:        nil,
+	atom.Sup:        nil,
+	atom.Table:      nil,
+	atom.Tbody:      nil,
+	atom.Td:         {"colspan", "rowspan"},
+	atom.Th:         {"colspan", "rowspan"},
+	atom.Thead:      nil,
+	atom.Tr:         nil,
+	atom.U:          nil,
+	atom.Ul:         nil,
+}
+
+// droppedTags are removed together with everything inside them
+var droppedTags = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Iframe:   true,
+	atom.Object:   true,
+	atom.Embed:    true,
+	atom.Noscript: true,
+	atom.Template: true,
+	atom.Form:     true,
+	atom.Svg:      true,
+	atom.Math:     true,
+}
+
+// SanitizeHTML reduces untrusted feed HTML to a small allowlist of
+// formatting elements and safe attributes. Links open in a new tab, and
+// only http, https and mailto URLs survive.
+func SanitizeHTML(input string) string {
+	var out strings.Builder
+	z := html.NewTokenizer(strings.NewReader(input))
+	skipDepth := 0
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			// io.EOF or malformed input, either way keep what was sanitized so far
+			return out.String()
+		}
+
+		token := z.Token()
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if droppedTags[token.DataAtom] {
+				if tt == html.StartTagToken {
+					skipDepth++
+				}
+				continue
+			}
+			if skipDepth > 0 {
+				continue
+			}
+			attrs, ok := allowedTags[token.DataAtom]
+			if !ok {
+				continue
+			}
+			writeStartTag(&out, token, attrs)
+
+		case html.EndTagToken:
+			if droppedTags[token.DataAtom] {
+				if skipDepth > 0 {
+					skipDepth--
+				}
+				continue
+			}
+			if skipDepth > 0 {
+				continue
+			}
+			if _, ok := allowedTags[token.DataAtom]; ok && !isVoid(token.DataAtom) {
+				out.WriteString("</" + token.DataAtom.String() + ">")
+			}
+
+		case html.TextToken:
+			if skipDepth == 0 {
+				out.WriteString(html.EscapeString(token.Data))
+			}
+		}
+	}
+}
+
+// writeStartTag writes a start tag keeping only the allowed attributes
+func writeStartTag(out *strings.Builder, token html.Token, allowed []string) {
+	out.WriteString("<" + token.DataAtom.String())
+	for _, attr := range token.Attr {
+		if attr.Namespace != "" || !contains(allowed, attr.Key) {
+			continue
+		}
+		value := attr.Val
+		if attr.Key == "href" || attr.Key == "src" {
+			var ok bool
+			if value, ok = safeURL(value); !ok {
+				continue
+			}
+		}
+		out.WriteString(" " + attr.Key + `="` + html.EscapeString(value) + `"`)
+	}
+	switch token.DataAtom {
+	case atom.A:
+		out.WriteString(` target="_blank" rel="noopener noreferrer"`)
+	case atom.Img:
+		out.WriteString(` loading="lazy"`)
+	}
+	out.WriteString(">")
+}
+
+// safeURL reports whether a URL uses a scheme that is safe to render
+func safeURL(raw string) (string, bool) {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto", "":
+		return raw, true
+	}
+	return "", false
+}
+
+// isVoid reports whether an element has no closing tag
+func isVoid(a atom.Atom) bool {
+	return a == atom.Br || a == atom.Hr || a == atom.Img
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// HTMLText returns the visible text of an HTML fragment, with the content
+// of dropped elements such as scripts left out
+func HTMLText(input string) string {
+	var out strings.Builder
+	z := html.NewTokenizer(strings.NewReader(input))
+	skipDepth := 0
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return strings.TrimSpace(out.String())
+		}
+
+		token := z.Token()
+		switch tt {
+		case html.StartTagToken:
+			if droppedTags[token.DataAtom] {
+				skipDepth++
+			}
+			out.WriteString(" ")
+		case html.EndTagToken:
+			if droppedTags[token.DataAtom] && skipDepth > 0 {
+				skipDepth--
+			}
+			out.WriteString(" ")
+		case html.SelfClosingTagToken:
+			out.WriteString(" ")
+		case html.TextToken:
+			if skipDepth == 0 {
+				out.WriteString(token.Data)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// ItemID returns a stable identifier for a feed item, derived from the feed
+// URL plus the item's RSS guid or Atom id. Items without one fall back to a
+// hash of their link and title.
+func ItemID(feedURL, guid, link, title string) string {
+	h := sha256.New()
+	h.Write([]byte(feedURL))
+	h.Write([]byte{0})
+	if guid != "" {
+		h.Write([]byte("guid:"))
+		h.Write([]byte(guid))
+	} else {
+		h.Write([]byte("content:"))
+		h.Write([]byte(link))
+		h.Write([]byte{0})
+		h.Write([]byte(title))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// IsItemID reports whether s has the shape of an ID made by ItemID, as
+// opposed to the links that keyed item state before items had IDs
+func IsItemID(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// ContentHash returns a hash of the parts of a feed item a reader sees, so
+// edits by the publisher can be told apart from unchanged items
+func ContentHash(title, description, content string) string {
+	h := sha256.New()
+	for _, part := range []string{title, description, content} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
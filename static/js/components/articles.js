@@ -12,7 +12,7 @@ export function initArticles() {
             const article = articleLink.closest('.article');
             if (article && article.dataset.read === 'false') {
                 // Mark as read before opening the link
-                markArticleAsRead(article.dataset.link);
+                markArticleAsRead(article.dataset.id);
             }
             return; // Let the link work normally
         }
@@ -24,8 +24,8 @@ export function initArticles() {
         const favoriteButton = event.target.closest('.favorite-toggle');
         if (favoriteButton) {
             event.stopPropagation(); // Prevent article selection when clicking favorite
-            const itemLink = favoriteButton.dataset.link;
-            toggleFavoriteStatus(itemLink, favoriteButton);
+            const itemId = favoriteButton.dataset.id;
+            toggleFavoriteStatus(itemId, favoriteButton);
             return;
         }
 
@@ -63,13 +63,13 @@ export function initArticles() {
     if (globalToggleReadButton) {
         globalToggleReadButton.addEventListener('click', () => {
             if (selectedArticle) {
-                const itemLink = selectedArticle.dataset.link;
-                if (!itemLink) {
-                    console.error('Selected article does not have a data-link attribute.');
+                const itemId = selectedArticle.dataset.id;
+                if (!itemId) {
+                    console.error('Selected article does not have a data-id attribute.');
                     return;
                 }
 
-                submitReadStatusForm(itemLink);
+                submitReadStatusForm(itemId);
             }
         });
     }
@@ -81,28 +81,28 @@ export function initArticles() {
         }
     }
     
-    function submitReadStatusForm(itemLink) {
+    function submitReadStatusForm(itemId) {
         const form = document.createElement('form');
         form.method = 'post';
         form.action = '/toggle-read';
 
-        const linkInput = document.createElement('input');
-        linkInput.type = 'hidden';
-        linkInput.name = 'link';
-        linkInput.value = itemLink;
-        form.appendChild(linkInput);
+        const idInput = document.createElement('input');
+        idInput.type = 'hidden';
+        idInput.name = 'id';
+        idInput.value = itemId;
+        form.appendChild(idInput);
 
         document.body.appendChild(form);
         form.submit();
     }
 
-    function toggleFavoriteStatus(itemLink, buttonElement) {
+    function toggleFavoriteStatus(itemId, buttonElement) {
         fetch('/toggle-favorite', {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/x-www-form-urlencoded',
             },
-            body: `link=${encodeURIComponent(itemLink)}`
+            body: `id=${encodeURIComponent(itemId)}`
         })
         .then(response => {
             if (response.ok) {
@@ -124,19 +124,19 @@ export function initArticles() {
         });
     }
 
-    function markArticleAsRead(itemLink) {
+    function markArticleAsRead(itemId) {
         // Send async request to mark as read without redirecting
         fetch('/toggle-read', {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/x-www-form-urlencoded',
             },
-            body: `link=${encodeURIComponent(itemLink)}`
+            body: `id=${encodeURIComponent(itemId)}`
         }).then(response => {
             if (response.ok) {
                 // Update the article's visual state immediately
                 const articles = document.querySelectorAll('.article');
-                const article = Array.from(articles).find(a => a.dataset.link === itemLink);
+                const article = Array.from(articles).find(a => a.dataset.id === itemId);
                 if (article) {
                     article.classList.remove('unread');
                     article.classList.add('read');